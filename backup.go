@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"ProxyaService/internal/backup"
+	"ProxyaService/internal/config"
+	"ProxyaService/internal/storage"
+)
+
+const backupUsage = "usage: app backup export [FILE] | app backup import FILE [merge|replace] [apply]"
+
+// runBackup implements the "backup" subcommand. Export writes to stdout without FILE;
+// import only validates unless "apply" is given.
+func runBackup(conf config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(backupUsage)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	st, err := storage.Open(ctx, conf.PostgresDSN)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	if err := st.Migrate(ctx); err != nil {
+		return err
+	}
+	// secrets are exported in plaintext and sealed with the current keys on import
+	keys, err := storage.LoadKeyring(conf.SecretKeys, conf.SecretKeysFile)
+	if err != nil {
+		return err
+	}
+	st = storage.NewSecretBox(st, keys)
+
+	switch args[0] {
+	case "export":
+		f, err := backup.Export(ctx, st)
+		if err != nil {
+			return err
+		}
+		var w io.Writer = os.Stdout
+		if len(args) > 1 {
+			out, err := os.OpenFile(args[1], os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+			w = out
+		}
+		if err := backup.Encode(w, f); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "exported %d users, %d roles, %d tokens, %d credentials, %d bans, %d settings\n",
+			len(f.Users), len(f.Roles), len(f.Tokens), len(f.Credentials), len(f.Bans), len(f.Settings))
+	case "import":
+		if len(args) < 2 {
+			return errors.New(backupUsage)
+		}
+		mode, apply := backup.ModeMerge, false
+		for _, a := range args[2:] {
+			switch a {
+			case "merge":
+				mode = backup.ModeMerge
+			case "replace":
+				mode = backup.ModeReplace
+			case "apply":
+				apply = true
+			default:
+				return errors.New(backupUsage)
+			}
+		}
+		in, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		f, err := backup.Decode(in)
+		if err != nil {
+			return err
+		}
+		rep, err := backup.Import(ctx, st, f, mode, !apply)
+		fmt.Printf("mode %s, format v%d from %s: %d users, %d roles, %d tokens, %d credentials, %d bans, %d settings\n",
+			rep.Mode, f.Version, f.CreatedAt.Format(time.RFC3339), rep.Users, rep.Roles, rep.Tokens, rep.Credentials, rep.Bans, rep.Settings)
+		for _, p := range rep.Problems {
+			fmt.Println("  -", p)
+		}
+		if err != nil {
+			return err
+		}
+		if apply {
+			fmt.Println("imported; restart running bots to pick up the data")
+		} else {
+			fmt.Println("dry run passed; add \"apply\" to import")
+		}
+	default:
+		return errors.New(backupUsage)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"ProxyaService/internal/reqctx"
+	"ProxyaService/internal/storage"
+)
+
+// Actions recorded in audit_events.
+const (
+	AuthSuccess    = "auth.success"
+	AuthFailure    = "auth.failure"
+	AuthLockout    = "auth.lockout"
+	LockoutCleared = "auth.lockout_cleared"
+	TokenIssue     = "token.issue"
+	TokenConsume   = "token.consume" // recorded by storage together with the consumption
+	RoleChange     = "user.role_change"
+	RoleSave       = "role.save"
+	RoleDelete     = "role.delete" // recorded by storage together with the reassignment
+	Ban            = "user.ban"
+	Unban          = "user.unban"
+	AccessRequest  = "access.request"
+	AccessApprove  = "access.approve"
+	AccessDeny     = "access.deny"
+	ConfigReload   = "config.reload"
+	TOTPEnroll     = "totp.enroll"
+	TOTPVerify     = "totp.verify"
+	TOTPFailure    = "totp.failure"
+	TOTPReset      = "totp.reset"
+	BackupExport   = "backup.export"
+	BackupImport   = "backup.import"
+	UserForget     = "user.forget"
+	UserDataExport = "user.data_export"
+)
+
+// Actions lists every action above; /audit accepts only these as a filter.
+var Actions = []string{
+	AuthSuccess, AuthFailure, AuthLockout, LockoutCleared, TokenIssue, TokenConsume,
+	RoleChange, RoleSave, RoleDelete, Ban, Unban, AccessRequest, AccessApprove, AccessDeny,
+	ConfigReload, TOTPEnroll, TOTPVerify, TOTPFailure, TOTPReset, BackupExport, BackupImport,
+	UserForget, UserDataExport,
+}
+
+// Recorder writes audit events to slog and, once a store is attached, to audit_events.
+// Failing to persist an event never fails the operation being audited.
+type Recorder struct {
+	log   *slog.Logger
+	mu    sync.RWMutex
+	store storage.Store
+}
+
+func New(log *slog.Logger) *Recorder {
+	return &Recorder{log: log}
+}
+
+func (r *Recorder) AttachStore(store storage.Store) {
+	r.mu.Lock()
+	r.store = store
+	r.mu.Unlock()
+}
+
+func (r *Recorder) loadStore() storage.Store {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.store
+}
+
+// Record logs and persists the event. actor and target of 0 are stored as NULL.
+func (r *Recorder) Record(ctx context.Context, action string, actor, target int64, meta map[string]any) {
+	if r == nil {
+		return
+	}
+	ev := storage.AuditEvent{Action: action, Metadata: meta}
+	if actor != 0 {
+		ev.Actor = &actor
+	}
+	if target != 0 {
+		ev.Target = &target
+	}
+	attrs := []any{"action", action, "actor", actor, "target", target}
+	for k, v := range meta {
+		attrs = append(attrs, k, v)
+	}
+	attrs = append(attrs, reqctx.LogAttrs(ctx)...)
+	r.log.Info("audit", attrs...)
+	st := r.loadStore()
+	if st == nil {
+		return
+	}
+	if err := st.InsertAuditEvent(ctx, ev); err != nil {
+		r.log.Error("audit persist failed", "action", action, "error", err)
+	}
+}
+
+// List returns persisted events newest first.
+func (r *Recorder) List(ctx context.Context, f storage.AuditFilter) ([]storage.AuditEvent, error) {
+	st := r.loadStore()
+	if st == nil {
+		return nil, nil
+	}
+	return st.ListAuditEvents(ctx, f)
+}
@@ -6,84 +6,277 @@ import (
 	"sync"
 	"time"
 
+	"ProxyaService/internal/audit"
+	"ProxyaService/internal/config"
+	"ProxyaService/internal/roles"
 	"ProxyaService/internal/storage"
 )
 
 type Service struct {
 	allowedUserIDs map[int64]struct{}
-	validTokens    map[string]struct{}
+	adminUserIDs   map[int64]struct{}
+	validTokens    map[string]config.StaticToken
 	authenticated  map[int64]struct{}
+	failures       map[int64]*failState
+	bans           map[int64]storage.Ban
+	elevated       map[int64]time.Time
+	totp           TOTPPolicy
+	memberChats    []MemberChat
+	memberTTL      time.Duration
+	members        map[int64]membership
+	checkMember    MembershipFunc
+	defaultRole    storage.Role
+	roles          *roles.Registry
+	policy         LockoutPolicy
+	onLockout      LockoutHook
+	audit          *audit.Recorder
 	mu             sync.RWMutex
-	store          *storage.Store
+	store          storage.Store
 }
 
-func New(allowed []int64, tokens []string) *Service {
-	ids := make(map[int64]struct{}, len(allowed))
-	for _, id := range allowed {
-		ids[id] = struct{}{}
+type Options struct {
+	AllowedUserIDs []int64
+	AdminUserIDs   []int64 // bootstrap admins, always granted RoleAdmin
+	Tokens         []config.StaticToken
+	DefaultRole    storage.Role
+	Roles          *roles.Registry
+	Lockout        LockoutPolicy
+	MemberChats    []MemberChat  // members of these chats are authorized
+	MemberTTL      time.Duration // how long a membership check is cached
+	TOTP           TOTPPolicy
+}
+
+// OptionsFromConfig maps configuration onto Options.
+func OptionsFromConfig(conf config.Config, r *roles.Registry) Options {
+	var memberChats []MemberChat
+	for _, c := range conf.MemberChats {
+		memberChats = append(memberChats, MemberChat{ChatID: c.ChatID, Role: storage.Role(c.Role)})
 	}
-	ts := make(map[string]struct{}, len(tokens))
-	for _, t := range tokens {
-		if t != "" {
-			ts[t] = struct{}{}
+	return Options{
+		AllowedUserIDs: conf.AllowedUserIDs,
+		AdminUserIDs:   conf.AdminUserIDs,
+		Tokens:         conf.AuthTokens,
+		DefaultRole:    storage.Role(conf.DefaultRole),
+		Roles:          r,
+		Lockout: LockoutPolicy{
+			MaxFailures: conf.AuthMaxFailures,
+			BaseDelay:   time.Duration(conf.AuthBackoffSec) * time.Second,
+			MaxDelay:    5 * time.Minute,
+			Lockout:     time.Duration(conf.AuthLockoutMin) * time.Minute,
+			Window:      time.Hour,
+		},
+		MemberChats: memberChats,
+		MemberTTL:   time.Duration(conf.MemberCacheMin) * time.Minute,
+		TOTP: TOTPPolicy{
+			Required: conf.TOTPRequired,
+			Window:   time.Duration(conf.TOTPWindowMin) * time.Minute,
+			Issuer:   conf.TOTPIssuer,
+		},
+	}
+}
+
+func New(opts Options) *Service {
+	ts := make(map[string]config.StaticToken, len(opts.Tokens))
+	for _, t := range opts.Tokens {
+		if t.Value != "" {
+			ts[t.Value] = t
 		}
 	}
-	return &Service{allowedUserIDs: ids, validTokens: ts, authenticated: make(map[int64]struct{})}
+	defaultRole := opts.DefaultRole
+	if defaultRole == "" {
+		defaultRole = storage.RoleFree
+	}
+	return &Service{
+		allowedUserIDs: idSet(opts.AllowedUserIDs),
+		adminUserIDs:   idSet(opts.AdminUserIDs),
+		validTokens:    ts,
+		authenticated:  make(map[int64]struct{}),
+		failures:       make(map[int64]*failState),
+		bans:           make(map[int64]storage.Ban),
+		elevated:       make(map[int64]time.Time),
+		totp:           opts.TOTP,
+		memberChats:    opts.MemberChats,
+		memberTTL:      opts.MemberTTL,
+		members:        make(map[int64]membership),
+		defaultRole:    defaultRole,
+		roles:          opts.Roles,
+		policy:         opts.Lockout,
+	}
+}
+
+// Reload atomically swaps whitelist, bootstrap admins, static tokens, member chats,
+// lockout and TOTP policy. Authenticated sessions, bans and lockouts are kept; cached memberships
+// are dropped so new chat settings apply right away.
+func (s *Service) Reload(opts Options) {
+	next := New(opts)
+	s.mu.Lock()
+	s.allowedUserIDs = next.allowedUserIDs
+	s.adminUserIDs = next.adminUserIDs
+	s.validTokens = next.validTokens
+	s.defaultRole = next.defaultRole
+	s.policy = next.policy
+	s.memberChats = next.memberChats
+	s.memberTTL = next.memberTTL
+	s.members = next.members
+	s.totp = next.totp
+	s.mu.Unlock()
+}
+
+func idSet(ids []int64) map[int64]struct{} {
+	res := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		res[id] = struct{}{}
+	}
+	return res
 }
 
 // AuthorizeUserByID returns true if user is allowed by ID whitelist (or if whitelist empty => open).
+// Members of configured chats are allowed as well; their membership is checked via Telegram and cached.
 func (s *Service) AuthorizeUserByID(userID int64) bool {
+	if _, banned := s.BanOf(userID); banned {
+		return false
+	}
+	if ok, restricted := s.authorizeLocal(userID); ok || !restricted {
+		return ok
+	}
+	member, _ := s.memberRole(userID)
+	return member
+}
+
+// authorizeLocal checks in-memory lists. restricted is false when access is open to everyone.
+func (s *Service) authorizeLocal(userID int64) (ok, restricted bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	// Bootstrap admins are always allowed
+	if _, ok := s.adminUserIDs[userID]; ok {
+		return true, true
+	}
 	// If whitelist set, allow if in whitelist
 	if len(s.allowedUserIDs) > 0 {
 		if _, ok := s.allowedUserIDs[userID]; ok {
-			return true
+			return true, true
 		}
 		// If user authenticated via token, allow as well
-		if _, ok := s.authenticated[userID]; ok {
-			return true
-		}
-		return false
+		_, ok := s.authenticated[userID]
+		return ok, true
 	}
-	// No whitelist: if there are tokens configured, require authentication
-	if len(s.validTokens) > 0 {
+	// No whitelist: if there are tokens or member chats configured, require authentication
+	if len(s.validTokens) > 0 || len(s.memberChats) > 0 {
 		_, ok := s.authenticated[userID]
-		return ok
+		return ok, true
 	}
-	// Open access if no whitelist and no tokens
-	return true
+	// Open access if no whitelist, no tokens and no member chats
+	return true, false
+}
+
+// IsAuthenticated reports whether the user passed token authentication or was granted access.
+func (s *Service) IsAuthenticated(userID int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.authenticated[userID]
+	return ok
 }
 
 var ErrInvalidToken = errors.New("invalid token")
 
 // Authenticate stores auth in context if token is valid (stateless simple flow).
+// Repeated failures are throttled with exponential backoff and end in a temporary lockout.
 func (s *Service) Authenticate(ctx context.Context, token string, userID int64) (context.Context, error) {
+	if _, banned := s.BanOf(userID); banned {
+		s.audit.Record(ctx, audit.AuthFailure, userID, userID, map[string]any{"reason": "banned"})
+		return ctx, ErrBanned
+	}
+	if err := s.checkAttempt(userID, time.Now()); err != nil {
+		return ctx, err
+	}
 	s.mu.RLock()
-	_, ok := s.validTokens[token]
+	static, ok := s.validTokens[token]
 	s.mu.RUnlock()
+	// expired static tokens are rejected like expired DB tokens
+	if ok && static.ExpiresAt != nil && time.Now().After(*static.ExpiresAt) {
+		ok = false
+	}
 	if !ok {
 		// try DB token if available
 		if s.store != nil {
-			if role, err := s.store.ConsumeToken(ctx, token, userID); err == nil {
+			role, err := s.store.ConsumeToken(ctx, token, userID)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				// the token may be valid: an outage, timeout or cancellation is not a failed attempt
+				return ctx, err
+			}
+			if err == nil {
 				// mark authed and persist role
 				s.mu.Lock()
 				s.authenticated[userID] = struct{}{}
 				s.mu.Unlock()
+				s.recordSuccess(userID)
 				_ = s.store.UpsertUser(ctx, storage.User{ID: userID, Role: role, IsAuthed: true, UpdatedAt: time.Now()})
+				s.audit.Record(ctx, audit.AuthSuccess, userID, userID, map[string]any{"method": "db_token", "role": string(role)})
 				return ctx, nil
 			}
 		}
+		if err := s.recordFailure(userID, time.Now()); err != nil {
+			s.audit.Record(ctx, audit.AuthLockout, 0, userID, map[string]any{"retry_after": s.RetryAfter(userID).String()})
+			return ctx, err
+		}
+		s.audit.Record(ctx, audit.AuthFailure, userID, userID, map[string]any{"reason": "invalid_token"})
 		return ctx, ErrInvalidToken
 	}
 	// mark user as authenticated (memory) and persist user
 	s.mu.Lock()
 	s.authenticated[userID] = struct{}{}
 	s.mu.Unlock()
+	s.recordSuccess(userID)
+	role := s.staticTokenRole(static)
 	if s.store != nil {
-		_ = s.store.UpsertUser(ctx, storage.User{ID: userID, Role: storage.RoleFree, IsAuthed: true, UpdatedAt: time.Now()})
+		_ = s.store.UpsertUser(ctx, storage.User{ID: userID, Role: role, IsAuthed: true, UpdatedAt: time.Now()})
 	}
+	s.audit.Record(ctx, audit.AuthSuccess, userID, userID, map[string]any{"method": "static_token", "role": string(role)})
 	return ctx, nil
 }
 
-func (s *Service) AttachStore(store *storage.Store) { s.store = store }
+// staticTokenRole returns the role granted by a static token; unknown roles fall back to the registry default.
+func (s *Service) staticTokenRole(t config.StaticToken) storage.Role {
+	if t.Role == "" {
+		return storage.RoleFree
+	}
+	role := storage.Role(t.Role)
+	if !s.roles.Exists(role) {
+		return s.roles.Fallback()
+	}
+	return role
+}
+
+func (s *Service) AttachStore(store storage.Store) { s.store = store }
+
+// SetAudit makes the service record security events.
+func (s *Service) SetAudit(r *audit.Recorder) { s.audit = r }
+
+// LoadAuthenticated restores users marked as authenticated in DB, so access survives
+// restarts. The in-memory set is replaced, e.g. after a backup was restored.
+func (s *Service) LoadAuthenticated(ctx context.Context) error {
+	if s.store == nil {
+		return nil
+	}
+	ids, err := s.store.ListAuthedUserIDs(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.authenticated = idSet(ids)
+	s.mu.Unlock()
+	return nil
+}
+
+// Grant gives the user access with the given role, e.g. after an approved access request.
+func (s *Service) Grant(ctx context.Context, userID int64, role storage.Role) error {
+	if s.store != nil {
+		if err := s.store.UpsertUser(ctx, storage.User{ID: userID, Role: role, IsAuthed: true}); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.authenticated[userID] = struct{}{}
+	s.mu.Unlock()
+	return nil
+}
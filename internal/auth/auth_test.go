@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"ProxyaService/internal/roles"
+	"ProxyaService/internal/storage"
+)
+
+// faultyStore fails token lookups with err.
+type faultyStore struct {
+	*storage.Memory
+	err error
+}
+
+func (s *faultyStore) ConsumeToken(context.Context, string, int64) (storage.Role, error) {
+	return "", s.err
+}
+
+func newLockoutService(st storage.Store) *Service {
+	s := New(Options{
+		Roles:   roles.New(BuiltinRoles(10, 60, 500), storage.RoleFree),
+		Lockout: LockoutPolicy{MaxFailures: 2, Lockout: time.Hour, Window: time.Hour},
+	})
+	s.AttachStore(st)
+	return s
+}
+
+// TestAuthenticateCountsOnlyInvalidTokens checks that storage faults do not
+// lock out a user whose token may well be valid.
+func TestAuthenticateCountsOnlyInvalidTokens(t *testing.T) {
+	ctx := context.Background()
+	for _, fault := range []error{storage.ErrUnavailable, context.DeadlineExceeded, context.Canceled, errors.New("connection reset")} {
+		s := newLockoutService(&faultyStore{Memory: storage.NewMemory(), err: fault})
+		for range 5 {
+			if _, err := s.Authenticate(ctx, "token", 1); !errors.Is(err, fault) {
+				t.Fatalf("%v: got %v", fault, err)
+			}
+		}
+		if d := s.RetryAfter(1); d != 0 {
+			t.Fatalf("%v: counted as a failure, retry after %v", fault, d)
+		}
+	}
+
+	s := newLockoutService(storage.NewMemory())
+	if _, err := s.Authenticate(ctx, "missing", 1); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("unknown token: %v", err)
+	}
+	if _, err := s.Authenticate(ctx, "missing", 1); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("second unknown token: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"ProxyaService/internal/audit"
+	"ProxyaService/internal/storage"
+)
+
+var (
+	ErrBanned      = errors.New("user is banned")
+	ErrBanAdmin    = errors.New("bootstrap admin cannot be banned")
+	ErrBanNotFound = errors.New("ban not found")
+)
+
+// LoadBans replaces the in-memory bans with the active ones from DB.
+func (s *Service) LoadBans(ctx context.Context) error {
+	if s.store == nil {
+		return nil
+	}
+	list, err := s.store.ListActiveBans(ctx)
+	if err != nil {
+		return err
+	}
+	bans := make(map[int64]storage.Ban, len(list))
+	for _, b := range list {
+		bans[b.TelegramID] = b
+	}
+	s.mu.Lock()
+	s.bans = bans
+	s.mu.Unlock()
+	return nil
+}
+
+// BanOf returns the active ban of the user, if any. Expired bans are dropped lazily.
+func (s *Service) BanOf(userID int64) (storage.Ban, bool) {
+	s.mu.RLock()
+	b, ok := s.bans[userID]
+	s.mu.RUnlock()
+	if !ok {
+		return storage.Ban{}, false
+	}
+	if !b.Active(time.Now()) {
+		s.mu.Lock()
+		delete(s.bans, userID)
+		s.mu.Unlock()
+		return storage.Ban{}, false
+	}
+	return b, true
+}
+
+// Ban cuts the user off: records the ban, drops the authenticated session and
+// cached membership, and revokes unconsumed tokens the user has issued.
+func (s *Service) Ban(ctx context.Context, b storage.Ban) error {
+	if s.IsAdminID(b.TelegramID) {
+		return ErrBanAdmin
+	}
+	if s.store != nil {
+		if err := s.store.UpsertBan(ctx, b); err != nil {
+			return err
+		}
+		if err := s.store.SetUserAuthed(ctx, b.TelegramID, false); err != nil {
+			return err
+		}
+		if _, err := s.store.RevokeTokensIssuedBy(ctx, b.TelegramID); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.bans[b.TelegramID] = b
+	delete(s.authenticated, b.TelegramID)
+	delete(s.members, b.TelegramID)
+	s.mu.Unlock()
+	meta := map[string]any{"reason": b.Reason}
+	if b.ExpiresAt != nil {
+		meta["expires_at"] = b.ExpiresAt.Format(time.RFC3339)
+	}
+	s.audit.Record(ctx, audit.Ban, b.BannedBy, b.TelegramID, meta)
+	return nil
+}
+
+// Unban lifts the ban. The user has to authenticate again to regain token-based access.
+func (s *Service) Unban(ctx context.Context, userID, actor int64) error {
+	if err := s.unban(ctx, userID); err != nil {
+		return err
+	}
+	s.audit.Record(ctx, audit.Unban, actor, userID, nil)
+	return nil
+}
+
+func (s *Service) unban(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	_, ok := s.bans[userID]
+	delete(s.bans, userID)
+	s.mu.Unlock()
+	if s.store != nil {
+		err := s.store.DeleteBan(ctx, userID)
+		if errors.Is(err, storage.ErrNotFound) && !ok {
+			return ErrBanNotFound
+		}
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	if !ok {
+		return ErrBanNotFound
+	}
+	return nil
+}
+
+// Bans returns active bans sorted by creation time.
+func (s *Service) Bans() []storage.Ban {
+	now := time.Now()
+	s.mu.RLock()
+	res := make([]storage.Ban, 0, len(s.bans))
+	for _, b := range s.bans {
+		if b.Active(now) {
+			res = append(res, b)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+	return res
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrTooManyAttempts = errors.New("too many attempts, retry later")
+	ErrLockedOut       = errors.New("locked out after repeated failures")
+)
+
+// LockoutPolicy controls how failed authentication attempts are penalised.
+// Zero MaxFailures disables tracking.
+type LockoutPolicy struct {
+	MaxFailures int           // failures before a temporary lockout
+	BaseDelay   time.Duration // backoff after the first failure, doubled on each next one
+	MaxDelay    time.Duration // cap for the backoff between attempts
+	Lockout     time.Duration // how long a lockout lasts
+	Window      time.Duration // failures older than this are forgotten
+}
+
+// failureLimit bounds the tracked users; past it expired entries are swept and,
+// if that is not enough, the oldest one that is not locked out is dropped.
+const failureLimit = 10000
+
+type failState struct {
+	failures    int
+	lastFailure time.Time
+	nextAttempt time.Time
+	lockedUntil time.Time
+}
+
+// LockoutHook is called once when a user gets locked out.
+type LockoutHook func(userID int64, failures int, until time.Time)
+
+// SetLockoutHook registers a callback fired when a lockout starts.
+func (s *Service) SetLockoutHook(h LockoutHook) {
+	s.mu.Lock()
+	s.onLockout = h
+	s.mu.Unlock()
+}
+
+// checkAttempt reports whether the user may try a token right now.
+func (s *Service) checkAttempt(userID int64, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.failures[userID]
+	if !ok {
+		return nil
+	}
+	if now.Before(st.lockedUntil) {
+		return ErrLockedOut
+	}
+	if s.policy.Window > 0 && now.Sub(st.lastFailure) > s.policy.Window {
+		delete(s.failures, userID)
+		return nil
+	}
+	if now.Before(st.nextAttempt) {
+		return ErrTooManyAttempts
+	}
+	return nil
+}
+
+// recordFailure counts a failed attempt and returns ErrLockedOut if it triggered a lockout.
+func (s *Service) recordFailure(userID int64, now time.Time) error {
+	s.mu.Lock()
+	if s.policy.MaxFailures <= 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	st, ok := s.failures[userID]
+	if !ok || (s.policy.Window > 0 && now.Sub(st.lastFailure) > s.policy.Window) || (!st.lockedUntil.IsZero() && !now.Before(st.lockedUntil)) {
+		if !ok && len(s.failures) >= failureLimit {
+			s.sweepFailures(now)
+		}
+		st = &failState{}
+		s.failures[userID] = st
+	}
+	st.failures++
+	st.lastFailure = now
+	st.nextAttempt = now.Add(s.backoff(st.failures))
+	if st.failures < s.policy.MaxFailures {
+		s.mu.Unlock()
+		return nil
+	}
+	st.lockedUntil = now.Add(s.policy.Lockout)
+	hook, failures, until := s.onLockout, st.failures, st.lockedUntil
+	s.mu.Unlock()
+	if hook != nil {
+		hook(userID, failures, until)
+	}
+	return ErrLockedOut
+}
+
+// sweepFailures drops entries past their window and lockout. Must be called with s.mu held.
+func (s *Service) sweepFailures(now time.Time) {
+	var oldest int64
+	var oldestAt time.Time
+	for id, st := range s.failures {
+		if now.Before(st.lockedUntil) {
+			continue
+		}
+		if s.policy.Window > 0 && now.Sub(st.lastFailure) > s.policy.Window {
+			delete(s.failures, id)
+			continue
+		}
+		if oldestAt.IsZero() || st.lastFailure.Before(oldestAt) {
+			oldest, oldestAt = id, st.lastFailure
+		}
+	}
+	if len(s.failures) >= failureLimit && !oldestAt.IsZero() {
+		delete(s.failures, oldest)
+	}
+}
+
+func (s *Service) backoff(failures int) time.Duration {
+	d := s.policy.BaseDelay
+	for i := 1; i < failures && d > 0; i++ {
+		d *= 2
+		if s.policy.MaxDelay > 0 && d >= s.policy.MaxDelay {
+			return s.policy.MaxDelay
+		}
+	}
+	return d
+}
+
+func (s *Service) recordSuccess(userID int64) {
+	s.mu.Lock()
+	delete(s.failures, userID)
+	s.mu.Unlock()
+}
+
+// RetryAfter returns how long the user has to wait before the next attempt.
+func (s *Service) RetryAfter(userID int64) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st, ok := s.failures[userID]
+	if !ok {
+		return 0
+	}
+	now := time.Now()
+	if now.Before(st.lockedUntil) {
+		return st.lockedUntil.Sub(now)
+	}
+	if now.Before(st.nextAttempt) {
+		return st.nextAttempt.Sub(now)
+	}
+	return 0
+}
+
+// ClearLockout forgets failed attempts of the user. Returns false if there was nothing to clear.
+func (s *Service) ClearLockout(userID int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.failures[userID]; !ok {
+		return false
+	}
+	delete(s.failures, userID)
+	return true
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"ProxyaService/internal/storage"
+)
+
+// MemberChat grants access to members of a Telegram chat. Empty Role keeps
+// the role from DB (or the default role).
+type MemberChat struct {
+	ChatID int64
+	Role   storage.Role
+}
+
+// MembershipFunc asks Telegram whether the user is a member of the chat.
+type MembershipFunc func(chatID, userID int64) (bool, error)
+
+type membership struct {
+	member    bool
+	role      storage.Role
+	checkedAt time.Time
+}
+
+// SetMembershipChecker enables chat-membership authorization.
+func (s *Service) SetMembershipChecker(check MembershipFunc) {
+	s.mu.Lock()
+	s.checkMember = check
+	s.mu.Unlock()
+}
+
+// MemberChats returns the configured chats.
+func (s *Service) MemberChats() []MemberChat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]MemberChat(nil), s.memberChats...)
+}
+
+// IsMemberChat reports whether membership in chatID grants access.
+func (s *Service) IsMemberChat(chatID int64) bool {
+	for _, c := range s.MemberChats() {
+		if c.ChatID == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+// memberRole returns whether the user is a member of any configured chat and the
+// role mapped to the first such chat. Results are cached for memberTTL.
+func (s *Service) memberRole(userID int64) (bool, storage.Role) {
+	s.mu.RLock()
+	m, cached := s.members[userID]
+	ttl := s.memberTTL
+	s.mu.RUnlock()
+	if cached && time.Since(m.checkedAt) < ttl {
+		return m.member, m.role
+	}
+	m, err := s.lookupMembership(userID)
+	if err != nil {
+		return false, ""
+	}
+	return m.member, m.role
+}
+
+// lookupMembership asks Telegram and caches the answer. Transient API errors are not cached.
+func (s *Service) lookupMembership(userID int64) (membership, error) {
+	s.mu.RLock()
+	chats, check := s.memberChats, s.checkMember
+	s.mu.RUnlock()
+	m := membership{checkedAt: time.Now()}
+	if len(chats) == 0 || check == nil {
+		return m, nil
+	}
+	for _, c := range chats {
+		ok, err := check(c.ChatID, userID)
+		if err != nil {
+			return membership{}, err
+		}
+		if ok {
+			m.member, m.role = true, c.Role
+			break
+		}
+	}
+	s.mu.Lock()
+	s.members[userID] = m
+	s.mu.Unlock()
+	return m, nil
+}
+
+// ForgetMembership drops the cached membership of the user, e.g. after a chat_member update.
+func (s *Service) ForgetMembership(userID int64) {
+	s.mu.Lock()
+	delete(s.members, userID)
+	s.mu.Unlock()
+}
+
+// RecheckMembers re-validates cached members and returns users who lost membership.
+func (s *Service) RecheckMembers(ctx context.Context) []int64 {
+	s.mu.RLock()
+	var ids []int64
+	for id, m := range s.members {
+		if m.member {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.RUnlock()
+	var revoked []int64
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		m, err := s.lookupMembership(id)
+		if err == nil && !m.member {
+			revoked = append(revoked, id)
+		}
+	}
+	return revoked
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+
+	"ProxyaService/internal/storage"
+)
+
+// Permission is a capability a command requires from the caller.
+type Permission string
+
+const (
+	PermNone         Permission = ""              // public command
+	PermProxy        Permission = "proxy"         // get proxy settings
+	PermIssueTokens  Permission = "tokens.issue"  // mint invite tokens
+	PermManageUsers  Permission = "users.manage"  // unlock users, assign roles and similar
+	PermManageRoles  Permission = "roles.manage"  // create, edit and delete roles
+	PermNotification Permission = "notifications" // receive security notifications
+	PermReload       Permission = "config.reload" // reload configuration at runtime
+	PermViewAudit    Permission = "audit.view"    // read the audit log
+	PermViewMetrics  Permission = "metrics.view"  // read service counters
+	PermBackup       Permission = "data.backup"   // export and restore backups
+	PermAll          Permission = "*"             // every permission, including ones added later
+)
+
+// AllPermissions lists every permission known to the bot.
+var AllPermissions = []Permission{PermProxy, PermIssueTokens, PermManageUsers, PermManageRoles, PermNotification, PermReload, PermViewAudit, PermViewMetrics, PermBackup}
+
+// SensitivePermissions are the permissions whose holders must use a second factor
+// when the TOTP policy requires it.
+var SensitivePermissions = []Permission{PermIssueTokens, PermManageUsers, PermManageRoles, PermReload, PermBackup}
+
+// BuiltinRoles returns the default free/premium/admin definitions with the given per-minute limits.
+func BuiltinRoles(ratePerMinFree, ratePerMinPremium, ratePerMinAdmin int) []storage.RoleDef {
+	return []storage.RoleDef{
+		{Name: storage.RoleFree, DisplayName: "Free", RatePerMin: ratePerMinFree, Permissions: []string{string(PermProxy)}},
+		{Name: storage.RolePremium, DisplayName: "Premium", RatePerMin: ratePerMinPremium, Permissions: []string{string(PermProxy)}},
+		{Name: storage.RoleAdmin, DisplayName: "Administrator", RatePerMin: ratePerMinAdmin, Permissions: []string{string(PermAll)}},
+	}
+}
+
+// KnownPermission reports whether p is one of AllPermissions or PermAll.
+func KnownPermission(p string) bool {
+	if p == string(PermAll) {
+		return true
+	}
+	for _, known := range AllPermissions {
+		if string(known) == p {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdminID reports whether the user is one of the bootstrap admins from config.
+func (s *Service) IsAdminID(userID int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.adminUserIDs[userID]
+	return ok
+}
+
+// AdminIDs returns bootstrap admin IDs from config.
+func (s *Service) AdminIDs() []int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]int64, 0, len(s.adminUserIDs))
+	for id := range s.adminUserIDs {
+		res = append(res, id)
+	}
+	return res
+}
+
+// RoleOf resolves the effective role: bootstrap admins first, then the role mapped to
+// a member chat, then DB, then the default role. Roles missing from the registry
+// resolve to its fallback role.
+func (s *Service) RoleOf(ctx context.Context, userID int64) storage.Role {
+	if s.IsAdminID(userID) {
+		return storage.RoleAdmin
+	}
+	if member, role := s.memberRole(userID); member && role != "" && s.roles.Exists(role) {
+		return role
+	}
+	if s.store != nil {
+		if u, err := s.store.GetUser(ctx, userID); err == nil {
+			if s.roles.Exists(u.Role) {
+				return u.Role
+			}
+			return s.roles.Fallback()
+		}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.defaultRole
+}
+
+// HasPermission checks the permission against the user's effective role.
+// Everything except PermNone additionally requires passing AuthorizeUserByID.
+func (s *Service) HasPermission(ctx context.Context, userID int64, perm Permission) bool {
+	if perm == PermNone {
+		return true
+	}
+	if !s.AuthorizeUserByID(userID) {
+		return false
+	}
+	return s.roles.Allows(s.RoleOf(ctx, userID), string(perm))
+}
+
+// SeedAdmins persists bootstrap admins with RoleAdmin so they are visible in DB.
+func (s *Service) SeedAdmins(ctx context.Context) error {
+	if s.store == nil {
+		return nil
+	}
+	for _, id := range s.AdminIDs() {
+		if err := s.store.UpsertUser(ctx, storage.User{ID: id, Role: storage.RoleAdmin, IsAuthed: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"ProxyaService/internal/storage"
+)
+
+var ErrForgetAdmin = errors.New("bootstrap admin cannot be forgotten")
+
+// Forget erases the user's stored data and ends their session. Bans and lockouts
+// stay in place. Access granted by configuration (whitelist, member chats) is not
+// affected, since it does not depend on stored data.
+func (s *Service) Forget(ctx context.Context, userID int64, policy storage.AuditPolicy) (storage.ForgetResult, error) {
+	if s.IsAdminID(userID) {
+		return storage.ForgetResult{}, ErrForgetAdmin
+	}
+	if s.store == nil {
+		return storage.ForgetResult{}, ErrNoStore
+	}
+	res, err := s.store.ForgetUser(ctx, userID, policy)
+	if err != nil {
+		return res, err
+	}
+	s.mu.Lock()
+	delete(s.authenticated, userID)
+	delete(s.elevated, userID)
+	delete(s.members, userID)
+	s.mu.Unlock()
+	return res, nil
+}
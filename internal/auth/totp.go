@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"ProxyaService/internal/audit"
+	"ProxyaService/internal/storage"
+	"ProxyaService/internal/totp"
+)
+
+var (
+	ErrNoStore          = errors.New("storage is not configured")
+	ErrTOTPNotEnrolled  = errors.New("second factor is not enrolled")
+	ErrTOTPInvalidCode  = errors.New("invalid second factor code")
+	ErrTOTPCodeReplayed = errors.New("second factor code already used")
+)
+
+// TOTPPolicy controls the second factor for sensitive admin commands.
+type TOTPPolicy struct {
+	Required bool          // holders of SensitivePermissions cannot run sensitive commands without a code
+	Window   time.Duration // how long a verified code keeps the session elevated
+	Issuer   string        // shown in authenticator apps
+}
+
+// EnrollTOTP creates a new unconfirmed secret and returns its otpauth:// URI.
+// The enrollment is confirmed by the first successful VerifyTOTP.
+func (s *Service) EnrollTOTP(ctx context.Context, userID int64, account string) (string, error) {
+	if s.store == nil {
+		return "", ErrNoStore
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	if err := s.store.PutTOTPSecret(ctx, userID, secret); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	delete(s.elevated, userID)
+	issuer := s.totp.Issuer
+	s.mu.Unlock()
+	if account == "" {
+		account = strconv.FormatInt(userID, 10)
+	}
+	s.audit.Record(ctx, audit.TOTPEnroll, userID, userID, nil)
+	return totp.URI(issuer, account, secret), nil
+}
+
+// VerifyTOTP checks a code and elevates the session for the configured window.
+// Failures count towards the same lockout as token authentication.
+func (s *Service) VerifyTOTP(ctx context.Context, userID int64, code string) error {
+	if s.store == nil {
+		return ErrNoStore
+	}
+	if err := s.checkAttempt(userID, time.Now()); err != nil {
+		return err
+	}
+	sec, err := s.store.GetTOTPSecret(ctx, userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(sec.Secret, code, time.Now(), 1)
+	if !ok {
+		s.audit.Record(ctx, audit.TOTPFailure, userID, userID, nil)
+		if err := s.recordFailure(userID, time.Now()); err != nil {
+			return err
+		}
+		return ErrTOTPInvalidCode
+	}
+	fresh, err := s.store.UseTOTPStep(ctx, userID, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrTOTPCodeReplayed
+	}
+	s.recordSuccess(userID)
+	s.mu.Lock()
+	s.elevated[userID] = time.Now().Add(s.totp.Window)
+	s.mu.Unlock()
+	s.audit.Record(ctx, audit.TOTPVerify, userID, userID, map[string]any{"confirmed_enrollment": !sec.Confirmed})
+	return nil
+}
+
+// Elevated reports whether the user verified a code within the window.
+func (s *Service) Elevated(userID int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	until, ok := s.elevated[userID]
+	return ok && time.Now().Before(until)
+}
+
+// NeedsTOTP reports whether a sensitive command from the user must be preceded by a code:
+// always for holders of a sensitive permission when the policy requires it, otherwise
+// only for users with a confirmed enrollment.
+func (s *Service) NeedsTOTP(ctx context.Context, userID int64) (bool, error) {
+	s.mu.RLock()
+	required := s.totp.Required
+	s.mu.RUnlock()
+	if required && s.holdsSensitive(ctx, userID) {
+		return true, nil
+	}
+	if s.store == nil {
+		return false, nil
+	}
+	sec, err := s.store.GetTOTPSecret(ctx, userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return sec.Confirmed, nil
+}
+
+func (s *Service) holdsSensitive(ctx context.Context, userID int64) bool {
+	role := s.RoleOf(ctx, userID)
+	for _, p := range SensitivePermissions {
+		if s.roles.Allows(role, string(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// TOTPEnrolled reports whether the user has a confirmed second factor.
+func (s *Service) TOTPEnrolled(ctx context.Context, userID int64) (bool, error) {
+	if s.store == nil {
+		return false, nil
+	}
+	sec, err := s.store.GetTOTPSecret(ctx, userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil && sec.Confirmed, err
+}
+
+// ResetTOTP removes the user's second factor, e.g. after a lost device.
+func (s *Service) ResetTOTP(ctx context.Context, userID, actor int64) error {
+	if s.store == nil {
+		return ErrNoStore
+	}
+	if err := s.store.DeleteTOTPSecret(ctx, userID); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return ErrTOTPNotEnrolled
+		}
+		return err
+	}
+	s.mu.Lock()
+	delete(s.elevated, userID)
+	s.mu.Unlock()
+	s.audit.Record(ctx, audit.TOTPReset, actor, userID, nil)
+	return nil
+}
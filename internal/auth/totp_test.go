@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"ProxyaService/internal/storage"
+	"ProxyaService/internal/totp"
+)
+
+// TestVerifyTOTPRejectsReplay checks that a code cannot be used twice within
+// its validity window.
+func TestVerifyTOTPRejectsReplay(t *testing.T) {
+	ctx := context.Background()
+	s := newLockoutService(storage.NewMemory())
+	uri, err := s.EnrollTOTP(ctx, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri == "" {
+		t.Fatal("empty enrollment URI")
+	}
+	sec, err := s.store.GetTOTPSecret(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.CodeAt(sec.Secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.VerifyTOTP(ctx, 1, code); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := s.VerifyTOTP(ctx, 1, code); !errors.Is(err, ErrTOTPCodeReplayed) {
+		t.Fatalf("replay: %v", err)
+	}
+}
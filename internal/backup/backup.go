@@ -0,0 +1,311 @@
+// Package backup converts the store contents to and from a versioned JSON file.
+// The file holds invite tokens and TOTP secrets in clear text and must be kept private.
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"ProxyaService/internal/auth"
+	"ProxyaService/internal/storage"
+)
+
+// Version is the format written by Export. Decode accepts this and older versions.
+const Version = 1
+
+var ErrInvalid = errors.New("backup is invalid")
+
+// Mode says how Import combines the file with existing data.
+type Mode string
+
+const (
+	ModeMerge   Mode = "merge"   // upsert rows from the file, keep everything else
+	ModeReplace Mode = "replace" // drop users, roles, tokens, credentials, bans and settings first
+)
+
+type File struct {
+	Version     int               `json:"version"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Users       []User            `json:"users"`
+	Roles       []Role            `json:"roles"`
+	Tokens      []Token           `json:"tokens"`
+	Credentials []Credential      `json:"credentials"`
+	Bans        []Ban             `json:"bans"`
+	Settings    map[string]string `json:"settings"`
+}
+
+type User struct {
+	ID        int64     `json:"telegram_id"`
+	Role      string    `json:"role"`
+	IsAuthed  bool      `json:"is_authed"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Role struct {
+	Name           string    `json:"name"`
+	DisplayName    string    `json:"display_name,omitempty"`
+	RatePerMin     int       `json:"rate_per_min"`
+	TrafficQuotaMB int64     `json:"traffic_quota_mb"`
+	MaxConnections int       `json:"max_connections"`
+	ProxyPools     []string  `json:"proxy_pools"`
+	Permissions    []string  `json:"permissions"`
+	Builtin        bool      `json:"builtin"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+type Token struct {
+	Token      string     `json:"token"`
+	Role       string     `json:"role"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	ConsumedAt *time.Time `json:"consumed_at,omitempty"`
+	IssuedBy   int64      `json:"issued_by"`
+	IssuedTo   *int64     `json:"issued_to,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Credential is a TOTP enrollment.
+type Credential struct {
+	TelegramID   int64     `json:"telegram_id"`
+	Type         string    `json:"type"`
+	Secret       string    `json:"secret"`
+	Confirmed    bool      `json:"confirmed"`
+	LastUsedStep int64     `json:"last_used_step"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type Ban struct {
+	TelegramID int64      `json:"telegram_id"`
+	Reason     string     `json:"reason,omitempty"`
+	BannedBy   int64      `json:"banned_by"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+const credentialTOTP = "totp"
+
+// Export reads a consistent snapshot of the store.
+func Export(ctx context.Context, store storage.Store) (File, error) {
+	d, err := store.ExportData(ctx)
+	if err != nil {
+		return File{}, err
+	}
+	return fromDataset(d), nil
+}
+
+// Encode writes the file as indented JSON.
+func Encode(w io.Writer, f File) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(f)
+}
+
+// Decode parses a backup and rejects unknown fields and unsupported versions.
+func Decode(r io.Reader) (File, error) {
+	var f File
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return File{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if f.Version < 1 || f.Version > Version {
+		return File{}, fmt.Errorf("%w: unsupported version %d (supported up to %d)", ErrInvalid, f.Version, Version)
+	}
+	return f, nil
+}
+
+// Report describes what an import would change. Problems make the file unusable.
+type Report struct {
+	Mode        Mode
+	Users       int
+	Roles       int
+	Tokens      int
+	Credentials int
+	Bans        int
+	Settings    int
+	Problems    []string
+}
+
+func (r Report) OK() bool { return len(r.Problems) == 0 }
+
+// Validate checks the file against itself and, in merge mode, the roles already in the store.
+func Validate(ctx context.Context, store storage.Store, f File, mode Mode) (Report, error) {
+	rep := Report{
+		Mode: mode, Users: len(f.Users), Roles: len(f.Roles), Tokens: len(f.Tokens),
+		Credentials: len(f.Credentials), Bans: len(f.Bans), Settings: len(f.Settings),
+	}
+	problem := func(format string, args ...any) { rep.Problems = append(rep.Problems, fmt.Sprintf(format, args...)) }
+	if mode != ModeMerge && mode != ModeReplace {
+		problem("unknown mode %q", mode)
+		return rep, nil
+	}
+
+	roles := make(map[string]bool)
+	if mode == ModeMerge {
+		existing, err := store.ListRoles(ctx)
+		if err != nil {
+			return rep, err
+		}
+		for _, r := range existing {
+			roles[string(r.Name)] = true
+		}
+	}
+	seenRoles := make(map[string]bool)
+	for _, r := range f.Roles {
+		switch {
+		case r.Name == "":
+			problem("role without name")
+		case seenRoles[r.Name]:
+			problem("duplicate role %s", r.Name)
+		}
+		seenRoles[r.Name] = true
+		roles[r.Name] = true
+		for _, p := range r.Permissions {
+			if !auth.KnownPermission(p) {
+				problem("role %s: unknown permission %s", r.Name, p)
+			}
+		}
+	}
+
+	seenUsers := make(map[int64]bool)
+	for _, u := range f.Users {
+		switch {
+		case u.ID == 0:
+			problem("user without telegram_id")
+		case seenUsers[u.ID]:
+			problem("duplicate user %d", u.ID)
+		case !roles[u.Role]:
+			problem("user %d: unknown role %q", u.ID, u.Role)
+		}
+		seenUsers[u.ID] = true
+	}
+
+	seenTokens := make(map[string]bool)
+	for i, t := range f.Tokens {
+		switch {
+		case t.Token == "":
+			problem("token #%d is empty", i+1)
+		case seenTokens[t.Token]:
+			problem("token #%d is duplicated", i+1)
+		case !roles[t.Role]:
+			problem("token #%d: unknown role %q", i+1, t.Role)
+		}
+		seenTokens[t.Token] = true
+	}
+
+	seenCreds := make(map[int64]bool)
+	for _, c := range f.Credentials {
+		switch {
+		case c.Type != credentialTOTP:
+			problem("credential of user %d: unsupported type %q", c.TelegramID, c.Type)
+		case c.TelegramID == 0 || c.Secret == "":
+			problem("credential without telegram_id or secret")
+		case seenCreds[c.TelegramID]:
+			problem("duplicate credential of user %d", c.TelegramID)
+		}
+		seenCreds[c.TelegramID] = true
+	}
+
+	seenBans := make(map[int64]bool)
+	for _, b := range f.Bans {
+		switch {
+		case b.TelegramID == 0:
+			problem("ban without telegram_id")
+		case seenBans[b.TelegramID]:
+			problem("duplicate ban of user %d", b.TelegramID)
+		}
+		seenBans[b.TelegramID] = true
+	}
+
+	for k := range f.Settings {
+		if k == "" {
+			problem("setting with empty key")
+		}
+	}
+	return rep, nil
+}
+
+// Import validates the file and, unless dryRun, writes it in one transaction.
+// It returns ErrInvalid together with the report if validation fails.
+func Import(ctx context.Context, store storage.Store, f File, mode Mode, dryRun bool) (Report, error) {
+	rep, err := Validate(ctx, store, f, mode)
+	if err != nil {
+		return rep, err
+	}
+	if !rep.OK() {
+		return rep, ErrInvalid
+	}
+	if dryRun {
+		return rep, nil
+	}
+	return rep, store.ImportData(ctx, toDataset(f), mode == ModeReplace)
+}
+
+func fromDataset(d storage.Dataset) File {
+	f := File{Version: Version, CreatedAt: time.Now().UTC(), Settings: d.Settings}
+	if f.Settings == nil {
+		f.Settings = map[string]string{}
+	}
+	f.Users = make([]User, 0, len(d.Users))
+	for _, u := range d.Users {
+		f.Users = append(f.Users, User{ID: u.ID, Role: string(u.Role), IsAuthed: u.IsAuthed, CreatedAt: u.CreatedAt, UpdatedAt: u.UpdatedAt})
+	}
+	f.Roles = make([]Role, 0, len(d.Roles))
+	for _, r := range d.Roles {
+		f.Roles = append(f.Roles, Role{
+			Name: string(r.Name), DisplayName: r.DisplayName, RatePerMin: r.RatePerMin, TrafficQuotaMB: r.TrafficQuotaMB,
+			MaxConnections: r.MaxConnections, ProxyPools: r.ProxyPools, Permissions: r.Permissions, Builtin: r.Builtin,
+			CreatedAt: r.CreatedAt, UpdatedAt: r.UpdatedAt,
+		})
+	}
+	f.Tokens = make([]Token, 0, len(d.Tokens))
+	for _, t := range d.Tokens {
+		f.Tokens = append(f.Tokens, Token{Token: t.Token, Role: string(t.Role), ExpiresAt: t.ExpiresAt, ConsumedAt: t.ConsumedAt, IssuedBy: t.IssuedBy, IssuedTo: t.IssuedTo, CreatedAt: t.CreatedAt})
+	}
+	f.Credentials = make([]Credential, 0, len(d.TOTPSecrets))
+	for _, t := range d.TOTPSecrets {
+		f.Credentials = append(f.Credentials, Credential{TelegramID: t.TelegramID, Type: credentialTOTP, Secret: t.Secret, Confirmed: t.Confirmed, LastUsedStep: t.LastUsedStep, CreatedAt: t.CreatedAt})
+	}
+	f.Bans = make([]Ban, 0, len(d.Bans))
+	for _, b := range d.Bans {
+		f.Bans = append(f.Bans, Ban{TelegramID: b.TelegramID, Reason: b.Reason, BannedBy: b.BannedBy, ExpiresAt: b.ExpiresAt, CreatedAt: b.CreatedAt})
+	}
+	return f
+}
+
+// toDataset converts the file back; missing timestamps default to now.
+func toDataset(f File) storage.Dataset {
+	now := time.Now()
+	ts := func(t time.Time) time.Time {
+		if t.IsZero() {
+			return now
+		}
+		return t
+	}
+	d := storage.Dataset{Settings: f.Settings}
+	for _, u := range f.Users {
+		d.Users = append(d.Users, storage.User{ID: u.ID, Role: storage.Role(u.Role), IsAuthed: u.IsAuthed, CreatedAt: ts(u.CreatedAt), UpdatedAt: ts(u.UpdatedAt)})
+	}
+	for _, r := range f.Roles {
+		d.Roles = append(d.Roles, storage.RoleDef{
+			Name: storage.Role(r.Name), DisplayName: r.DisplayName, RatePerMin: r.RatePerMin, TrafficQuotaMB: r.TrafficQuotaMB,
+			MaxConnections: r.MaxConnections, ProxyPools: r.ProxyPools, Permissions: r.Permissions, Builtin: r.Builtin,
+			CreatedAt: ts(r.CreatedAt), UpdatedAt: ts(r.UpdatedAt),
+		})
+	}
+	for _, t := range f.Tokens {
+		d.Tokens = append(d.Tokens, storage.Token{Token: t.Token, Role: storage.Role(t.Role), ExpiresAt: t.ExpiresAt, ConsumedAt: t.ConsumedAt, IssuedBy: t.IssuedBy, IssuedTo: t.IssuedTo, CreatedAt: ts(t.CreatedAt)})
+	}
+	for _, c := range f.Credentials {
+		d.TOTPSecrets = append(d.TOTPSecrets, storage.TOTPSecret{TelegramID: c.TelegramID, Secret: c.Secret, Confirmed: c.Confirmed, LastUsedStep: c.LastUsedStep, CreatedAt: ts(c.CreatedAt)})
+	}
+	for _, b := range f.Bans {
+		d.Bans = append(d.Bans, storage.Ban{TelegramID: b.TelegramID, Reason: b.Reason, BannedBy: b.BannedBy, ExpiresAt: b.ExpiresAt, CreatedAt: ts(b.CreatedAt)})
+	}
+	return d
+}
@@ -0,0 +1,254 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ProxyaService/internal/audit"
+	"ProxyaService/internal/config"
+	"ProxyaService/internal/storage"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// Callback uniques of access request buttons.
+const (
+	cbRequestAccess = "access_request"
+	cbApproveAccess = "access_approve"
+	cbDenyAccess    = "access_deny"
+)
+
+// accessNotifyLimit bounds the notification times kept; past it expired ones are dropped.
+const accessNotifyLimit = 10000
+
+// accessNotifier remembers when each user's request was last sent to admins, so
+// repeating /request_access does not flood them.
+type accessNotifier struct {
+	mu   sync.Mutex
+	last map[int64]time.Time
+}
+
+// due reports whether the user's request may be sent again and, if so, records it.
+func (n *accessNotifier) due(id int64, every time.Duration, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if prev, ok := n.last[id]; ok && now.Sub(prev) < every {
+		return false
+	}
+	if n.last == nil {
+		n.last = make(map[int64]time.Time)
+	}
+	if len(n.last) >= accessNotifyLimit {
+		for k, t := range n.last {
+			if now.Sub(t) >= every {
+				delete(n.last, k)
+			}
+		}
+	}
+	n.last[id] = now
+	return true
+}
+
+func (s *Service) accessRequestMarkup() *tele.ReplyMarkup {
+	m := &tele.ReplyMarkup{}
+	m.Inline(m.Row(m.Data("Запросить доступ", cbRequestAccess)))
+	return m
+}
+
+func (s *Service) reviewMarkup(id int64) *tele.ReplyMarkup {
+	m := &tele.ReplyMarkup{}
+	rid := strconv.FormatInt(id, 10)
+	m.Inline(m.Row(
+		m.Data("Одобрить ("+s.cfg().DefaultRole+")", cbApproveAccess, rid),
+		m.Data("Отклонить", cbDenyAccess, rid),
+	))
+	return m
+}
+
+func formatAccessRequest(r storage.AccessRequest) string {
+	name := strings.TrimSpace(r.FirstName + " " + r.LastName)
+	if name == "" {
+		name = "<без имени>"
+	}
+	username := "-"
+	if r.Username != "" {
+		username = "@" + r.Username
+	}
+	msg := fmt.Sprintf("Запрос доступа #%d\nПользователь: %s (%s)\nID: %d\nЯзык: %s", r.ID, name, username, r.TelegramID, safe(r.LanguageCode))
+	if r.Message != "" {
+		msg += "\nСообщение: " + r.Message
+	}
+	return msg
+}
+
+// handleRequestAccess serves both the "Request access" button and /request_access [message].
+func (s *Service) handleRequestAccess(c tele.Context) error {
+	if c.Callback() != nil {
+		_ = c.Respond()
+	}
+	uid := c.Sender().ID
+	if s.auth.AuthorizeUserByID(uid) {
+		return c.Send("У вас уже есть доступ. Используйте /proxy", s.mainMenu())
+	}
+	conf := s.cfg()
+	if wait := s.accessRetryWait(c, conf); wait > 0 {
+		return c.Send(fmt.Sprintf("Ваш запрос отклонён. Повторный запрос возможен через %s.", wait.Round(time.Minute)))
+	}
+	var message string
+	if c.Callback() == nil {
+		message = strings.TrimSpace(c.Message().Payload)
+	}
+	u := c.Sender()
+	req, created, err := s.store.CreateAccessRequest(s.ctx(c), storage.AccessRequest{
+		TelegramID:   uid,
+		Username:     u.Username,
+		FirstName:    u.FirstName,
+		LastName:     u.LastName,
+		LanguageCode: u.LanguageCode,
+		Message:      message,
+	})
+	if err != nil {
+		s.log.Error("access request create failed", "user", uid, "error", err)
+		return c.Send(storeErrorMessage(err, "Не удалось отправить запрос. Попробуйте позже."))
+	}
+	s.audit.Record(s.ctx(c), audit.AccessRequest, uid, uid, map[string]any{"request": req.ID, "new": created})
+	// a new request always reaches admins; comments on a pending one at most once per AccessNotifyMin
+	notify := created || message != "" && s.accessNotified.due(uid, time.Duration(conf.AccessNotifyMin)*time.Minute, time.Now())
+	if notify {
+		go s.notifyAdmins(s.runCtx, formatAccessRequest(req), s.reviewMarkup(req.ID))
+	}
+	switch {
+	case created:
+		return c.Send("Запрос отправлен администраторам. Добавить комментарий: /request_access <текст>")
+	case message != "" && !notify:
+		return c.Send("Комментарий сохранён. Ваш запрос уже на рассмотрении.")
+	}
+	return c.Send("Ваш запрос уже на рассмотрении.")
+}
+
+// accessRetryWait returns how long a user whose last request was denied has to
+// wait before asking again, or 0.
+func (s *Service) accessRetryWait(c tele.Context, conf config.Config) time.Duration {
+	last, err := s.store.LastAccessDecision(s.ctx(c), c.Sender().ID)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			s.log.Warn("load last access decision failed", "user", c.Sender().ID, "error", err)
+		}
+		return 0
+	}
+	if last.Status != storage.AccessDenied || last.DecidedAt == nil {
+		return 0
+	}
+	return time.Until(last.DecidedAt.Add(time.Duration(conf.AccessRetryHours) * time.Hour))
+}
+
+// /requests
+func (s *Service) handleListRequests(c tele.Context) error {
+	reqs, err := s.store.ListPendingAccessRequests(s.ctx(c))
+	if err != nil {
+		s.log.Error("list access requests failed", "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка чтения запросов"))
+	}
+	if len(reqs) == 0 {
+		return c.Send("Нет ожидающих запросов")
+	}
+	for _, r := range reqs {
+		if err := c.Send(formatAccessRequest(r), s.reviewMarkup(r.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestArgs parses "<id> [role]" from a command payload or "id" from callback data.
+func requestArgs(c tele.Context) (int64, string, error) {
+	var args []string
+	if c.Callback() != nil {
+		args = []string{c.Callback().Data}
+	} else {
+		args = strings.Fields(c.Message().Payload)
+	}
+	if len(args) < 1 {
+		return 0, "", errors.New("missing request id")
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(args) >= 2 {
+		return id, args[1], nil
+	}
+	return id, "", nil
+}
+
+// replyDecision answers a review callback or command and updates the review message.
+func (s *Service) replyDecision(c tele.Context, text string) error {
+	if c.Callback() != nil {
+		_ = c.Respond(&tele.CallbackResponse{Text: text})
+		return c.Edit(c.Callback().Message.Text + "\n\n" + text)
+	}
+	return c.Send(text)
+}
+
+// /approve <id> [role] and the approve button
+func (s *Service) handleApprove(c tele.Context) error {
+	id, roleArg, err := requestArgs(c)
+	if err != nil {
+		return c.Send("Использование: /approve <id> [" + strings.Join(s.roleNames(), "|") + "]")
+	}
+	role := storage.Role(s.cfg().DefaultRole)
+	if roleArg != "" {
+		role = storage.Role(roleArg)
+	}
+	if !s.roles.Exists(role) {
+		return c.Send("Неизвестная роль: " + string(role))
+	}
+	ctx := s.ctx(c)
+	admin := c.Sender().ID
+	if !s.canGrant(ctx, admin, role) {
+		return c.Send(grantDeniedMessage)
+	}
+	req, err := s.store.DecideAccessRequest(ctx, id, storage.AccessApproved, role, admin)
+	if errors.Is(err, storage.ErrNotFound) {
+		return s.replyDecision(c, "Запрос не найден или уже рассмотрен")
+	}
+	if err != nil {
+		s.log.Error("access approve failed", "request", id, "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка обработки запроса"))
+	}
+	if err := s.auth.Grant(ctx, req.TelegramID, role); err != nil {
+		s.log.Error("grant access failed", "user", req.TelegramID, "error", err)
+		return c.Send("Запрос одобрен, но выдать доступ не удалось")
+	}
+	s.audit.Record(ctx, audit.AccessApprove, admin, req.TelegramID, map[string]any{"request": id, "role": string(role)})
+	if _, err := s.bot.Send(&tele.User{ID: req.TelegramID}, "Доступ одобрен. Ваша роль: "+describeRole(s.roles.Get(role))+"\nИспользуйте /proxy", s.mainMenu()); err != nil {
+		s.log.Warn("notify approved user failed", "user", req.TelegramID, "error", err)
+	}
+	return s.replyDecision(c, fmt.Sprintf("✅ Одобрено (%s), администратор %d", role, admin))
+}
+
+// /deny <id> and the deny button
+func (s *Service) handleDeny(c tele.Context) error {
+	id, _, err := requestArgs(c)
+	if err != nil {
+		return c.Send("Использование: /deny <id>")
+	}
+	admin := c.Sender().ID
+	req, err := s.store.DecideAccessRequest(s.ctx(c), id, storage.AccessDenied, "", admin)
+	if errors.Is(err, storage.ErrNotFound) {
+		return s.replyDecision(c, "Запрос не найден или уже рассмотрен")
+	}
+	if err != nil {
+		s.log.Error("access deny failed", "request", id, "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка обработки запроса"))
+	}
+	s.audit.Record(s.ctx(c), audit.AccessDeny, admin, req.TelegramID, map[string]any{"request": id})
+	if _, err := s.bot.Send(&tele.User{ID: req.TelegramID}, "Запрос доступа отклонён администратором."); err != nil {
+		s.log.Warn("notify denied user failed", "user", req.TelegramID, "error", err)
+	}
+	return s.replyDecision(c, fmt.Sprintf("❌ Отклонено, администратор %d", admin))
+}
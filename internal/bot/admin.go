@@ -0,0 +1,121 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"ProxyaService/internal/audit"
+	"ProxyaService/internal/auth"
+	"ProxyaService/internal/storage"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// notifyAdmins sends a message to bootstrap admins and every admin known to the DB.
+func (s *Service) notifyAdmins(ctx context.Context, msg string, opts ...interface{}) {
+	if s.bot == nil {
+		return
+	}
+	ids := s.auth.AdminIDs()
+	admins, err := s.store.ListUsersByRole(ctx, storage.RoleAdmin)
+	if err != nil {
+		s.log.Error("list admins failed", "error", err)
+	}
+	for _, a := range admins {
+		ids = append(ids, a.ID)
+	}
+	seen := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		if !s.auth.HasPermission(ctx, id, auth.PermNotification) {
+			continue
+		}
+		if _, err := s.bot.Send(&tele.User{ID: id}, msg, opts...); err != nil {
+			s.log.Warn("admin notify failed", "admin", id, "error", err)
+		}
+	}
+}
+
+// onLockout is fired by auth.Service when a user exhausts its attempts.
+func (s *Service) onLockout(userID int64, failures int, until time.Time) {
+	s.log.Warn("auth lockout", "user", userID, "failures", failures, "until", until)
+	msg := fmt.Sprintf("⚠️ Подозрительная активность: пользователь %d ввёл неверный токен %d раз подряд.\nЗаблокирован до %s.\nСнять блокировку: /unlock %d",
+		userID, failures, until.Format("2006-01-02 15:04:05"), userID)
+	go s.notifyAdmins(s.runCtx, msg)
+}
+
+// authThrottledMessage returns a reply for backoff, lockout and storage errors, or
+// "" for an invalid token.
+func (s *Service) authThrottledMessage(err error, uid int64) string {
+	wait := s.auth.RetryAfter(uid).Round(time.Second)
+	switch {
+	case errors.Is(err, auth.ErrLockedOut):
+		return fmt.Sprintf("Слишком много неудачных попыток. Доступ к аутентификации заблокирован на %s.", wait)
+	case errors.Is(err, auth.ErrTooManyAttempts):
+		return fmt.Sprintf("Слишком часто. Повторите попытку через %s.", wait)
+	case errors.Is(err, storage.ErrUnavailable):
+		return "Хранилище временно недоступно, попробуйте позже."
+	case err != nil && !errors.Is(err, auth.ErrInvalidToken) && !errors.Is(err, auth.ErrBanned):
+		return "Не удалось проверить токен, попробуйте позже."
+	}
+	return ""
+}
+
+func (s *Service) handleIssueToken(c tele.Context) error {
+	uid := c.Sender().ID
+	parts := strings.Fields(c.Message().Payload)
+	if len(parts) < 1 {
+		return c.Send("Использование: /issue_token <" + strings.Join(s.roleNames(), "|") + "> [30m|24h|7d]")
+	}
+	role := storage.Role(parts[0])
+	if !s.roles.Exists(role) {
+		return c.Send("Неизвестная роль: " + parts[0])
+	}
+	if !s.canGrant(s.ctx(c), uid, role) {
+		return c.Send(grantDeniedMessage)
+	}
+	var ttl *time.Duration
+	if len(parts) >= 2 {
+		if d, err := time.ParseDuration(parts[1]); err == nil {
+			ttl = &d
+		}
+	}
+	token := genToken()
+	var exp *time.Time
+	if ttl != nil {
+		t := time.Now().Add(*ttl)
+		exp = &t
+	}
+	if err := s.store.CreateToken(s.ctx(c), token, role, exp, uid, nil); err != nil {
+		s.log.Error("token create failed", "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка создания токена"))
+	}
+	meta := map[string]any{"role": string(role)}
+	if exp != nil {
+		meta["expires_at"] = exp.Format(time.RFC3339)
+	}
+	s.audit.Record(s.ctx(c), audit.TokenIssue, uid, 0, meta)
+	return c.Send("Токен: " + token)
+}
+
+func (s *Service) handleUnlock(c tele.Context) error {
+	args := strings.Fields(c.Message().Payload)
+	if len(args) < 1 {
+		return c.Send("Использование: /unlock <user_id|@username>")
+	}
+	target, err := s.resolveUser(s.ctx(c), args[0])
+	if err != nil {
+		return c.Send(userArgError(args[0], err))
+	}
+	if !s.auth.ClearLockout(target) {
+		return c.Send("Блокировки нет")
+	}
+	s.audit.Record(s.ctx(c), audit.LockoutCleared, c.Sender().ID, target, nil)
+	return c.Send(fmt.Sprintf("Блокировка пользователя %d снята", target))
+}
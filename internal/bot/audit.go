@@ -0,0 +1,155 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"ProxyaService/internal/audit"
+	"ProxyaService/internal/storage"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+const (
+	cbAuditPage   = "audit_page"
+	auditPageSize = 15
+	auditMaxPage  = 99999 // keeps the page callback data under Telegram's 64 bytes
+)
+
+var errUnknownAuditAction = errors.New("unknown audit action")
+
+type auditQuery struct {
+	userID int64
+	action string
+	page   int
+}
+
+// parseAuditQuery parses "[user_id|@username] [action=...] [page=N]" or callback data "user|action|page".
+func (s *Service) parseAuditQuery(ctx context.Context, c tele.Context) (auditQuery, error) {
+	q := auditQuery{page: 1}
+	if c.Callback() != nil {
+		parts := strings.Split(c.Callback().Data, "|")
+		if len(parts) != 3 {
+			return q, fmt.Errorf("bad callback data")
+		}
+		q.userID, _ = strconv.ParseInt(parts[0], 10, 64)
+		q.action = parts[1]
+		q.page, _ = strconv.Atoi(parts[2])
+		if q.page < 1 {
+			q.page = 1
+		}
+		return q, nil
+	}
+	for _, arg := range strings.Fields(c.Message().Payload) {
+		switch {
+		case strings.HasPrefix(arg, "action="):
+			// only known actions: the filter is carried in callback data, which Telegram caps at 64 bytes
+			q.action = strings.TrimPrefix(arg, "action=")
+			if !slices.Contains(audit.Actions, q.action) {
+				return q, fmt.Errorf("%w: %q", errUnknownAuditAction, q.action)
+			}
+		case strings.HasPrefix(arg, "page="):
+			p, err := strconv.Atoi(strings.TrimPrefix(arg, "page="))
+			if err != nil || p < 1 || p > auditMaxPage {
+				return q, fmt.Errorf("bad page %q", arg)
+			}
+			q.page = p
+		default:
+			id, err := s.resolveUser(ctx, arg)
+			if err != nil {
+				return q, fmt.Errorf("user %q: %w", arg, err)
+			}
+			q.userID = id
+		}
+	}
+	return q, nil
+}
+
+func (q auditQuery) data(page int) string {
+	return fmt.Sprintf("%d|%s|%d", q.userID, q.action, page)
+}
+
+func formatAuditEvent(ev storage.AuditEvent) string {
+	line := ev.CreatedAt.Format("01-02 15:04:05") + " " + ev.Action
+	if ev.Actor != nil {
+		line += fmt.Sprintf(" by %d", *ev.Actor)
+	}
+	if ev.Target != nil && (ev.Actor == nil || *ev.Target != *ev.Actor) {
+		line += fmt.Sprintf(" → %d", *ev.Target)
+	}
+	if len(ev.Metadata) > 0 {
+		if b, err := json.Marshal(ev.Metadata); err == nil {
+			line += " " + string(b)
+		}
+	}
+	return line
+}
+
+// /audit [user_id] [action=...] [page=N]
+func (s *Service) handleAudit(c tele.Context) error {
+	if c.Callback() != nil {
+		_ = c.Respond()
+	}
+	q, err := s.parseAuditQuery(s.ctx(c), c)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.Send("Пользователь не найден: бот знает только тех, кто ему писал")
+	}
+	if errors.Is(err, errUnknownAuditAction) {
+		return c.Send("Неизвестное действие. Доступные: " + strings.Join(audit.Actions, ", "))
+	}
+	if err != nil {
+		return c.Send("Использование: /audit [user_id|@username] [action=auth.failure] [page=N]")
+	}
+	f := storage.AuditFilter{Action: q.action, Limit: auditPageSize + 1, Offset: (q.page - 1) * auditPageSize}
+	if q.userID != 0 {
+		f.UserID = &q.userID
+	}
+	events, err := s.audit.List(s.ctx(c), f)
+	if err != nil {
+		s.log.Error("audit list failed", "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка чтения журнала"))
+	}
+	hasNext := len(events) > auditPageSize
+	if hasNext {
+		events = events[:auditPageSize]
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Журнал аудита, стр. %d", q.page)
+	if q.userID != 0 {
+		fmt.Fprintf(&b, ", пользователь %d", q.userID)
+	}
+	if q.action != "" {
+		b.WriteString(", действие " + q.action)
+	}
+	b.WriteString(":\n")
+	if len(events) == 0 {
+		b.WriteString("пусто")
+	}
+	for _, ev := range events {
+		b.WriteString(formatAuditEvent(ev))
+		b.WriteString("\n")
+	}
+	var m *tele.ReplyMarkup
+	var row []tele.Btn
+	if q.page > 1 || hasNext {
+		m = &tele.ReplyMarkup{}
+	}
+	if q.page > 1 {
+		row = append(row, m.Data("← Назад", cbAuditPage, q.data(q.page-1)))
+	}
+	if hasNext {
+		row = append(row, m.Data("Дальше →", cbAuditPage, q.data(q.page+1)))
+	}
+	if len(row) > 0 {
+		m.Inline(m.Row(row...))
+	}
+	if c.Callback() != nil {
+		return c.Edit(b.String(), m)
+	}
+	return c.Send(b.String(), m)
+}
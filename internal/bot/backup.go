@@ -0,0 +1,137 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"ProxyaService/internal/audit"
+	"ProxyaService/internal/backup"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// maxBackupSize caps downloaded backup files.
+const maxBackupSize = 20 << 20
+
+// /backup — sends the backup as a JSON document. Only in a private chat: the file holds tokens and TOTP secrets.
+func (s *Service) handleBackup(c tele.Context) error {
+	if c.Chat().Type != tele.ChatPrivate {
+		return c.Send("Резервная копия содержит секреты, запросите её в личном чате с ботом.")
+	}
+	ctx := s.ctx(c)
+	f, err := backup.Export(ctx, s.store)
+	if err != nil {
+		s.log.Error("backup export failed", "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка выгрузки данных"))
+	}
+	var buf bytes.Buffer
+	if err := backup.Encode(&buf, f); err != nil {
+		return err
+	}
+	s.audit.Record(ctx, audit.BackupExport, c.Sender().ID, 0, map[string]any{
+		"users": len(f.Users), "roles": len(f.Roles), "tokens": len(f.Tokens), "credentials": len(f.Credentials),
+	})
+	doc := &tele.Document{
+		File:     tele.FromReader(&buf),
+		FileName: "proxya-backup-" + f.CreatedAt.Format("20060102-150405") + ".json",
+		Caption:  fmt.Sprintf("Резервная копия, формат v%d. Храните файл в безопасном месте: в нём токены и секреты TOTP.", f.Version),
+	}
+	return c.Send(doc)
+}
+
+const restoreUsage = "Ответьте этой командой на сообщение с файлом резервной копии: /restore [merge|replace] [apply]\nБез apply выполняется только проверка."
+
+// /restore [merge|replace] [apply] — reply to a backup document
+func (s *Service) handleRestore(c tele.Context) error {
+	mode, apply := backup.ModeMerge, false
+	for _, a := range strings.Fields(c.Message().Payload) {
+		switch strings.ToLower(a) {
+		case "merge":
+			mode = backup.ModeMerge
+		case "replace":
+			mode = backup.ModeReplace
+		case "apply":
+			apply = true
+		default:
+			return c.Send(restoreUsage)
+		}
+	}
+	reply := c.Message().ReplyTo
+	if reply == nil || reply.Document == nil {
+		return c.Send(restoreUsage)
+	}
+	if reply.Document.FileSize > maxBackupSize {
+		return c.Send("Файл слишком большой")
+	}
+	rc, err := s.bot.File(&reply.Document.File)
+	if err != nil {
+		s.log.Error("backup download failed", "error", err)
+		return c.Send("Не удалось скачать файл")
+	}
+	defer rc.Close()
+	f, err := backup.Decode(io.LimitReader(rc, maxBackupSize))
+	if err != nil {
+		return c.Send("Файл не похож на резервную копию: " + err.Error())
+	}
+
+	ctx := s.ctx(c)
+	rep, err := backup.Import(ctx, s.store, f, mode, !apply)
+	switch {
+	case errors.Is(err, backup.ErrInvalid):
+		return c.Send(formatRestoreReport(rep, f, false) + "\n\nИмпорт невозможен, исправьте ошибки.")
+	case err != nil:
+		s.log.Error("backup import failed", "error", err)
+		return c.Send("Ошибка импорта: " + err.Error())
+	case !apply:
+		return c.Send(formatRestoreReport(rep, f, false) + "\n\nПроверка пройдена. Для применения: /restore " + string(mode) + " apply")
+	}
+	s.audit.Record(ctx, audit.BackupImport, c.Sender().ID, 0, map[string]any{
+		"mode": string(mode), "version": f.Version, "created_at": f.CreatedAt.Format(time.RFC3339),
+		"users": rep.Users, "roles": rep.Roles, "tokens": rep.Tokens, "credentials": rep.Credentials, "bans": rep.Bans,
+	})
+	if err := s.afterRestore(ctx); err != nil {
+		s.log.Error("reload after restore failed", "error", err)
+		return c.Send(formatRestoreReport(rep, f, true) + "\n\nДанные импортированы, но не удалось обновить кеши: " + err.Error())
+	}
+	return c.Send(formatRestoreReport(rep, f, true))
+}
+
+// afterRestore reloads everything cached from the store.
+func (s *Service) afterRestore(ctx context.Context) error {
+	if err := s.roles.AttachStore(ctx, s.store); err != nil {
+		return err
+	}
+	if err := s.auth.LoadAuthenticated(ctx); err != nil {
+		return err
+	}
+	if err := s.auth.LoadBans(ctx); err != nil {
+		return err
+	}
+	return s.auth.SeedAdmins(ctx)
+}
+
+func formatRestoreReport(rep backup.Report, f backup.File, applied bool) string {
+	var b strings.Builder
+	if applied {
+		b.WriteString("Импорт выполнен")
+	} else {
+		b.WriteString("Проверка резервной копии")
+	}
+	fmt.Fprintf(&b, " (режим %s, формат v%d от %s):\n", rep.Mode, f.Version, f.CreatedAt.Format("2006-01-02 15:04"))
+	fmt.Fprintf(&b, "пользователи: %d, роли: %d, токены: %d, учётные данные: %d, баны: %d, настройки: %d",
+		rep.Users, rep.Roles, rep.Tokens, rep.Credentials, rep.Bans, rep.Settings)
+	const maxProblems = 20
+	for i, p := range rep.Problems {
+		if i == maxProblems {
+			fmt.Fprintf(&b, "\n… и ещё %d", len(rep.Problems)-maxProblems)
+			break
+		}
+		b.WriteString("\n- " + p)
+	}
+	return b.String()
+}
@@ -0,0 +1,141 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"ProxyaService/internal/auth"
+	"ProxyaService/internal/storage"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// banGuard is a global middleware that stops banned users before any handler runs.
+func (s *Service) banGuard(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		if c.Sender() == nil {
+			return next(c)
+		}
+		b, banned := s.auth.BanOf(c.Sender().ID)
+		if !banned {
+			return next(c)
+		}
+		s.log.Debug("update from banned user dropped", "user", c.Sender().ID)
+		if c.Callback() != nil {
+			return c.Respond(&tele.CallbackResponse{Text: "Доступ заблокирован", ShowAlert: true})
+		}
+		if c.Message() == nil || c.Chat() == nil || c.Chat().Type != tele.ChatPrivate {
+			return nil
+		}
+		return c.Send(banMessage(b))
+	}
+}
+
+func banMessage(b storage.Ban) string {
+	msg := "Доступ заблокирован администратором."
+	if b.Reason != "" {
+		msg += "\nПричина: " + b.Reason
+	}
+	if b.ExpiresAt != nil {
+		msg += "\nДо: " + b.ExpiresAt.Format("2006-01-02 15:04")
+	}
+	return msg
+}
+
+// parseDuration accepts time.ParseDuration values plus a "d" suffix for days (e.g. 7d).
+func parseDuration(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// /ban <user_id|@username> [duration] [reason]
+func (s *Service) handleBan(c tele.Context) error {
+	args := strings.Fields(c.Message().Payload)
+	if len(args) < 1 {
+		return c.Send("Использование: /ban <user_id|@username> [30m|24h|7d] [причина]")
+	}
+	target, err := s.resolveUser(s.ctx(c), args[0])
+	if err != nil {
+		return c.Send(userArgError(args[0], err))
+	}
+	admin := c.Sender().ID
+	if target == admin {
+		return c.Send("Нельзя заблокировать самого себя")
+	}
+	ban := storage.Ban{TelegramID: target, BannedBy: admin, CreatedAt: time.Now()}
+	rest := args[1:]
+	if len(rest) > 0 {
+		if d, err := parseDuration(rest[0]); err == nil && d > 0 {
+			exp := time.Now().Add(d)
+			ban.ExpiresAt = &exp
+			rest = rest[1:]
+		}
+	}
+	ban.Reason = strings.Join(rest, " ")
+	switch err := s.auth.Ban(s.ctx(c), ban); {
+	case errors.Is(err, auth.ErrBanAdmin):
+		return c.Send("Администратора из ADMIN_USER_IDS заблокировать нельзя")
+	case err != nil:
+		s.log.Error("ban failed", "user", target, "error", err)
+		return c.Send("Ошибка блокировки")
+	}
+	if _, err := s.bot.Send(&tele.User{ID: target}, banMessage(ban)); err != nil {
+		s.log.Debug("notify banned user failed", "user", target, "error", err)
+	}
+	until := "навсегда"
+	if ban.ExpiresAt != nil {
+		until = "до " + ban.ExpiresAt.Format("2006-01-02 15:04")
+	}
+	return c.Send(fmt.Sprintf("Пользователь %d заблокирован %s. Сессия и выданные им токены отозваны.", target, until))
+}
+
+// /unban <user_id|@username>
+func (s *Service) handleUnban(c tele.Context) error {
+	args := strings.Fields(c.Message().Payload)
+	if len(args) < 1 {
+		return c.Send("Использование: /unban <user_id|@username>")
+	}
+	target, err := s.resolveUser(s.ctx(c), args[0])
+	if err != nil {
+		return c.Send(userArgError(args[0], err))
+	}
+	switch err := s.auth.Unban(s.ctx(c), target, c.Sender().ID); {
+	case errors.Is(err, auth.ErrBanNotFound):
+		return c.Send("Пользователь не заблокирован")
+	case err != nil:
+		s.log.Error("unban failed", "user", target, "error", err)
+		return c.Send("Ошибка разблокировки")
+	}
+	return c.Send(fmt.Sprintf("Пользователь %d разблокирован", target))
+}
+
+// /bans
+func (s *Service) handleBans(c tele.Context) error {
+	bans := s.auth.Bans()
+	if len(bans) == 0 {
+		return c.Send("Активных блокировок нет")
+	}
+	var b strings.Builder
+	b.WriteString("Блокировки:\n")
+	for _, ban := range bans {
+		until := "навсегда"
+		if ban.ExpiresAt != nil {
+			until = "до " + ban.ExpiresAt.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(&b, "%d — %s (админ %d)", ban.TelegramID, until, ban.BannedBy)
+		if ban.Reason != "" {
+			b.WriteString(": " + ban.Reason)
+		}
+		b.WriteString("\n")
+	}
+	return c.Send(b.String())
+}
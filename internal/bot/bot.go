@@ -7,13 +7,20 @@ import (
 	"log/slog"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/joho/godotenv"
 
+	"ProxyaService/internal/audit"
 	"ProxyaService/internal/auth"
 	"ProxyaService/internal/config"
+	"ProxyaService/internal/health"
+	"ProxyaService/internal/leader"
+	"ProxyaService/internal/maintenance"
 	"ProxyaService/internal/ratelimit"
+	"ProxyaService/internal/roles"
 	"ProxyaService/internal/storage"
 
 	tele "gopkg.in/telebot.v4"
@@ -21,139 +28,283 @@ import (
 
 type Service struct {
 	log   *slog.Logger
-	conf  config.Config
+	conf  atomic.Pointer[config.Config]
 	auth  *auth.Service
-	store *storage.Store
+	roles *roles.Registry
+	store storage.Store
 	rl    *ratelimit.Limiter
+	bot   *tele.Bot
+	audit *audit.Recorder
+
+	// sw is the store every component uses; it fails with ErrUnavailable until connected
+	sw         *storage.Switch
+	storageErr atomic.Pointer[string] // last connection error while degraded
+	health     *health.Handler
+	keys       *storage.Keyring // nil keeps secrets in plaintext
+
+	// runCtx lives until Stop; update contexts and background jobs derive from it
+	runCtx context.Context
+	cancel context.CancelFunc
+	// elector decides which replica polls; nil with LEADER_ELECTION=false
+	elector *leader.Elector
+	// poller is restarted on every leadership; updates tracks which polled updates are handled
+	poller  *tele.LongPoller
+	updates updateTracker
+
+	profiles       profileTracker
+	accessNotified accessNotifier
+
+	reloadMu sync.Mutex
 }
 
-func New(log *slog.Logger, conf config.Config, auth *auth.Service) *Service {
-	return &Service{log: log, conf: conf, auth: auth}
+func New(log *slog.Logger, conf config.Config, auth *auth.Service, roles *roles.Registry) *Service {
+	s := &Service{log: log, auth: auth, roles: roles, audit: audit.New(log), health: health.New()}
+	s.conf.Store(&conf)
+	s.runCtx, s.cancel = context.WithCancel(context.Background())
+	auth.SetAudit(s.audit)
+	return s
 }
 
+// cfg returns the current configuration snapshot; it is swapped atomically on reload.
+func (s *Service) cfg() config.Config { return *s.conf.Load() }
+
 func (s *Service) Start() error {
 	_ = godotenv.Load()
 
+	s.poller = &tele.LongPoller{Timeout: 10 * time.Second}
 	pref := tele.Settings{
-		Token:  s.conf.BotToken,
-		Poller: &tele.LongPoller{Timeout: 10 * time.Second},
+		Token:  s.cfg().BotToken,
+		Poller: &trackingPoller{poller: s.poller, updates: &s.updates},
+		// trackingPoller runs updates concurrently and must know when each is done
+		Synchronous: true,
 	}
 
 	b, err := tele.NewBot(pref)
 	if err != nil {
 		return err
 	}
+	s.bot = b
+	s.auth.SetLockoutHook(s.onLockout)
 
-	// Init store and limiter if DSN configured
-	if s.store == nil && s.conf.PostgresDSN != "" {
-		st, err := storage.NewPostgres(context.Background(), s.conf.PostgresDSN)
-		if err != nil {
-			s.log.Error("postgres connect failed", "error", err)
-		} else {
-			if err := st.Migrate(context.Background()); err != nil {
-				s.log.Error("migrate failed", "error", err)
+	if s.store == nil {
+		if err := s.initStorage(s.runCtx); err != nil {
+			if s.runCtx.Err() != nil {
+				return nil // stopped while waiting for the database
 			}
-			s.store = st
-			s.auth.AttachStore(st)
-			s.rl = ratelimit.New(st, s.conf.RatePerMinFree, s.conf.RatePerMinPremium, s.conf.RatePerMinAdmin, s.conf.ThrottleSeconds)
+			return err
 		}
 	}
+	if addr := s.cfg().HealthAddr; addr != "" {
+		go func() {
+			if err := health.Serve(s.runCtx, s.log, addr, s.health); err != nil {
+				s.log.Error("health endpoint failed", "error", err)
+			}
+		}()
+	}
+
+	// Every update gets a context with a deadline, cancelled on shutdown
+	b.Use(s.withUpdateContext)
+	// Profiles are recorded for everyone, banned users included, to keep usernames current
+	b.Use(s.trackProfile)
+	// Banned users are stopped before any handler, including public ones
+	b.Use(s.banGuard)
+
+	s.setupMembership(b, s.poller)
 
-	b.Handle("/start", func(c tele.Context) error {
+	// Every command declares the permission it needs; s.handle enforces it.
+	// Commands with side effects use handleOnce, so a redelivered update is not applied twice.
+	s.handleOnce(b, "/start", auth.PermNone, func(c tele.Context) error {
 		uid := c.Sender().ID
 		if !s.auth.AuthorizeUserByID(uid) {
 			s.log.Warn("access denied by id", "user", uid)
 			// попробуем deep-link токен из payload
 			payload := strings.TrimSpace(c.Message().Payload)
 			if payload != "" {
-				if _, err := s.auth.Authenticate(context.Background(), payload, uid); err == nil {
+				_, err := s.auth.Authenticate(s.ctx(c), payload, uid)
+				if err == nil {
 					s.log.Info("authed via deeplink", "user", uid)
 					return c.Send("Аутентификация успешна. Используйте /proxy или меню ниже", s.mainMenu())
 				}
+				if msg := s.authThrottledMessage(err, uid); msg != "" {
+					return c.Send(msg)
+				}
 			}
-			return c.Send("Доступ ограничён. Обратитесь к администратору или используйте /auth <token>.")
+			return c.Send("Доступ ограничён. Запросите доступ у администратора кнопкой ниже или используйте /auth <token>.", s.accessRequestMarkup())
 		}
 		return c.Send("Отправьте /proxy для получения кнопки подключения. Либо выполните /auth <token>.", s.mainMenu())
 	})
 
-	b.Handle("/menu", func(c tele.Context) error {
+	s.handle(b, "/menu", auth.PermNone, func(c tele.Context) error {
 		return c.Send("Главное меню:", s.mainMenu())
 	})
-	// Admin: /issue_token <role> [ttl]
-	b.Handle("/issue_token", func(c tele.Context) error {
-		uid := c.Sender().ID
-		// Simple admin check: must be in AllowedUserIDs and role admin in DB (if any)
-		if !s.auth.AuthorizeUserByID(uid) {
-			return c.Send("Нет прав")
-		}
-		if s.store == nil {
-			return c.Send("Хранилище не настроено")
-		}
-		parts := strings.Fields(c.Message().Payload)
-		if len(parts) < 1 {
-			return c.Send("Использование: /issue_token <free|premium|admin> [30m|24h|7d]")
-		}
-		role := storage.Role(parts[0])
-		var ttl *time.Duration
-		if len(parts) >= 2 {
-			if d, err := time.ParseDuration(parts[1]); err == nil {
-				ttl = &d
-			}
-		}
-		token := genToken()
-		var exp *time.Time
-		if ttl != nil {
-			t := time.Now().Add(*ttl)
-			exp = &t
-		}
-		if err := s.store.CreateToken(context.Background(), token, role, exp, uid, nil); err != nil {
-			s.log.Error("token create failed", "error", err)
-			return c.Send("Ошибка создания токена")
-		}
-		return c.Send("Токен: " + token)
-	})
-
-	b.Handle("/auth", func(c tele.Context) error {
+	s.handleOnce(b, "/auth", auth.PermNone, func(c tele.Context) error {
 		uid := c.Sender().ID
 		args := strings.Fields(c.Message().Payload)
 		if len(args) < 1 {
 			return c.Send("Использование: /auth <token>")
 		}
-		if _, err := s.auth.Authenticate(context.Background(), args[0], uid); err != nil {
-			s.log.Info("auth failed", "user", uid)
+		if _, err := s.auth.Authenticate(s.ctx(c), args[0], uid); err != nil {
+			s.log.Info("auth failed", "user", uid, "error", err)
+			if msg := s.authThrottledMessage(err, uid); msg != "" {
+				return c.Send(msg)
+			}
 			return c.Send("Неверный токен")
 		}
 		s.log.Info("auth ok", "user", uid)
 		return c.Send("Аутентификация успешна. Используйте /proxy")
 	})
 
-	b.Handle("/proxy", s.handleProxy)
-	b.Handle("/disable", s.handleDisable)
+	// Second factor for sensitive admin commands (registered via handleSensitive)
+	s.handleOnce(b, "/totp_enroll", auth.PermNone, s.handleTOTPEnroll)
+	s.handleOnce(b, "/totp", auth.PermNone, s.handleTOTP)
+	s.handleSensitive(b, "/totp_reset", auth.PermNone, s.handleTOTPReset)
+
+	// Admin: /issue_token <role> [ttl]
+	s.handleSensitive(b, "/issue_token", auth.PermIssueTokens, s.handleIssueToken)
+	// Admin: /user <user_id|@username> — профиль, роль и история изменений
+	s.handle(b, "/user", auth.PermManageUsers, s.handleUserInfo)
+	// Admin: /unlock <user_id>
+	s.handleOnce(b, "/unlock", auth.PermManageUsers, s.handleUnlock)
+	// Admin: /ban <user_id> [duration] [reason], /unban <user_id>, /bans
+	s.handleSensitive(b, "/ban", auth.PermManageUsers, s.handleBan)
+	s.handleSensitive(b, "/unban", auth.PermManageUsers, s.handleUnban)
+	s.handle(b, "/bans", auth.PermManageUsers, s.handleBans)
+	// Access requests from unknown users and their review
+	s.handleOnce(b, "/request_access", auth.PermNone, s.handleRequestAccess)
+	s.handleOnce(b, "\f"+cbRequestAccess, auth.PermNone, s.handleRequestAccess)
+	s.handle(b, "/requests", auth.PermManageUsers, s.handleListRequests)
+	s.handleSensitive(b, "/approve", auth.PermManageUsers, s.handleApprove)
+	s.handleOnce(b, "/deny", auth.PermManageUsers, s.handleDeny)
+	s.handleSensitive(b, "\f"+cbApproveAccess, auth.PermManageUsers, s.handleApprove)
+	s.handleOnce(b, "\f"+cbDenyAccess, auth.PermManageUsers, s.handleDeny)
+	// Admin: role management
+	s.handle(b, "/roles", auth.PermManageRoles, s.handleRoles)
+	s.handleSensitive(b, "/role_set", auth.PermManageRoles, s.handleRoleSet)
+	s.handleSensitive(b, "/role_del", auth.PermManageRoles, s.handleRoleDel)
+	s.handleSensitive(b, "/set_role", auth.PermManageUsers, s.handleSetRole)
+	// Admin: /audit [user_id] [action=...] [page=N]
+	s.handle(b, "/audit", auth.PermViewAudit, s.handleAudit)
+	s.handle(b, "\f"+cbAuditPage, auth.PermViewAudit, s.handleAudit)
+	// Personal data: /my_data — выгрузка, /forget_me — удаление с подтверждением
+	s.handle(b, "/my_data", auth.PermNone, s.handleMyData)
+	s.handle(b, "/forget_me", auth.PermNone, s.handleForgetMe)
+	s.handleOnce(b, "\f"+cbForgetConfirm, auth.PermNone, s.handleForgetConfirm)
+	s.handle(b, "\f"+cbForgetCancel, auth.PermNone, s.handleForgetCancel)
+
+	// Admin: /backup, /restore [merge|replace] [apply] — резервная копия в JSON
+	s.handleSensitive(b, "/backup", auth.PermBackup, s.handleBackup)
+	s.handleSensitive(b, "/restore", auth.PermBackup, s.handleRestore)
+
+	// Admin: /metrics — счётчики сервиса
+	s.handle(b, "/metrics", auth.PermViewMetrics, s.handleMetrics)
+
+	// Admin: /reload — перечитать конфигурацию без перезапуска
+	s.handleSensitive(b, "/reload", auth.PermReload, s.handleReload)
 
-	b.Handle("/status", s.handleStatus)
-	b.Handle("/help", s.handleHelp)
+	s.handle(b, "/proxy", auth.PermProxy, s.handleProxy)
+	s.handle(b, "/disable", auth.PermProxy, s.handleDisable)
 
-	// Обработка нажатий текстовых кнопок меню
-	b.Handle(tele.OnText, func(c tele.Context) error {
+	s.handle(b, "/status", auth.PermNone, s.handleStatus)
+	s.handle(b, "/help", auth.PermNone, s.handleHelp)
+
+	// Обработка нажатий текстовых кнопок меню; Trigger проходит через те же проверки прав
+	s.handle(b, tele.OnText, auth.PermNone, func(c tele.Context) error {
 		txt := strings.TrimSpace(c.Text())
 		switch txt {
 		case "Подключить прокси":
-			return s.handleProxy(c)
+			return b.Trigger("/proxy", c)
 		case "Отключить прокси":
-			return s.handleDisable(c)
+			return b.Trigger("/disable", c)
 		case "Мой статус":
-			return s.handleStatus(c)
+			return b.Trigger("/status", c)
 		case "Помощь":
-			return s.handleHelp(c)
+			return b.Trigger("/help", c)
 		}
 		return nil
 	})
 
-	s.log.Info("bot started")
-	b.Start()
+	go s.watchConfig(s.runCtx)
+
+	if !s.cfg().LeaderElection {
+		s.lead(s.runCtx)
+		return nil
+	}
+	s.elector = leader.New(s.log, s.store, time.Duration(s.cfg().LeaderCheckSec)*time.Second)
+	s.health.Add("leader", s.elector.Health)
+	s.log.Info("waiting for leadership")
+	s.elector.Run(s.runCtx, s.lead)
 	return nil
 }
 
+// lead polls Telegram and runs the background jobs only the leader runs, until
+// ctx is done.
+func (s *Service) lead(ctx context.Context) {
+	if err := s.reloadState(ctx); err != nil {
+		s.log.Error("reload state failed", "error", err)
+	}
+	go maintenance.New(s.log, s.store, s.maintenancePolicy).Run(ctx)
+	if len(s.auth.MemberChats()) > 0 {
+		go s.recheckMembers(ctx, time.Duration(s.cfg().MemberRecheckMin)*time.Minute)
+	}
+	s.restoreOffset(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.bot.Start()
+	}()
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		s.saveOffsets(done)
+	}()
+	s.log.Info("bot started")
+	<-ctx.Done()
+	s.bot.Stop()
+	<-done
+	<-saved
+	s.log.Info("bot stopped")
+}
+
+// reloadState re-reads roles, authenticated users and bans. A follower loaded
+// them at startup, and the leader that ran until now may have changed them since.
+func (s *Service) reloadState(ctx context.Context) error {
+	if err := s.roles.Reload(ctx); err != nil {
+		return err
+	}
+	if err := s.auth.LoadAuthenticated(ctx); err != nil {
+		return err
+	}
+	return s.auth.LoadBans(ctx)
+}
+
+// handle registers h behind a permission check.
+func (s *Service) handle(b *tele.Bot, endpoint string, perm auth.Permission, h tele.HandlerFunc) {
+	b.Handle(endpoint, h, s.require(perm))
+}
+
+// require is a middleware rejecting callers whose role lacks perm.
+func (s *Service) require(perm auth.Permission) tele.MiddlewareFunc {
+	return func(next tele.HandlerFunc) tele.HandlerFunc {
+		return func(c tele.Context) error {
+			if c.Sender() == nil {
+				return nil
+			}
+			uid := c.Sender().ID
+			if s.auth.HasPermission(s.ctx(c), uid, perm) {
+				return next(c)
+			}
+			s.log.Warn("permission denied", "user", uid, "permission", perm)
+			if c.Callback() != nil {
+				return c.Respond(&tele.CallbackResponse{Text: "Нет прав", ShowAlert: true})
+			}
+			if !s.auth.AuthorizeUserByID(uid) {
+				return c.Send("Доступ ограничён. Обратитесь к администратору.")
+			}
+			return c.Send("Нет прав")
+		}
+	}
+}
+
 func buildTgSocksLink(host, port, user, pass string) string {
 	if host == "" || port == "" {
 		return ""
@@ -172,6 +323,14 @@ func buildTgSocksLink(host, port, user, pass string) string {
 	return u.String()
 }
 
+// rateLimitedMessage tells the user when the limiter will admit the next request.
+func rateLimitedMessage(retry time.Duration) string {
+	if retry <= 0 {
+		return "Слишком часто. Попробуйте позже."
+	}
+	return fmt.Sprintf("Слишком часто. Повторите через %s.", max(retry.Round(time.Second), time.Second))
+}
+
 func safe(v string) string {
 	if strings.TrimSpace(v) == "" {
 		return "<не задано>"
@@ -179,6 +338,8 @@ func safe(v string) string {
 	return v
 }
 
+func secondsToDuration(sec int) time.Duration { return time.Duration(sec) * time.Second }
+
 // genToken generates a short random token (base62, 24 chars)
 func genToken() string {
 	const alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -210,35 +371,34 @@ func (s *Service) mainMenu() *tele.ReplyMarkup {
 
 func (s *Service) handleProxy(c tele.Context) error {
 	uid := c.Sender().ID
-	if !s.auth.AuthorizeUserByID(uid) {
-		s.log.Warn("access denied by id", "user", uid)
-		return c.Send("Доступ ограничён. Обратитесь к администратору.")
+	if !s.roles.AllowsPool(s.auth.RoleOf(s.ctx(c), uid), defaultProxyPool) {
+		return c.Send("Ваша роль не даёт доступа к этому прокси.")
 	}
-	if s.store != nil && s.rl != nil {
-		if u, err := s.store.GetUser(context.Background(), uid); err == nil {
-			if ok, err := s.rl.Allow(context.Background(), u, "proxy"); err == nil {
-				if !ok {
-					return c.Send("Слишком часто. Попробуйте позже.")
+	if s.rl != nil {
+		if u, err := s.store.GetUser(s.ctx(c), uid); err == nil {
+			if res, err := s.rl.Allow(s.ctx(c), u, "proxy"); err == nil {
+				if !res.Allowed {
+					return c.Send(rateLimitedMessage(res.RetryAfter))
 				}
 			} else {
 				s.log.Error("rate check error", "error", err)
 			}
 		}
 	}
-	if s.store != nil {
-		if _, err := s.store.GetUser(context.Background(), uid); err != nil {
-			_ = s.store.UpsertUser(context.Background(), storage.User{ID: uid, Role: storage.Role(s.conf.DefaultRole), IsAuthed: true})
-		}
+	if _, err := s.store.GetUser(s.ctx(c), uid); err != nil {
+		// IsAuthed only for token/approval access: whitelist and chat membership are re-checked on every request
+		_ = s.store.UpsertUser(s.ctx(c), storage.User{ID: uid, Role: s.auth.RoleOf(s.ctx(c), uid), IsAuthed: s.auth.IsAuthenticated(uid)})
 	}
-	link := buildTgSocksLink(s.conf.ProxyHost, s.conf.ProxyPort, s.conf.ProxyUser, s.conf.ProxyPass)
+	conf := s.cfg()
+	link := buildTgSocksLink(conf.ProxyHost, conf.ProxyPort, conf.ProxyUser, conf.ProxyPass)
 	markup := &tele.ReplyMarkup{}
 	btn := markup.URL("Подключить прокси", link)
 	markup.Inline(markup.Row(btn))
-	info := fmt.Sprintf("Готово к подключению. Если кнопка не сработает, добавьте прокси вручную:\nHost: %s\nPort: %s", safe(s.conf.ProxyHost), safe(s.conf.ProxyPort))
-	if s.conf.ProxyUser != "" {
-		info += fmt.Sprintf("\nUser: %s", s.conf.ProxyUser)
+	info := fmt.Sprintf("Готово к подключению. Если кнопка не сработает, добавьте прокси вручную:\nHost: %s\nPort: %s", safe(conf.ProxyHost), safe(conf.ProxyPort))
+	if conf.ProxyUser != "" {
+		info += fmt.Sprintf("\nUser: %s", conf.ProxyUser)
 	}
-	if s.conf.ProxyPass != "" {
+	if conf.ProxyPass != "" {
 		info += "\nPass: <скрыт>"
 	}
 	s.log.Info("sent proxy data", "user", uid)
@@ -247,29 +407,23 @@ func (s *Service) handleProxy(c tele.Context) error {
 
 func (s *Service) handleStatus(c tele.Context) error {
 	uid := c.Sender().ID
-	role := "<нет БД>"
+	role := describeRole(s.roles.Get(s.auth.RoleOf(s.ctx(c), uid)))
 	authed := false
-	if s.store != nil {
-		if u, err := s.store.GetUser(context.Background(), uid); err == nil {
-			role = string(u.Role)
-			authed = u.IsAuthed
-		} else {
-			role = s.conf.DefaultRole
-		}
+	if u, err := s.store.GetUser(s.ctx(c), uid); err == nil {
+		authed = u.IsAuthed
+	}
+	msg := fmt.Sprintf("Ваш статус:\nID: %d\nРоль: %s\nАутентифицирован: %t", uid, role, authed)
+	if s.auth.HasPermission(s.ctx(c), uid, auth.PermViewMetrics) {
+		msg += "\n\n" + formatHealth(s.health.Report(s.ctx(c)))
 	}
-	return c.Send(fmt.Sprintf("Ваш статус:\nID: %d\nРоль: %s\nАутентифицирован: %t", uid, role, authed), s.mainMenu())
+	return c.Send(msg, s.mainMenu())
 }
 
 func (s *Service) handleHelp(c tele.Context) error {
-	return c.Send("Команды:\n/start — меню\n/proxy — подключение\n/disable — отключить прокси\n/status — мой статус\n/help — помощь\n/auth <token> — аутентификация", s.mainMenu())
+	return c.Send("Команды:\n/start — меню\n/proxy — подключение\n/disable — отключить прокси\n/status — мой статус\n/help — помощь\n/auth <token> — аутентификация\n/my_data — мои данные\n/forget_me — удалить мои данные", s.mainMenu())
 }
 
 func (s *Service) handleDisable(c tele.Context) error {
-	uid := c.Sender().ID
-	if !s.auth.AuthorizeUserByID(uid) {
-		s.log.Warn("access denied by id", "user", uid)
-		return c.Send("Доступ ограничён. Обратитесь к администратору.")
-	}
 	// Telegram не имеет прямого API для выключения прокси из бота.
 	// Даем пользователю быстрые ссылки и инструкцию.
 	markup := &tele.ReplyMarkup{}
@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"ProxyaService/internal/metrics"
+	"ProxyaService/internal/reqctx"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// ctxKey is where withUpdateContext keeps the update context in tele.Context.
+const ctxKey = "ctx"
+
+// withUpdateContext is a global middleware giving each update a context that
+// carries the update and sender IDs, expires after UPDATE_TIMEOUT_SECONDS and
+// is cancelled on shutdown.
+func (s *Service) withUpdateContext(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		var uid int64
+		if c.Sender() != nil {
+			uid = c.Sender().ID
+		}
+		ctx := reqctx.With(s.runCtx, c.Update().ID, uid)
+		cancel := context.CancelFunc(func() {})
+		if sec := s.cfg().UpdateTimeoutSec; sec > 0 {
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(sec)*time.Second)
+		}
+		defer cancel()
+		c.Set(ctxKey, ctx)
+		err := next(c)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			metrics.Add("update_timeouts", 1)
+			s.log.Warn("update deadline exceeded", append(reqctx.LogAttrs(ctx), "error", err)...)
+		}
+		return err
+	}
+}
+
+// ctx returns the context of the update being handled.
+func (s *Service) ctx(c tele.Context) context.Context {
+	if ctx, ok := c.Get(ctxKey).(context.Context); ok {
+		return ctx
+	}
+	return s.runCtx
+}
+
+// Stop cancels in-flight updates and background jobs and stops polling; Start
+// returns once the poller has stopped.
+func (s *Service) Stop() {
+	s.cancel()
+}
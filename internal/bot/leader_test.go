@@ -0,0 +1,75 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+
+	"ProxyaService/internal/leader"
+	"ProxyaService/internal/storage"
+)
+
+// idlePoller delivers no updates, so lead can run without Telegram.
+type idlePoller struct{}
+
+func (idlePoller) Poll(_ *tele.Bot, _ chan tele.Update, stop chan struct{}) { <-stop }
+
+// TestLeaderReloadsBans checks that a replica taking over enforces a ban the
+// previous leader issued after the replica had started.
+func TestLeaderReloadsBans(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMemory()
+	if err := st.UpsertUser(ctx, storage.User{ID: 42, Role: storage.RoleFree, IsAuthed: true}); err != nil {
+		t.Fatal(err)
+	}
+	prev := newTestService(t, st)
+	follower := newTestService(t, st)
+	if err := follower.auth.LoadAuthenticated(ctx); err != nil {
+		t.Fatal(err)
+	}
+	b, err := tele.NewBot(tele.Settings{Offline: true, Synchronous: true, Poller: idlePoller{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower.bot = b
+	follower.poller = &tele.LongPoller{}
+
+	if err := prev.auth.Ban(ctx, storage.Ban{TelegramID: 42, Reason: "spam", BannedBy: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, banned := follower.auth.BanOf(42); banned {
+		t.Fatal("follower saw the ban before taking over")
+	}
+
+	lctx, cancel := context.WithCancel(ctx)
+	el := leader.New(follower.log, st, 10*time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		el.Run(lctx, follower.lead)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !el.Leader() {
+		if time.Now().After(deadline) {
+			t.Fatal("follower did not become leader")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for {
+		_, banned := follower.auth.BanOf(42)
+		if banned && !follower.auth.IsAuthenticated(42) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ban is not enforced after taking over")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,38 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"ProxyaService/internal/maintenance"
+	"ProxyaService/internal/metrics"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// maintenancePolicy maps the current configuration onto cleanup settings.
+func (s *Service) maintenancePolicy() maintenance.Policy {
+	conf := s.cfg()
+	return maintenance.Policy{
+		Interval:           time.Duration(conf.MaintenanceMin) * time.Minute,
+		BatchSize:          conf.MaintenanceBatch,
+		RateEventRetention: time.Duration(conf.RetainRateEventsHr) * time.Hour,
+		TokenRetention:     time.Duration(conf.RetainTokensDays) * 24 * time.Hour,
+		UpdateRetention:    time.Duration(conf.RetainUpdatesHr) * time.Hour,
+	}
+}
+
+// /metrics
+func (s *Service) handleMetrics(c tele.Context) error {
+	list := metrics.Snapshot()
+	if len(list) == 0 {
+		return c.Send("Счётчиков пока нет")
+	}
+	var b strings.Builder
+	b.WriteString("Счётчики:\n")
+	for _, m := range list {
+		fmt.Fprintf(&b, "%s: %d\n", m.Name, m.Value)
+	}
+	return c.Send(b.String())
+}
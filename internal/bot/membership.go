@@ -0,0 +1,134 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ProxyaService/internal/auth"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// memberUpdates are the update types needed when access is granted by chat membership.
+var memberUpdates = []string{"message", "callback_query", "chat_member"}
+
+// checkMember asks Telegram whether the user is a member of the chat.
+func (s *Service) checkMember(chatID, userID int64) (bool, error) {
+	m, err := s.chatMember(chatID, userID)
+	if err != nil {
+		if errors.Is(err, errNotInChat) {
+			return false, nil
+		}
+		s.log.Warn("chat member check failed", "chat", chatID, "user", userID, "error", err)
+		return false, err
+	}
+	switch m.Role {
+	case tele.Creator, tele.Administrator, tele.Member:
+		return true, nil
+	case tele.Restricted:
+		return m.Member, nil
+	}
+	return false, nil
+}
+
+// errNotInChat means getChatMember does not know the user in that chat.
+var errNotInChat = errors.New("user is not in the chat")
+
+// chatMember calls getChatMember directly: telebot turns the "user not found"
+// answer into a plain formatted error, so its code and description are read
+// from the response instead.
+func (s *Service) chatMember(chatID, userID int64) (*tele.ChatMember, error) {
+	data, err := s.bot.Raw("getChatMember", map[string]string{
+		"chat_id": strconv.FormatInt(chatID, 10),
+		"user_id": strconv.FormatInt(userID, 10),
+	})
+	var resp struct {
+		OK          bool            `json:"ok"`
+		Code        int             `json:"error_code"`
+		Description string          `json:"description"`
+		Result      tele.ChatMember `json:"result"`
+	}
+	if len(data) == 0 || json.Unmarshal(data, &resp) != nil {
+		if err == nil {
+			err = errors.New("getChatMember: malformed response")
+		}
+		return nil, err
+	}
+	if !resp.OK {
+		if notInChat(resp.Code, resp.Description) {
+			return nil, errNotInChat
+		}
+		if err == nil {
+			err = fmt.Errorf("getChatMember: %s (%d)", resp.Description, resp.Code)
+		}
+		return nil, err
+	}
+	return &resp.Result, nil
+}
+
+// notInChat reports whether a getChatMember error means the user is not in the
+// chat, as opposed to the check itself failing.
+func notInChat(code int, description string) bool {
+	if code != http.StatusBadRequest {
+		return false
+	}
+	switch description {
+	case "Bad Request: user not found", "Bad Request: PARTICIPANT_ID_INVALID", tele.ErrBadUserID.Description:
+		return true
+	}
+	return false
+}
+
+// handleChatMember drops cached membership when someone joins or leaves a configured chat.
+// Requires the bot to be an administrator of the chat.
+func (s *Service) handleChatMember(c tele.Context) error {
+	upd := c.ChatMember()
+	if upd == nil || upd.Chat == nil || upd.NewChatMember == nil || upd.NewChatMember.User == nil {
+		return nil
+	}
+	if !s.auth.IsMemberChat(upd.Chat.ID) {
+		return nil
+	}
+	uid := upd.NewChatMember.User.ID
+	s.auth.ForgetMembership(uid)
+	switch upd.NewChatMember.Role {
+	case tele.Left, tele.Kicked:
+		s.log.Info("member left chat, access revoked", "chat", upd.Chat.ID, "user", uid)
+	default:
+		s.log.Debug("chat member updated", "chat", upd.Chat.ID, "user", uid, "status", upd.NewChatMember.Role)
+	}
+	return nil
+}
+
+// recheckMembers periodically re-validates cached members in case a chat_member update was missed.
+func (s *Service) recheckMembers(ctx context.Context, every time.Duration) {
+	if every <= 0 {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			for _, uid := range s.auth.RecheckMembers(ctx) {
+				s.log.Info("membership lost, access revoked", "user", uid)
+			}
+		}
+	}
+}
+
+func (s *Service) setupMembership(b *tele.Bot, poller *tele.LongPoller) {
+	if len(s.auth.MemberChats()) == 0 {
+		return
+	}
+	poller.AllowedUpdates = memberUpdates
+	s.auth.SetMembershipChecker(s.checkMember)
+	s.handle(b, tele.OnChatMember, auth.PermNone, s.handleChatMember)
+}
@@ -0,0 +1,214 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"ProxyaService/internal/audit"
+	"ProxyaService/internal/auth"
+	"ProxyaService/internal/storage"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// Callback uniques of the /forget_me confirmation.
+const (
+	cbForgetConfirm = "forget_confirm"
+	cbForgetCancel  = "forget_cancel"
+)
+
+// forgetConfirmTTL is how long the confirmation button stays valid.
+const forgetConfirmTTL = 5 * time.Minute
+
+// myData is the /my_data export. Token values and TOTP secrets are not included.
+type myData struct {
+	TelegramID     int64                   `json:"telegram_id"`
+	ExportedAt     time.Time               `json:"exported_at"`
+	Role           string                  `json:"role"`
+	User           *storage.User           `json:"user,omitempty"`
+	Profile        *storage.Profile        `json:"profile,omitempty"`
+	ProfileChanges []storage.ProfileChange `json:"profile_changes"`
+	AccessRequests []storage.AccessRequest `json:"access_requests"`
+	RateEvents     []storage.RateEvent     `json:"rate_events"`
+	TOTP           *myTOTP                 `json:"totp,omitempty"`
+	Ban            *storage.Ban            `json:"ban,omitempty"`
+	Tokens         []myToken               `json:"tokens"`
+	AuditEvents    []storage.AuditEvent    `json:"audit_events"`
+}
+
+type myTOTP struct {
+	Confirmed bool      `json:"confirmed"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type myToken struct {
+	Token      string     `json:"token"`
+	Role       string     `json:"role"`
+	IssuedByMe bool       `json:"issued_by_me"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	ConsumedAt *time.Time `json:"consumed_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// maskToken keeps a short prefix so the user can recognize the token.
+func maskToken(t string) string {
+	if len(t) <= 4 {
+		return "…"
+	}
+	return t[:4] + "…"
+}
+
+// /my_data
+func (s *Service) handleMyData(c tele.Context) error {
+	if c.Chat().Type != tele.ChatPrivate {
+		return c.Send("Выгрузка содержит личные данные, запросите её в личном чате с ботом.")
+	}
+	uid := c.Sender().ID
+	ctx := s.ctx(c)
+	d, err := s.store.UserData(ctx, uid)
+	if err != nil {
+		s.log.Error("user data export failed", "user", uid, "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка выгрузки данных"))
+	}
+	out := myData{
+		TelegramID:     uid,
+		ExportedAt:     time.Now().UTC(),
+		Role:           string(s.auth.RoleOf(ctx, uid)),
+		User:           d.User,
+		Profile:        d.Profile,
+		ProfileChanges: d.ProfileChanges,
+		AccessRequests: d.AccessRequests,
+		RateEvents:     d.RateEvents,
+		Ban:            d.Ban,
+		AuditEvents:    d.AuditEvents,
+		Tokens:         []myToken{},
+	}
+	if d.TOTP != nil {
+		out.TOTP = &myTOTP{Confirmed: d.TOTP.Confirmed, CreatedAt: d.TOTP.CreatedAt}
+	}
+	for _, t := range d.Tokens {
+		out.Tokens = append(out.Tokens, myToken{
+			Token: maskToken(t.Token), Role: string(t.Role), IssuedByMe: t.IssuedBy == uid,
+			ExpiresAt: t.ExpiresAt, ConsumedAt: t.ConsumedAt, CreatedAt: t.CreatedAt,
+		})
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return err
+	}
+	s.audit.Record(ctx, audit.UserDataExport, uid, uid, nil)
+	return c.Send(&tele.Document{
+		File:     tele.FromReader(&buf),
+		FileName: "my-data-" + strconv.FormatInt(uid, 10) + ".json",
+		Caption: fmt.Sprintf("Все данные о вас, которые хранит бот: запись пользователя, профиль Telegram и история его изменений, запросы доступа (%d), события лимитов (%d), токены (%d), записи журнала аудита (%d).",
+			len(out.AccessRequests), len(out.RateEvents), len(out.Tokens), len(out.AuditEvents)),
+	})
+}
+
+// /forget_me
+func (s *Service) handleForgetMe(c tele.Context) error {
+	if s.auth.IsAdminID(c.Sender().ID) {
+		return c.Send("Администратора из ADMIN_USER_IDS удалить нельзя: сначала уберите его из конфигурации.")
+	}
+	m := &tele.ReplyMarkup{}
+	uid := strconv.FormatInt(c.Sender().ID, 10)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	m.Inline(m.Row(m.Data("Да, удалить мои данные", cbForgetConfirm, uid, ts), m.Data("Отмена", cbForgetCancel, uid)))
+	return c.Send("Будут удалены ваша учётная запись, сохранённый профиль Telegram, история запросов, второй фактор и заявки на доступ; записи журнала аудита — "+
+		auditPolicyText(s.forgetPolicy())+". Доступ, полученный по токену или одобрению, будет отозван. Бан, если есть, сохраняется.\n\nПродолжить?", m)
+}
+
+func (s *Service) forgetPolicy() storage.AuditPolicy {
+	return storage.AuditPolicy(s.cfg().ForgetAuditPolicy)
+}
+
+func auditPolicyText(p storage.AuditPolicy) string {
+	switch p {
+	case storage.AuditDelete:
+		return "удалены"
+	case storage.AuditKeep:
+		return "сохранены без изменений"
+	default:
+		return "обезличены"
+	}
+}
+
+// forgetOwner reports whether the callback was pressed by the user who sent /forget_me.
+func forgetOwner(c tele.Context, data string) bool {
+	owner, _ := strconv.ParseInt(data, 10, 64)
+	if owner == c.Sender().ID {
+		return true
+	}
+	_ = c.Respond(&tele.CallbackResponse{Text: "Эта кнопка не для вас", ShowAlert: true})
+	return false
+}
+
+func (s *Service) handleForgetCancel(c tele.Context) error {
+	if !forgetOwner(c, c.Callback().Data) {
+		return nil
+	}
+	_ = c.Respond()
+	return c.Edit("Удаление данных отменено.")
+}
+
+func (s *Service) handleForgetConfirm(c tele.Context) error {
+	uid := c.Sender().ID
+	owner, ts, _ := strings.Cut(c.Callback().Data, "|")
+	if !forgetOwner(c, owner) {
+		return nil
+	}
+	issued, _ := strconv.ParseInt(ts, 10, 64)
+	if time.Since(time.Unix(issued, 0)) > forgetConfirmTTL {
+		_ = c.Respond(&tele.CallbackResponse{Text: "Подтверждение устарело, отправьте /forget_me ещё раз", ShowAlert: true})
+		return nil
+	}
+	_ = c.Respond()
+	ctx := s.ctx(c)
+	policy := s.forgetPolicy()
+	res, err := s.auth.Forget(ctx, uid, policy)
+	switch {
+	case errors.Is(err, auth.ErrForgetAdmin):
+		return c.Edit("Администратора из ADMIN_USER_IDS удалить нельзя.")
+	case err != nil:
+		s.log.Error("forget user failed", "user", uid, "error", err)
+		return c.Edit(storeErrorMessage(err, "Ошибка удаления данных, попробуйте позже."))
+	}
+	s.profiles.forget(uid)
+	// the event itself carries no user ID, so it does not undo anonymization
+	s.audit.Record(ctx, audit.UserForget, 0, 0, map[string]any{
+		"policy": string(policy), "user_row": res.User, "profile": res.Profile, "rate_events": res.RateEvents, "credentials": res.Credentials,
+		"access_requests": res.AccessRequests, "tokens": res.Tokens, "audit_events": res.AuditEvents,
+	})
+	s.log.Info("user data erased", "policy", policy)
+	return c.Edit(formatForgetResult(res, policy, s.auth.AuthorizeUserByID(uid)))
+}
+
+func formatForgetResult(res storage.ForgetResult, policy storage.AuditPolicy, stillAllowed bool) string {
+	var b strings.Builder
+	b.WriteString("Ваши данные удалены:\n")
+	if res.User {
+		b.WriteString("- учётная запись и роль\n")
+	}
+	fmt.Fprintf(&b, "- профиль и история его изменений: %d\n", res.Profile)
+	fmt.Fprintf(&b, "- события лимитов: %d\n", res.RateEvents)
+	fmt.Fprintf(&b, "- второй фактор: %d\n", res.Credentials)
+	fmt.Fprintf(&b, "- заявки на доступ: %d\n", res.AccessRequests)
+	fmt.Fprintf(&b, "- ссылки на вас в токенах: %d\n", res.Tokens)
+	if policy == storage.AuditKeep {
+		b.WriteString("- журнал аудита сохранён без изменений\n")
+	} else {
+		fmt.Fprintf(&b, "- записи журнала аудита %s: %d\n", auditPolicyText(policy), res.AuditEvents)
+	}
+	b.WriteString("Сессия завершена.")
+	if stillAllowed {
+		b.WriteString(" Доступ по списку разрешённых пользователей или членству в чате задаётся конфигурацией и сохраняется.")
+	}
+	return b.String()
+}
@@ -0,0 +1,191 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ProxyaService/internal/storage"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// profileTouchInterval limits how often an unchanged profile is written just to
+// refresh the last-seen time.
+const profileTouchInterval = time.Minute
+
+// profileTrackerLimit bounds the last-written cache; older entries are dropped past it.
+const profileTrackerLimit = 10000
+
+// profileTracker remembers what was last written for each user to skip redundant writes.
+type profileTracker struct {
+	mu   sync.Mutex
+	last map[int64]storage.Profile
+}
+
+// due reports whether p differs from the last write or that write is stale.
+func (t *profileTracker) due(p storage.Profile, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev, ok := t.last[p.TelegramID]
+	if !ok || now.Sub(prev.LastSeenAt) >= profileTouchInterval {
+		return true
+	}
+	prev.LastSeenAt, prev.UpdatedAt = time.Time{}, time.Time{}
+	return prev != p
+}
+
+func (t *profileTracker) remember(p storage.Profile, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last == nil {
+		t.last = make(map[int64]storage.Profile)
+	}
+	if len(t.last) >= profileTrackerLimit {
+		for id, prev := range t.last {
+			if now.Sub(prev.LastSeenAt) >= profileTouchInterval {
+				delete(t.last, id)
+			}
+		}
+	}
+	p.LastSeenAt = now
+	t.last[p.TelegramID] = p
+}
+
+func (t *profileTracker) forget(id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.last, id)
+}
+
+// trackProfile is a global middleware recording the sender's Telegram profile
+// and last-seen time. Failures are logged and never block the update.
+func (s *Service) trackProfile(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		u := c.Sender()
+		if u == nil || u.IsBot {
+			return next(c)
+		}
+		p := storage.Profile{
+			TelegramID: u.ID, Username: u.Username, FirstName: u.FirstName, LastName: u.LastName,
+			LanguageCode: u.LanguageCode, IsPremium: u.IsPremium,
+		}
+		now := time.Now()
+		if s.profiles.due(p, now) {
+			changes, err := s.store.TouchProfile(s.ctx(c), p)
+			switch {
+			case errors.Is(err, storage.ErrUnavailable):
+			case err != nil:
+				s.log.Warn("profile update failed", "user", u.ID, "error", err)
+			default:
+				s.profiles.remember(p, now)
+				for _, ch := range changes {
+					s.log.Info("profile changed", "user", u.ID, "field", ch.Field, "old", ch.OldValue, "new", ch.NewValue)
+				}
+			}
+		}
+		return next(c)
+	}
+}
+
+var errBadUserArg = errors.New("bad user argument")
+
+// resolveUser accepts a numeric Telegram ID or @username of a user the bot has seen.
+func (s *Service) resolveUser(ctx context.Context, arg string) (int64, error) {
+	if id, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return id, nil
+	}
+	if !strings.HasPrefix(arg, "@") || len(arg) < 2 {
+		return 0, errBadUserArg
+	}
+	p, err := s.store.FindProfileByUsername(ctx, arg)
+	if err != nil {
+		return 0, err
+	}
+	return p.TelegramID, nil
+}
+
+// userArgError turns a resolveUser error into a reply.
+func userArgError(arg string, err error) string {
+	switch {
+	case errors.Is(err, errBadUserArg):
+		return "Некорректный пользователь: укажите user_id или @username"
+	case errors.Is(err, storage.ErrNotFound):
+		return "Пользователь " + arg + " не найден: бот знает только тех, кто ему писал"
+	default:
+		return storeErrorMessage(err, "Ошибка поиска пользователя")
+	}
+}
+
+// /user <user_id|@username>
+func (s *Service) handleUserInfo(c tele.Context) error {
+	args := strings.Fields(c.Message().Payload)
+	if len(args) < 1 {
+		return c.Send("Использование: /user <user_id|@username>")
+	}
+	ctx := s.ctx(c)
+	id, err := s.resolveUser(ctx, args[0])
+	if err != nil {
+		if !errors.Is(err, errBadUserArg) && !errors.Is(err, storage.ErrNotFound) {
+			s.log.Error("user lookup failed", "arg", args[0], "error", err)
+		}
+		return c.Send(userArgError(args[0], err))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Пользователь %d\n", id)
+	p, err := s.store.GetProfile(ctx, id)
+	switch {
+	case err == nil:
+		b.WriteString(formatProfile(p))
+	case errors.Is(err, storage.ErrNotFound):
+		b.WriteString("Профиль неизвестен: пользователь ещё не писал боту\n")
+	default:
+		s.log.Error("get profile failed", "user", id, "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка чтения профиля"))
+	}
+	fmt.Fprintf(&b, "Роль: %s\nДоступ: %t\n", describeRole(s.roles.Get(s.auth.RoleOf(ctx, id))), s.auth.AuthorizeUserByID(id))
+	if ban, banned := s.auth.BanOf(id); banned {
+		until := "навсегда"
+		if ban.ExpiresAt != nil {
+			until = "до " + ban.ExpiresAt.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(&b, "Заблокирован %s (админ %d)", until, ban.BannedBy)
+		if ban.Reason != "" {
+			b.WriteString(": " + ban.Reason)
+		}
+		b.WriteString("\n")
+	}
+	changes, err := s.store.ListProfileChanges(ctx, id, 10)
+	if err != nil {
+		s.log.Error("list profile changes failed", "user", id, "error", err)
+	}
+	if len(changes) > 0 {
+		b.WriteString("\nИзменения профиля:\n")
+		for _, ch := range changes {
+			fmt.Fprintf(&b, "%s %s: %q → %q\n", ch.ChangedAt.Format("2006-01-02 15:04"), ch.Field, ch.OldValue, ch.NewValue)
+		}
+	}
+	return c.Send(b.String())
+}
+
+func formatProfile(p storage.Profile) string {
+	var b strings.Builder
+	if p.Username != "" {
+		fmt.Fprintf(&b, "@%s\n", p.Username)
+	}
+	if name := strings.TrimSpace(p.FirstName + " " + p.LastName); name != "" {
+		fmt.Fprintf(&b, "Имя: %s\n", name)
+	}
+	if p.LanguageCode != "" {
+		fmt.Fprintf(&b, "Язык: %s\n", p.LanguageCode)
+	}
+	if p.IsPremium {
+		b.WriteString("Telegram Premium\n")
+	}
+	fmt.Fprintf(&b, "Последняя активность: %s\n", p.LastSeenAt.Format("2006-01-02 15:04"))
+	return b.String()
+}
@@ -0,0 +1,79 @@
+package bot
+
+import (
+	"context"
+
+	"ProxyaService/internal/audit"
+	"ProxyaService/internal/auth"
+	"ProxyaService/internal/config"
+	"ProxyaService/internal/storage"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// Reload re-reads configuration and atomically swaps whitelist, tokens, proxy
+// settings and limits. Handlers already running keep the snapshot they started with.
+// Bot token and database settings require a restart.
+func (s *Service) Reload() error { return s.reload(0, "signal") }
+
+// reload applies new configuration; actor is the admin who asked for it (0 for signal/file watch).
+func (s *Service) reload(actor int64, source string) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	prev := s.cfg()
+	conf, err := config.Reload(prev.ConfigFile)
+	if err != nil {
+		return err
+	}
+	if conf.BotToken != prev.BotToken || conf.PostgresDSN != prev.PostgresDSN {
+		s.log.Warn("bot token and database settings are applied only after restart")
+		conf.BotToken, conf.PostgresDSN = prev.BotToken, prev.PostgresDSN
+	}
+	if conf.AuthTokensErr != nil {
+		s.log.Error("static tokens file cannot be read, keeping previous tokens", "error", conf.AuthTokensErr)
+		conf.AuthTokens = prev.AuthTokens
+	}
+	if conf.RateLimitBackend != prev.RateLimitBackend {
+		s.log.Warn("rate limit backend is applied only after restart")
+		conf.RateLimitBackend = prev.RateLimitBackend
+	}
+	// roles are the only step that can fail, so they go first: on error nothing
+	// of the new configuration is applied
+	if err := s.roles.SetDefaults(s.runCtx, auth.BuiltinRoles(conf.RatePerMinFree, conf.RatePerMinPremium, conf.RatePerMinAdmin), storage.Role(conf.DefaultRole)); err != nil {
+		return err
+	}
+	opts := auth.OptionsFromConfig(conf, s.roles)
+	s.conf.Store(&conf)
+	s.auth.Reload(opts)
+	if s.rl != nil {
+		s.rl.SetBurst(conf.RateLimitBurst)
+	}
+	s.audit.Record(s.runCtx, audit.ConfigReload, actor, 0, map[string]any{
+		"source":        source,
+		"allowed_users": len(conf.AllowedUserIDs),
+		"admins":        len(conf.AdminUserIDs),
+		"tokens":        len(conf.AuthTokens),
+		"member_chats":  len(conf.MemberChats),
+	})
+	return nil
+}
+
+// /reload
+func (s *Service) handleReload(c tele.Context) error {
+	if err := s.reload(c.Sender().ID, "command"); err != nil {
+		s.log.Error("reload failed", "error", err)
+		return c.Send("Ошибка перезагрузки конфигурации: " + err.Error())
+	}
+	return c.Send("Конфигурация перезагружена")
+}
+
+func (s *Service) watchConfig(ctx context.Context) {
+	conf := s.cfg()
+	config.Watch(ctx, conf.ConfigFile, secondsToDuration(conf.ConfigWatchSec), func() {
+		s.log.Info("config file changed", "file", conf.ConfigFile)
+		if err := s.reload(0, "file"); err != nil {
+			s.log.Error("reload failed", "error", err)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ProxyaService/internal/storage"
+)
+
+// seedFailingStore fails once roles are seeded again, as on reload.
+type seedFailingStore struct {
+	*storage.Memory
+	fail bool
+}
+
+func (s *seedFailingStore) SeedRole(ctx context.Context, r storage.RoleDef) error {
+	if s.fail {
+		return errors.New("seed failed")
+	}
+	return s.Memory.SeedRole(ctx, r)
+}
+
+// TestReloadIsAllOrNothing checks that a reload failing on the roles leaves the
+// previous admins in force.
+func TestReloadIsAllOrNothing(t *testing.T) {
+	st := &seedFailingStore{Memory: storage.NewMemory()}
+	s := newTestService(t, st)
+	file := filepath.Join(t.TempDir(), "bot.env")
+	if err := os.WriteFile(file, []byte("ADMIN_USER_IDS=5\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	conf := s.cfg()
+	conf.ConfigFile = file
+	s.conf.Store(&conf)
+
+	st.fail = true
+	if err := s.reload(0, "test"); err == nil {
+		t.Fatal("reload succeeded with failing roles")
+	}
+	if len(s.cfg().AdminUserIDs) != 0 || s.auth.IsAdminID(5) {
+		t.Fatal("failed reload applied the new admins")
+	}
+
+	st.fail = false
+	if err := s.reload(0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.auth.IsAdminID(5) {
+		t.Fatal("reload did not apply the new whitelist")
+	}
+}
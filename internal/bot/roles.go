@@ -0,0 +1,232 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ProxyaService/internal/audit"
+	"ProxyaService/internal/auth"
+	"ProxyaService/internal/roles"
+	"ProxyaService/internal/storage"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// defaultProxyPool is the pool served by the PROXY_* settings.
+const defaultProxyPool = "default"
+
+func (s *Service) roleNames() []string {
+	var res []string
+	for _, r := range s.roles.List() {
+		res = append(res, string(r.Name))
+	}
+	return res
+}
+
+// canGrant reports whether the user may hand out role: a role with permissions
+// the user lacks would escalate privileges.
+func (s *Service) canGrant(ctx context.Context, uid int64, role storage.Role) bool {
+	return s.roles.Covers(s.auth.RoleOf(ctx, uid), role)
+}
+
+// roleChangeDenied returns why uid may not move a user from prev to role, or ""
+// if the change is allowed: uid must cover both roles, so nobody can demote a
+// user who holds rights they lack themselves.
+func (s *Service) roleChangeDenied(ctx context.Context, uid int64, prev, role storage.Role) string {
+	if !s.canGrant(ctx, uid, role) {
+		return grantDeniedMessage
+	}
+	if !s.canGrant(ctx, uid, prev) {
+		return "Нельзя сменить роль пользователю с правами, которых нет у вас"
+	}
+	return ""
+}
+
+func describeRole(r storage.RoleDef) string {
+	name := string(r.Name)
+	if r.DisplayName != "" {
+		name = r.DisplayName + " (" + name + ")"
+	}
+	return name
+}
+
+func limitText(v int64, unit string) string {
+	if v <= 0 {
+		return "без ограничений"
+	}
+	return strconv.FormatInt(v, 10) + unit
+}
+
+func formatRole(r storage.RoleDef) string {
+	pools := "все"
+	if len(r.ProxyPools) > 0 {
+		pools = strings.Join(r.ProxyPools, ",")
+	}
+	perms := "-"
+	if len(r.Permissions) > 0 {
+		perms = strings.Join(r.Permissions, ",")
+	}
+	builtin := ""
+	if r.Builtin {
+		builtin = " [встроенная]"
+	}
+	return fmt.Sprintf("%s%s\n  лимит: %s\n  трафик: %s, соединений: %s (справочно, бот их не ограничивает)\n  пулы: %s\n  права: %s",
+		describeRole(r), builtin, limitText(int64(r.RatePerMin), "/мин"),
+		limitText(r.TrafficQuotaMB, " МБ"), limitText(int64(r.MaxConnections), ""), pools, perms)
+}
+
+// /roles
+func (s *Service) handleRoles(c tele.Context) error {
+	var b strings.Builder
+	b.WriteString("Роли:\n")
+	for _, r := range s.roles.List() {
+		b.WriteString(formatRole(r))
+		b.WriteString("\n")
+	}
+	return c.Send(b.String())
+}
+
+const grantDeniedMessage = "Нельзя выдать роль с правами, которых нет у вас"
+
+const roleSetUsage = "Использование: /role_set <name> [title=<текст>] [rate=<в минуту>] [quota=<МБ>] [conns=<число>] [pools=<a,b|*>] [perms=<p1,p2>]\nПрава: "
+
+// /role_set <name> key=value...
+func (s *Service) handleRoleSet(c tele.Context) error {
+	args := strings.Fields(c.Message().Payload)
+	if len(args) < 1 {
+		return c.Send(roleSetUsage + permissionList())
+	}
+	name := storage.Role(strings.ToLower(args[0]))
+	def := storage.RoleDef{Name: name}
+	if s.roles.Exists(name) {
+		def = s.roles.Get(name)
+	}
+	for _, kv := range args[1:] {
+		key, val, ok := strings.Cut(kv, "=")
+		if !ok {
+			return c.Send("Ожидается key=value: " + kv)
+		}
+		var err error
+		switch key {
+		case "title":
+			def.DisplayName = strings.ReplaceAll(val, "_", " ")
+		case "rate":
+			if def.Builtin {
+				return c.Send("Лимит встроенной роли задаётся переменной RATE_LIMIT_" + strings.ToUpper(string(name)) + "_PER_MIN")
+			}
+			def.RatePerMin, err = strconv.Atoi(val)
+		case "quota":
+			def.TrafficQuotaMB, err = strconv.ParseInt(val, 10, 64)
+		case "conns":
+			def.MaxConnections, err = strconv.Atoi(val)
+		case "pools":
+			def.ProxyPools = nil
+			if val != "*" {
+				def.ProxyPools = splitList(val)
+			}
+		case "perms":
+			def.Permissions = splitList(val)
+			own := s.auth.RoleOf(s.ctx(c), c.Sender().ID)
+			for _, p := range def.Permissions {
+				if !auth.KnownPermission(p) {
+					return c.Send("Неизвестное право: " + p + "\nПрава: " + permissionList())
+				}
+				if !s.roles.Allows(own, p) {
+					return c.Send("Нельзя дать роли право, которого нет у вас: " + p)
+				}
+			}
+		default:
+			return c.Send("Неизвестный параметр: " + key)
+		}
+		if err != nil {
+			return c.Send("Некорректное значение: " + kv)
+		}
+	}
+	if err := s.roles.Save(s.ctx(c), def); err != nil {
+		s.log.Error("role save failed", "role", name, "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка сохранения роли"))
+	}
+	saved := s.roles.Get(name)
+	s.audit.Record(s.ctx(c), audit.RoleSave, c.Sender().ID, 0, map[string]any{
+		"role":             string(name),
+		"display_name":     saved.DisplayName,
+		"rate_per_min":     saved.RatePerMin,
+		"traffic_quota_mb": saved.TrafficQuotaMB,
+		"max_connections":  saved.MaxConnections,
+		"proxy_pools":      saved.ProxyPools,
+		"permissions":      saved.Permissions,
+	})
+	return c.Send("Роль сохранена:\n" + formatRole(s.roles.Get(name)))
+}
+
+// /role_del <name>
+func (s *Service) handleRoleDel(c tele.Context) error {
+	args := strings.Fields(c.Message().Payload)
+	if len(args) < 1 {
+		return c.Send("Использование: /role_del <name>")
+	}
+	name := storage.Role(args[0])
+	switch err := s.roles.Delete(s.ctx(c), name, c.Sender().ID); {
+	case err == nil:
+	case errors.Is(err, roles.ErrUnknownRole), errors.Is(err, storage.ErrNotFound):
+		return c.Send("Роль не найдена")
+	case errors.Is(err, roles.ErrBuiltinRole):
+		return c.Send("Встроенную роль удалить нельзя")
+	default:
+		s.log.Error("role delete failed", "role", name, "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка удаления роли"))
+	}
+	return c.Send(fmt.Sprintf("Роль %s удалена, её пользователи переведены в %s", name, s.roles.Fallback()))
+}
+
+// /set_role <user_id|@username> <role>
+func (s *Service) handleSetRole(c tele.Context) error {
+	args := strings.Fields(c.Message().Payload)
+	if len(args) < 2 {
+		return c.Send("Использование: /set_role <user_id|@username> <" + strings.Join(s.roleNames(), "|") + ">")
+	}
+	target, err := s.resolveUser(s.ctx(c), args[0])
+	if err != nil {
+		return c.Send(userArgError(args[0], err))
+	}
+	role := storage.Role(args[1])
+	if !s.roles.Exists(role) {
+		return c.Send("Неизвестная роль: " + args[1])
+	}
+	ctx := s.ctx(c)
+	prev := s.auth.RoleOf(ctx, target)
+	if msg := s.roleChangeDenied(ctx, c.Sender().ID, prev, role); msg != "" {
+		return c.Send(msg)
+	}
+	err = s.store.SetUserRole(ctx, target, role)
+	if errors.Is(err, storage.ErrNotFound) {
+		err = s.store.UpsertUser(ctx, storage.User{ID: target, Role: role})
+	}
+	if err != nil {
+		s.log.Error("set role failed", "user", target, "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка смены роли"))
+	}
+	s.audit.Record(ctx, audit.RoleChange, c.Sender().ID, target, map[string]any{"role": string(role), "previous": string(prev)})
+	return c.Send(fmt.Sprintf("Пользователю %d назначена роль %s", target, describeRole(s.roles.Get(role))))
+}
+
+func permissionList() string {
+	var res []string
+	for _, p := range auth.AllPermissions {
+		res = append(res, string(p))
+	}
+	return strings.Join(res, ",")
+}
+
+func splitList(v string) []string {
+	var res []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			res = append(res, p)
+		}
+	}
+	return res
+}
@@ -0,0 +1,63 @@
+package bot
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"ProxyaService/internal/auth"
+	"ProxyaService/internal/config"
+	"ProxyaService/internal/roles"
+	"ProxyaService/internal/storage"
+)
+
+// newTestService builds a Service over st without connecting to Telegram.
+func newTestService(t *testing.T, st storage.Store) *Service {
+	t.Helper()
+	ctx := context.Background()
+	r := roles.New(auth.BuiltinRoles(10, 60, 500), storage.RoleFree)
+	if err := r.AttachStore(ctx, st); err != nil {
+		t.Fatal(err)
+	}
+	a := auth.New(auth.Options{Roles: r})
+	a.AttachStore(st)
+	s := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.Config{}, a, r)
+	s.store = st
+	return s
+}
+
+func TestRoleChangeDenied(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMemory()
+	s := newTestService(t, st)
+	moderator := storage.RoleDef{Name: "moderator", Permissions: []string{string(auth.PermProxy), string(auth.PermManageUsers)}}
+	if err := s.roles.Save(ctx, moderator); err != nil {
+		t.Fatal(err)
+	}
+	for id, role := range map[int64]storage.Role{1: "moderator", 2: storage.RoleAdmin} {
+		if err := st.UpsertUser(ctx, storage.User{ID: id, Role: role}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name       string
+		caller     int64
+		prev, role storage.Role
+		allowed    bool
+	}{
+		{"promote within own rights", 1, storage.RoleFree, storage.RolePremium, true},
+		{"grant own role", 1, storage.RoleFree, "moderator", true},
+		{"grant a higher role", 1, storage.RoleFree, storage.RoleAdmin, false},
+		{"demote a higher role", 1, storage.RoleAdmin, storage.RoleFree, false},
+		{"admin demotes", 2, storage.RoleAdmin, storage.RoleFree, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := s.roleChangeDenied(ctx, tc.caller, tc.prev, tc.role)
+			if (msg == "") != tc.allowed {
+				t.Fatalf("allowed = %v (%q), want %v", msg == "", msg, tc.allowed)
+			}
+		})
+	}
+}
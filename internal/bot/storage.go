@@ -0,0 +1,242 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"ProxyaService/internal/health"
+
+	"ProxyaService/internal/metrics"
+	"ProxyaService/internal/ratelimit"
+	"ProxyaService/internal/roles"
+	"ProxyaService/internal/storage"
+)
+
+// Storage startup policies (STORAGE_STARTUP).
+const (
+	startupFail     = "fail"     // exit if the database is unreachable
+	startupRetry    = "retry"    // block start until it is reachable
+	startupDegraded = "degraded" // start without it and reconnect in the background
+)
+
+// initStorage wires every component to a storage.Switch and connects it according
+// to the startup policy. Without a DSN data is kept in memory until restart.
+func (s *Service) initStorage(ctx context.Context) error {
+	keys, err := storage.LoadKeyring(s.cfg().SecretKeys, s.cfg().SecretKeysFile)
+	if err != nil {
+		return fmt.Errorf("secret keys: %w", err)
+	}
+	if keys == nil && s.cfg().PostgresDSN != "" {
+		s.log.Warn("SECRET_KEYS not set, secrets are stored in plaintext")
+	}
+	s.keys = keys
+	s.sw = storage.NewSwitch()
+	s.store = s.sw
+	s.audit.AttachStore(s.sw)
+	s.auth.AttachStore(s.sw)
+	s.rl = ratelimit.New(s.sw, s.roles, s.cfg().RateLimitBackend, s.cfg().RateLimitBurst)
+	s.health.Add("storage", s.storageHealth)
+
+	st, err := s.connectStorage(ctx)
+	if err == nil {
+		s.storageReady(ctx, st)
+		return nil
+	}
+	s.setStorageErr(err)
+	switch s.cfg().StorageStartup {
+	case startupFail:
+		return fmt.Errorf("storage: %w", err)
+	case startupRetry:
+		s.log.Error("storage unavailable, waiting", "error", err)
+		st, err := s.reconnectStorage(ctx)
+		if err != nil {
+			return fmt.Errorf("storage: %w", err)
+		}
+		s.storageReady(ctx, st)
+	default:
+		s.log.Error("storage unavailable, running degraded", "error", err)
+		go func() {
+			if st, err := s.reconnectStorage(ctx); err == nil {
+				s.storageReady(ctx, st)
+			}
+		}()
+	}
+	return nil
+}
+
+// connectStorage opens the store and applies migrations.
+func (s *Service) connectStorage(ctx context.Context) (storage.Store, error) {
+	dsn := s.cfg().PostgresDSN
+	st, err := storage.Open(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dsn == "" {
+		s.log.Warn("PG_DSN not set, using in-memory storage")
+	}
+	if err := st.Migrate(ctx); err != nil {
+		st.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return st, nil
+}
+
+// reconnectStorage retries connectStorage with exponential backoff until it
+// succeeds or ctx is done.
+func (s *Service) reconnectStorage(ctx context.Context) (storage.Store, error) {
+	delay := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		metrics.Add("storage_reconnects", 1)
+		st, err := s.connectStorage(ctx)
+		if err == nil {
+			return st, nil
+		}
+		s.setStorageErr(err)
+		s.log.Warn("storage reconnect failed", "error", err, "retry_in", (2 * delay).String())
+		delay *= 2
+		if max := time.Duration(s.cfg().StorageRetryMaxSec) * time.Second; max > 0 && delay > max {
+			delay = max
+		}
+	}
+}
+
+// storageReady installs the connected store behind secret encryption and the
+// user cache and loads what depends on it.
+func (s *Service) storageReady(ctx context.Context, st storage.Store) {
+	st = storage.NewSecretBox(st, s.keys)
+	if box, ok := st.(*storage.SecretBox); ok {
+		go s.reencryptSecrets(ctx, box)
+	}
+	cache := storage.NewUserCache(st, time.Duration(s.cfg().UserCacheSec)*time.Second)
+	s.sw.Set(cache)
+	go s.listenUserChanges(ctx, cache)
+	s.setStorageErr(nil)
+	s.log.Info("storage connected")
+	if err := s.roles.AttachStore(ctx, s.sw); err != nil {
+		s.log.Error("roles init failed", "error", err)
+	}
+	if err := s.auth.LoadAuthenticated(ctx); err != nil {
+		s.log.Error("load authenticated users failed", "error", err)
+	}
+	if err := s.auth.LoadBans(ctx); err != nil {
+		s.log.Error("load bans failed", "error", err)
+	}
+	if err := s.auth.SeedAdmins(ctx); err != nil {
+		s.log.Error("seed admins failed", "error", err)
+	}
+}
+
+// reencryptSecrets moves secrets left in plaintext or under an old key to the
+// primary key. One replica does it; the rest skip while the lock is held.
+func (s *Service) reencryptSecrets(ctx context.Context, box *storage.SecretBox) {
+	release, ok, err := box.TryLock(ctx, "secrets.reencrypt")
+	if err != nil || !ok {
+		if err != nil {
+			s.log.Error("secret re-encryption lock failed", "error", err)
+		}
+		return
+	}
+	defer release()
+	n, err := box.Reencrypt(ctx, s.cfg().MaintenanceBatch)
+	if err != nil {
+		s.log.Error("secret re-encryption failed", "rewritten", n, "error", err)
+		return
+	}
+	if n > 0 {
+		s.log.Info("secrets re-encrypted", "rewritten", n, "key_version", s.keys.Primary())
+	}
+}
+
+// listenUserChanges keeps the cache subscribed to invalidations from other
+// replicas, reconnecting with backoff. It returns at once for stores that
+// cannot notify (memory, SQLite), which only ever have a single process.
+func (s *Service) listenUserChanges(ctx context.Context, cache *storage.UserCache) {
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := cache.Listen(ctx)
+		if errors.Is(err, errors.ErrUnsupported) || ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		s.log.Warn("user cache listener stopped", "error", err, "retry_in", delay.String())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > time.Minute {
+			delay = time.Minute
+		}
+	}
+}
+
+// storeErrorMessage returns the reply for a failed store call: a notice while
+// the database is unreachable, msg otherwise. The role registry gets its store
+// only on the first connection and reports ErrNoStore until then.
+func storeErrorMessage(err error, msg string) string {
+	if errors.Is(err, storage.ErrUnavailable) || errors.Is(err, roles.ErrNoStore) {
+		return "Хранилище временно недоступно, попробуйте позже."
+	}
+	return msg
+}
+
+func (s *Service) setStorageErr(err error) {
+	if err == nil {
+		s.storageErr.Store(nil)
+		return
+	}
+	msg := err.Error()
+	s.storageErr.Store(&msg)
+}
+
+// storageHealth is the health check of the store.
+func (s *Service) storageHealth(ctx context.Context) (string, error) {
+	if !s.sw.Available() {
+		if msg := s.storageErr.Load(); msg != nil {
+			return "reconnecting", fmt.Errorf("%w: %s", storage.ErrUnavailable, *msg)
+		}
+		return "reconnecting", storage.ErrUnavailable
+	}
+	if err := s.sw.Ping(ctx); err != nil {
+		return "down", err
+	}
+	if s.cfg().PostgresDSN == "" {
+		return "memory", nil
+	}
+	return "ok", nil
+}
+
+// formatHealth renders the health report for admins in /status.
+func formatHealth(rep health.Report) string {
+	var b strings.Builder
+	if rep.OK() {
+		b.WriteString("Сервис: в норме")
+	} else {
+		b.WriteString("Сервис: работает с ограничениями")
+	}
+	names := make([]string, 0, len(rep.Components))
+	for name := range rep.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		st := rep.Components[name]
+		fmt.Fprintf(&b, "\n%s: %s", name, st.State)
+		if st.Error != "" {
+			b.WriteString(" (" + st.Error + ")")
+		}
+	}
+	return b.String()
+}
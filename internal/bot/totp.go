@@ -0,0 +1,113 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"ProxyaService/internal/auth"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// handleSensitive registers an admin command that also requires a fresh TOTP code.
+// Like handleOnce, a redelivered update is not applied twice.
+func (s *Service) handleSensitive(b *tele.Bot, endpoint string, perm auth.Permission, h tele.HandlerFunc) {
+	b.Handle(endpoint, h, s.require(perm), s.requireTOTP, s.once(endpoint))
+}
+
+// requireTOTP lets the command through only if the caller verified a code within the window.
+func (s *Service) requireTOTP(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		uid := c.Sender().ID
+		need, err := s.auth.NeedsTOTP(s.ctx(c), uid)
+		if err != nil {
+			s.log.Error("totp check failed", "user", uid, "error", err)
+			return c.Send("Ошибка проверки второго фактора")
+		}
+		if !need || s.auth.Elevated(uid) {
+			return next(c)
+		}
+		msg := "Команда требует подтверждения: отправьте /totp <код> из приложения-аутентификатора и повторите."
+		if enrolled, _ := s.auth.TOTPEnrolled(s.ctx(c), uid); !enrolled {
+			msg = "Команда требует второго фактора. Подключите его: /totp_enroll"
+		}
+		if c.Callback() != nil {
+			return c.Respond(&tele.CallbackResponse{Text: msg, ShowAlert: true})
+		}
+		return c.Send(msg)
+	}
+}
+
+// /totp_enroll
+func (s *Service) handleTOTPEnroll(c tele.Context) error {
+	uid := c.Sender().ID
+	if !s.auth.AuthorizeUserByID(uid) {
+		return c.Send("Доступ ограничён. Обратитесь к администратору.")
+	}
+	ctx := s.ctx(c)
+	// re-enrolling an active factor must be confirmed with the current one
+	if enrolled, _ := s.auth.TOTPEnrolled(ctx, uid); enrolled && !s.auth.Elevated(uid) {
+		return c.Send("Второй фактор уже подключён. Чтобы заменить его, сначала подтвердите текущий код: /totp <код>")
+	}
+	uri, err := s.auth.EnrollTOTP(ctx, uid, c.Sender().Username)
+	if err != nil {
+		s.log.Error("totp enroll failed", "user", uid, "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка подключения второго фактора"))
+	}
+	markup := &tele.ReplyMarkup{}
+	markup.Inline(markup.Row(markup.URL("Добавить в аутентификатор", uri)))
+	return c.Send("Добавьте ключ в приложение-аутентификатор (Google Authenticator, Aegis и т.п.) по ссылке или вручную:\n"+
+		uri+"\n\nЗатем подтвердите подключение: /totp <код>\nУдалите это сообщение после настройки.", markup)
+}
+
+// /totp <code>
+func (s *Service) handleTOTP(c tele.Context) error {
+	uid := c.Sender().ID
+	args := strings.Fields(c.Message().Payload)
+	if len(args) < 1 {
+		return c.Send("Использование: /totp <код>")
+	}
+	// the code is single-use, but there is no reason to keep it in the chat
+	_ = c.Delete()
+	err := s.auth.VerifyTOTP(s.ctx(c), uid, args[0])
+	switch {
+	case err == nil:
+		return c.Send(fmt.Sprintf("Код принят. Команды администратора доступны %d мин.", s.cfg().TOTPWindowMin))
+	case errors.Is(err, auth.ErrTOTPNotEnrolled):
+		return c.Send("Второй фактор не подключён: /totp_enroll")
+	case errors.Is(err, auth.ErrTOTPInvalidCode):
+		return c.Send("Неверный код")
+	case errors.Is(err, auth.ErrTOTPCodeReplayed):
+		return c.Send("Этот код уже использован, дождитесь следующего")
+	}
+	if msg := s.authThrottledMessage(err, uid); msg != "" {
+		return c.Send(msg)
+	}
+	s.log.Error("totp verify failed", "user", uid, "error", err)
+	return c.Send("Ошибка проверки кода")
+}
+
+// /totp_reset [user_id] — removes own or (with users.manage) someone else's second factor.
+func (s *Service) handleTOTPReset(c tele.Context) error {
+	uid := c.Sender().ID
+	target := uid
+	if args := strings.Fields(c.Message().Payload); len(args) > 0 {
+		id, err := s.resolveUser(s.ctx(c), args[0])
+		if err != nil {
+			return c.Send(userArgError(args[0], err))
+		}
+		if id != uid && !s.auth.HasPermission(s.ctx(c), uid, auth.PermManageUsers) {
+			return c.Send("Нет прав")
+		}
+		target = id
+	}
+	switch err := s.auth.ResetTOTP(s.ctx(c), target, uid); {
+	case errors.Is(err, auth.ErrTOTPNotEnrolled):
+		return c.Send("Второй фактор не подключён")
+	case err != nil:
+		s.log.Error("totp reset failed", "user", target, "error", err)
+		return c.Send(storeErrorMessage(err, "Ошибка сброса второго фактора"))
+	}
+	return c.Send(fmt.Sprintf("Второй фактор пользователя %d удалён", target))
+}
@@ -0,0 +1,214 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ProxyaService/internal/auth"
+	"ProxyaService/internal/metrics"
+	"ProxyaService/internal/storage"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// updateOffsetKey prefixes the setting holding the last handled update ID; the
+// bot ID is appended, so bots sharing a database keep separate offsets.
+const updateOffsetKey = "telegram.update_offset."
+
+// updateOffsetFlush is how often the last handled update ID is saved.
+const updateOffsetFlush = 2 * time.Second
+
+// updateOffsetMaxAge: Telegram keeps undelivered updates for 24 hours and may
+// restart numbering after a week without updates, so an older offset is ignored.
+const updateOffsetMaxAge = 24 * time.Hour
+
+type savedOffset struct {
+	UpdateID int       `json:"update_id"`
+	SavedAt  time.Time `json:"saved_at"`
+}
+
+func (s *Service) offsetKey() string {
+	return updateOffsetKey + strconv.FormatInt(s.bot.Me.ID, 10)
+}
+
+// updateTracker keeps the low watermark of handled updates: the highest ID up
+// to which every polled update has been handled. Handlers run concurrently, so
+// a later update can finish first; saving its ID would lose the earlier one
+// after a crash.
+type updateTracker struct {
+	mu       sync.Mutex
+	inflight []int // ascending, as updates are polled in order
+	polled   int   // highest ID polled
+}
+
+// begin records an update as polled and not yet handled.
+func (t *updateTracker) begin(id int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inflight = append(t.inflight, id)
+	t.polled = max(t.polled, id)
+}
+
+// done records that all handlers of an update have returned.
+func (t *updateTracker) done(id int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if i := slices.Index(t.inflight, id); i >= 0 {
+		t.inflight = slices.Delete(t.inflight, i, i+1)
+	}
+}
+
+// resume moves the watermark to an offset handled by another replica.
+func (t *updateTracker) resume(id int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.polled = max(t.polled, id)
+}
+
+func (t *updateTracker) watermark() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.inflight) > 0 {
+		return t.inflight[0] - 1
+	}
+	return t.polled
+}
+
+// trackingPoller runs each polled update in its own goroutine and records it in
+// the tracker. The bot must be synchronous, so that ProcessUpdate returns only
+// once every handler of the update has.
+type trackingPoller struct {
+	poller  *tele.LongPoller
+	updates *updateTracker
+}
+
+func (p *trackingPoller) Poll(b *tele.Bot, _ chan tele.Update, stop chan struct{}) {
+	in := make(chan tele.Update)
+	stopPoller := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		p.poller.Poll(b, in, stopPoller)
+	}()
+	var wg sync.WaitGroup
+	for {
+		select {
+		case upd := <-in:
+			p.updates.begin(upd.ID)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer p.updates.done(upd.ID)
+				b.ProcessUpdate(upd)
+			}()
+		case <-stop:
+			close(stopPoller)
+			// updates fetched meanwhile are dropped: they are above the watermark,
+			// so the next poll fetches them again
+			for done := false; !done; {
+				select {
+				case <-in:
+				case <-polled:
+					done = true
+				}
+			}
+			wg.Wait()
+			p.poller.LastUpdateID = p.updates.watermark()
+			return
+		}
+	}
+}
+
+// restoreOffset makes the poller start after the last update handled by any
+// replica, so a restart or failover does not fetch handled updates again.
+func (s *Service) restoreOffset(ctx context.Context) {
+	raw, err := s.store.GetSetting(ctx, s.offsetKey())
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrUnavailable) {
+			s.log.Warn("load update offset failed", "error", err)
+		}
+		return
+	}
+	var o savedOffset
+	if err := json.Unmarshal([]byte(raw), &o); err != nil {
+		s.log.Warn("bad saved update offset", "value", raw, "error", err)
+		return
+	}
+	if time.Since(o.SavedAt) > updateOffsetMaxAge {
+		s.log.Info("saved update offset is stale, ignoring", "update", o.UpdateID, "saved_at", o.SavedAt)
+		return
+	}
+	if o.UpdateID > s.poller.LastUpdateID {
+		s.poller.LastUpdateID = o.UpdateID
+		s.updates.resume(o.UpdateID)
+		s.log.Info("resuming after saved update", "update", o.UpdateID)
+	}
+}
+
+// saveOffsets writes the update watermark every updateOffsetFlush and once more
+// when stopped is closed, after polling and the handlers have finished.
+func (s *Service) saveOffsets(stopped <-chan struct{}) {
+	saved := s.updates.watermark()
+	save := func(ctx context.Context) {
+		id := s.updates.watermark()
+		if id <= saved {
+			return
+		}
+		raw, _ := json.Marshal(savedOffset{UpdateID: id, SavedAt: time.Now().UTC()})
+		if err := s.store.PutSetting(ctx, s.offsetKey(), string(raw)); err != nil {
+			if !errors.Is(err, storage.ErrUnavailable) {
+				s.log.Warn("save update offset failed", "error", err)
+			}
+			return
+		}
+		saved = id
+	}
+	t := time.NewTicker(updateOffsetFlush)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopped:
+			fctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			save(fctx)
+			cancel()
+			return
+		case <-t.C:
+			save(s.runCtx)
+		}
+	}
+}
+
+// handleOnce registers a side-effecting command that must not be applied twice
+// for the same update.
+func (s *Service) handleOnce(b *tele.Bot, endpoint string, perm auth.Permission, h tele.HandlerFunc) {
+	b.Handle(endpoint, h, s.require(perm), s.once(endpoint))
+}
+
+// once drops an update that was already claimed by a handler, e.g. one
+// redelivered by Telegram after a crash. If the claim cannot be recorded the
+// handler runs anyway: a lost command is worse than a rare repeat.
+func (s *Service) once(endpoint string) tele.MiddlewareFunc {
+	name := strings.TrimPrefix(endpoint, "\f")
+	return func(next tele.HandlerFunc) tele.HandlerFunc {
+		return func(c tele.Context) error {
+			id := c.Update().ID
+			ok, err := s.store.ClaimUpdate(s.ctx(c), int64(id), name)
+			switch {
+			case errors.Is(err, storage.ErrUnavailable):
+			case err != nil:
+				s.log.Warn("claim update failed", "update", id, "handler", name, "error", err)
+			case !ok:
+				metrics.Add("updates_deduplicated", 1)
+				s.log.Info("duplicate update skipped", "update", id, "handler", name)
+				return nil
+			}
+			return next(c)
+		}
+	}
+}
@@ -1,9 +1,15 @@
 package config
 
 import (
+	"context"
+	"fmt"
+	"maps"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
 )
 
 type Config struct {
@@ -13,32 +19,184 @@ type Config struct {
 	ProxyUser         string
 	ProxyPass         string
 	AllowedUserIDs    []int64
-	AuthTokens        []string
+	AdminUserIDs      []int64
+	AuthTokens        []StaticToken
 	LogLevel          string
 	PostgresDSN       string
 	DefaultRole       string
 	RatePerMinFree    int
 	RatePerMinPremium int
 	RatePerMinAdmin   int
-	ThrottleSeconds   int
+	RateLimitBackend  string // limiter state: memory, store or window (count of rate_events)
+	RateLimitBurst    int    // requests admitted at once before the per-minute pace applies
+	AuthMaxFailures   int
+	AuthBackoffSec    int
+	AuthLockoutMin    int
+	MemberChats       []MemberChat
+	MemberCacheMin    int
+	MemberRecheckMin  int
+	ConfigFile        string
+	ConfigWatchSec    int
+	TOTPRequired      bool
+	TOTPWindowMin     int
+	TOTPIssuer        string
+	// Maintenance: cleanup interval, delete batch size and how long rows are kept (0 disables a job)
+	MaintenanceMin     int
+	MaintenanceBatch   int
+	RetainRateEventsHr int
+	RetainTokensDays   int
+	RetainUpdatesHr    int
+	// ForgetAuditPolicy is what /forget_me does with audit events: anonymize, delete or keep
+	ForgetAuditPolicy string
+	// StorageStartup is what happens when the database is unreachable at start: fail, retry or
+	// degraded; degraded needs LeaderElection off, since leadership is a database lock
+	StorageStartup     string
+	StorageRetryMaxSec int
+	// HealthAddr is where /health and /debug/vars are served; empty disables the endpoint
+	HealthAddr string
+	// UpdateTimeoutSec bounds the handling of one update, database calls included
+	UpdateTimeoutSec int
+	// UserCacheSec is how long user records are cached in memory; 0 disables the cache
+	UserCacheSec int
+	// SecretKeys and SecretKeysFile hold "version:base64key" entries used to encrypt
+	// stored secrets; with neither set secrets are stored in plaintext
+	SecretKeys     string
+	SecretKeysFile string
+	// LeaderElection lets only one replica sharing the database poll Telegram and run
+	// background jobs; LeaderCheckSec is how often leadership is checked and contested
+	LeaderElection bool
+	LeaderCheckSec int
+	// AccessNotifyMin is how often a comment on a pending access request is re-sent to
+	// admins; AccessRetryHours is how long a denied user waits before asking again
+	AccessNotifyMin  int
+	AccessRetryHours int
+	// AuthTokensErr is why AUTH_TOKENS_FILE could not be read; AuthTokens then holds
+	// only the tokens given inline
+	AuthTokensErr error
+}
+
+// StaticToken is a token from AUTH_TOKENS or AUTH_TOKENS_FILE. Empty Role means free;
+// nil ExpiresAt means the token never expires.
+type StaticToken struct {
+	Value     string
+	Role      string
+	ExpiresAt *time.Time
+}
+
+// MemberChat is a chat whose members are authorized, optionally with a role.
+type MemberChat struct {
+	ChatID int64
+	Role   string
 }
 
-func Load() Config {
+// Load builds the configuration from the process environment.
+func Load() Config { return load(os.Getenv) }
+
+func load(getenv func(string) string) Config {
+	tokens, tokensErr := loadStaticTokens(getenv("AUTH_TOKENS_FILE"), getenv("AUTH_TOKENS"), getenv("AUTH_TOKEN"))
+	leaderElection := parseBoolDefault(getenv("LEADER_ELECTION"), true)
 	return Config{
-		BotToken:          firstNonEmpty(os.Getenv("TOKEN"), os.Getenv("BOT_TOKEN")),
-		ProxyHost:         firstNonEmpty(os.Getenv("PROXY_HOST"), os.Getenv("PROXY_SERVER")),
-		ProxyPort:         os.Getenv("PROXY_PORT"),
-		ProxyUser:         os.Getenv("PROXY_USER"),
-		ProxyPass:         os.Getenv("PROXY_PASS"),
-		AllowedUserIDs:    parseInt64List(os.Getenv("ALLOWED_USER_IDS")),
-		AuthTokens:        parseStringList(os.Getenv("AUTH_TOKENS"), os.Getenv("AUTH_TOKEN")),
-		LogLevel:          firstNonEmpty(os.Getenv("LOG_LEVEL"), "info"),
-		PostgresDSN:       firstNonEmpty(os.Getenv("PG_DSN"), buildDSN()),
-		DefaultRole:       firstNonEmpty(os.Getenv("DEFAULT_ROLE"), "free"),
-		RatePerMinFree:    parseIntDefault(os.Getenv("RATE_LIMIT_FREE_PER_MIN"), 10),
-		RatePerMinPremium: parseIntDefault(os.Getenv("RATE_LIMIT_PREMIUM_PER_MIN"), 60),
-		RatePerMinAdmin:   parseIntDefault(os.Getenv("RATE_LIMIT_ADMIN_PER_MIN"), 500),
-		ThrottleSeconds:   parseIntDefault(os.Getenv("THROTTLE_SECONDS"), 2),
+		BotToken:           firstNonEmpty(getenv("TOKEN"), getenv("BOT_TOKEN")),
+		ProxyHost:          firstNonEmpty(getenv("PROXY_HOST"), getenv("PROXY_SERVER")),
+		ProxyPort:          getenv("PROXY_PORT"),
+		ProxyUser:          getenv("PROXY_USER"),
+		ProxyPass:          getenv("PROXY_PASS"),
+		AllowedUserIDs:     parseInt64List(getenv("ALLOWED_USER_IDS")),
+		AdminUserIDs:       parseInt64List(getenv("ADMIN_USER_IDS")),
+		AuthTokens:         tokens,
+		LogLevel:           firstNonEmpty(getenv("LOG_LEVEL"), "info"),
+		PostgresDSN:        firstNonEmpty(getenv("PG_DSN"), buildDSN(getenv)),
+		DefaultRole:        firstNonEmpty(getenv("DEFAULT_ROLE"), "free"),
+		RatePerMinFree:     parseIntDefault(getenv("RATE_LIMIT_FREE_PER_MIN"), 10),
+		RatePerMinPremium:  parseIntDefault(getenv("RATE_LIMIT_PREMIUM_PER_MIN"), 60),
+		RatePerMinAdmin:    parseIntDefault(getenv("RATE_LIMIT_ADMIN_PER_MIN"), 500),
+		RateLimitBackend:   parseRateLimitBackend(getenv("RATE_LIMIT_BACKEND")),
+		RateLimitBurst:     parseIntDefault(getenv("RATE_LIMIT_BURST"), 3),
+		AuthMaxFailures:    parseIntDefault(getenv("AUTH_MAX_FAILURES"), 5),
+		AuthBackoffSec:     parseIntDefault(getenv("AUTH_BACKOFF_SECONDS"), 2),
+		AuthLockoutMin:     parseIntDefault(getenv("AUTH_LOCKOUT_MINUTES"), 30),
+		MemberChats:        parseMemberChats(getenv("MEMBER_CHATS")),
+		MemberCacheMin:     parseIntDefault(getenv("MEMBER_CACHE_MINUTES"), 10),
+		MemberRecheckMin:   parseIntDefault(getenv("MEMBER_RECHECK_MINUTES"), 60),
+		ConfigFile:         firstNonEmpty(getenv("CONFIG_FILE"), ".env"),
+		ConfigWatchSec:     parseIntDefault(getenv("CONFIG_WATCH_SECONDS"), 0),
+		TOTPRequired:       parseBoolDefault(getenv("TOTP_REQUIRED"), true),
+		TOTPWindowMin:      parseIntDefault(getenv("TOTP_WINDOW_MINUTES"), 5),
+		TOTPIssuer:         firstNonEmpty(getenv("TOTP_ISSUER"), "ProxyaService"),
+		MaintenanceMin:     parseIntDefault(getenv("MAINTENANCE_INTERVAL_MINUTES"), 60),
+		MaintenanceBatch:   parseIntDefault(getenv("MAINTENANCE_BATCH_SIZE"), 1000),
+		RetainRateEventsHr: parseIntDefault(getenv("RETENTION_RATE_EVENTS_HOURS"), 168),
+		RetainTokensDays:   parseIntDefault(getenv("RETENTION_TOKENS_DAYS"), 30),
+		RetainUpdatesHr:    parseIntDefault(getenv("RETENTION_UPDATES_HOURS"), 48),
+		ForgetAuditPolicy:  parseAuditPolicy(getenv("FORGET_AUDIT_POLICY")),
+		StorageStartup:     parseStartupPolicy(getenv("STORAGE_STARTUP"), leaderElection),
+		StorageRetryMaxSec: parseIntDefault(getenv("STORAGE_RETRY_MAX_SECONDS"), 60),
+		HealthAddr:         getenv("HEALTH_ADDR"),
+		UpdateTimeoutSec:   parseIntDefault(getenv("UPDATE_TIMEOUT_SECONDS"), 30),
+		UserCacheSec:       parseIntDefault(getenv("USER_CACHE_SECONDS"), 30),
+		SecretKeys:         getenv("SECRET_KEYS"),
+		SecretKeysFile:     getenv("SECRET_KEYS_FILE"),
+		LeaderElection:     leaderElection,
+		LeaderCheckSec:     parseIntDefault(getenv("LEADER_CHECK_SECONDS"), 5),
+		AccessNotifyMin:    parseIntDefault(getenv("ACCESS_NOTIFY_MINUTES"), 10),
+		AuthTokensErr:      tokensErr,
+		AccessRetryHours:   parseIntDefault(getenv("ACCESS_RETRY_HOURS"), 24),
+	}
+}
+
+// processEnv is the environment the process started with, before main loaded
+// any file into it; Reload starts from it so removed variables go away.
+var processEnv = environ()
+
+// Reload re-reads the config file and builds a fresh Config from it over the
+// original process environment, without touching the environment itself.
+// Values from the file override process environment; a missing file is not an error.
+func Reload(file string) (Config, error) {
+	env := maps.Clone(processEnv)
+	if file != "" {
+		values, err := godotenv.Read(file)
+		if err != nil && !os.IsNotExist(err) {
+			return Config{}, err
+		}
+		maps.Copy(env, values)
+	}
+	return load(func(key string) string { return env[key] }), nil
+}
+
+func environ() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// Watch polls the file's modification time and calls onChange after it changes.
+func Watch(ctx context.Context, file string, every time.Duration, onChange func()) {
+	if file == "" || every <= 0 {
+		return
+	}
+	modTime := func() time.Time {
+		if st, err := os.Stat(file); err == nil {
+			return st.ModTime()
+		}
+		return time.Time{}
+	}
+	last := modTime()
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if m := modTime(); !m.Equal(last) {
+				last = m
+				onChange()
+			}
+		}
 	}
 }
 
@@ -70,6 +228,82 @@ func parseInt64List(s string) []int64 {
 	return res
 }
 
+// parseMemberChats parses "chat_id[:role],..." e.g. "-1001234567890:premium,-1009876543210".
+func parseMemberChats(s string) []MemberChat {
+	var res []MemberChat
+	for _, p := range parseStringList(s) {
+		id, role, _ := strings.Cut(p, ":")
+		v, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+		if err != nil {
+			continue
+		}
+		res = append(res, MemberChat{ChatID: v, Role: strings.TrimSpace(role)})
+	}
+	return res
+}
+
+// loadStaticTokens reads "token[:role[:expiry]]" entries from env values and,
+// if set, from a file with one entry per line ("#" starts a comment). If the file
+// cannot be read, the inline tokens are returned with the error.
+func loadStaticTokens(file string, values ...string) ([]StaticToken, error) {
+	entries := parseStringList(values...)
+	var fileErr error
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fileErr = fmt.Errorf("AUTH_TOKENS_FILE: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				entries = append(entries, line)
+			}
+		}
+	}
+	var res []StaticToken
+	for _, e := range entries {
+		if t, ok := ParseStaticToken(e); ok {
+			res = append(res, t)
+		}
+	}
+	return res, fileErr
+}
+
+// ParseStaticToken parses "token[:role[:expiry]]". Expiry is RFC 3339 or YYYY-MM-DD
+// (end of that day, UTC). Entries with an unparsable expiry are rejected rather than
+// treated as never expiring.
+func ParseStaticToken(s string) (StaticToken, bool) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 3)
+	t := StaticToken{Value: strings.TrimSpace(parts[0])}
+	if t.Value == "" {
+		return StaticToken{}, false
+	}
+	if len(parts) > 1 {
+		t.Role = strings.TrimSpace(parts[1])
+	}
+	if len(parts) > 2 && strings.TrimSpace(parts[2]) != "" {
+		exp, err := parseExpiry(strings.TrimSpace(parts[2]))
+		if err != nil {
+			return StaticToken{}, false
+		}
+		t.ExpiresAt = &exp
+	}
+	return t, true
+}
+
+func parseExpiry(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	d, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return d.Add(24*time.Hour - time.Nanosecond), nil
+}
+
 func parseStringList(values ...string) []string {
 	var in []string
 	for _, v := range values {
@@ -104,13 +338,52 @@ func parseIntDefault(s string, def int) int {
 	return def
 }
 
-func buildDSN() string {
-	host := firstNonEmpty(os.Getenv("PG_HOST"), os.Getenv("POSTGRES_HOST"))
-	port := firstNonEmpty(os.Getenv("PG_PORT"), os.Getenv("POSTGRES_PORT"))
-	user := firstNonEmpty(os.Getenv("PG_USER"), os.Getenv("POSTGRES_USER"))
-	pass := firstNonEmpty(os.Getenv("PG_PASSWORD"), os.Getenv("POSTGRES_PASSWORD"))
-	db := firstNonEmpty(os.Getenv("PG_DB"), os.Getenv("POSTGRES_DB"))
-	ssl := firstNonEmpty(os.Getenv("PG_SSLMODE"), os.Getenv("POSTGRES_SSLMODE"))
+// parseAuditPolicy accepts anonymize, delete or keep; anything else means anonymize.
+func parseAuditPolicy(v string) string {
+	switch v = strings.ToLower(strings.TrimSpace(v)); v {
+	case "delete", "keep":
+		return v
+	}
+	return "anonymize"
+}
+
+// parseStartupPolicy accepts fail, retry or degraded. The default is degraded,
+// or retry under leader election: without the database no replica can lead.
+func parseStartupPolicy(v string, leaderElection bool) string {
+	switch v = strings.ToLower(strings.TrimSpace(v)); v {
+	case "fail", "retry", "degraded":
+		return v
+	}
+	if leaderElection {
+		return "retry"
+	}
+	return "degraded"
+}
+
+// parseRateLimitBackend accepts memory, store or window; anything else means memory.
+func parseRateLimitBackend(v string) string {
+	switch v = strings.ToLower(strings.TrimSpace(v)); v {
+	case "store", "window":
+		return v
+	}
+	return "memory"
+}
+
+func parseBoolDefault(s string, def bool) bool {
+	v, err := strconv.ParseBool(strings.TrimSpace(s))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func buildDSN(getenv func(string) string) string {
+	host := firstNonEmpty(getenv("PG_HOST"), getenv("POSTGRES_HOST"))
+	port := firstNonEmpty(getenv("PG_PORT"), getenv("POSTGRES_PORT"))
+	user := firstNonEmpty(getenv("PG_USER"), getenv("POSTGRES_USER"))
+	pass := firstNonEmpty(getenv("PG_PASSWORD"), getenv("POSTGRES_PASSWORD"))
+	db := firstNonEmpty(getenv("PG_DB"), getenv("POSTGRES_DB"))
+	ssl := firstNonEmpty(getenv("PG_SSLMODE"), getenv("POSTGRES_SSLMODE"))
 	if host == "" || user == "" || db == "" {
 		return ""
 	}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReloadDropsRemovedVariables checks that a variable deleted from the file
+// stops applying on reload, and that the process environment is left alone.
+func TestReloadDropsRemovedVariables(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bot.env")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("ALLOWED_USER_IDS=1,2\nADMIN_USER_IDS=3\nAUTH_TOKENS=secret:premium\n")
+	conf, err := Reload(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.AllowedUserIDs) != 2 || len(conf.AdminUserIDs) != 1 || len(conf.AuthTokens) != 1 {
+		t.Fatalf("loaded %+v", conf)
+	}
+	if v := os.Getenv("ALLOWED_USER_IDS"); v != "" {
+		t.Fatalf("reload leaked ALLOWED_USER_IDS=%q into the environment", v)
+	}
+
+	write("ALLOWED_USER_IDS=1\n")
+	conf, err = Reload(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.AllowedUserIDs) != 1 || len(conf.AdminUserIDs) != 0 || len(conf.AuthTokens) != 0 {
+		t.Fatalf("after removal: allowed=%v admins=%v tokens=%v", conf.AllowedUserIDs, conf.AdminUserIDs, conf.AuthTokens)
+	}
+
+	if _, err := Reload(filepath.Join(t.TempDir(), "missing.env")); err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+// Package health serves a JSON health report and the expvar counters over HTTP.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds each component check, so a hung database cannot hang the endpoint.
+const checkTimeout = 2 * time.Second
+
+// Check reports a component's state. A non-nil error marks the service degraded;
+// state is shown either way (e.g. "ok", "reconnecting").
+type Check func(ctx context.Context) (state string, err error)
+
+type component struct {
+	name  string
+	check Check
+}
+
+// Handler answers with 200 when every check passes and 503 otherwise.
+type Handler struct {
+	started    time.Time
+	mu         sync.RWMutex
+	components []component
+}
+
+func New() *Handler { return &Handler{started: time.Now()} }
+
+// Add registers a check; components are reported in the order they were added.
+func (h *Handler) Add(name string, c Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.components = append(h.components, component{name: name, check: c})
+}
+
+type ComponentStatus struct {
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status     string                     `json:"status"` // ok or degraded
+	Uptime     string                     `json:"uptime"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+func (r Report) OK() bool { return r.Status == "ok" }
+
+// Report runs all checks.
+func (h *Handler) Report(ctx context.Context) Report {
+	h.mu.RLock()
+	components := append([]component(nil), h.components...)
+	h.mu.RUnlock()
+	rep := Report{Status: "ok", Uptime: time.Since(h.started).Round(time.Second).String(), Components: make(map[string]ComponentStatus, len(components))}
+	for _, c := range components {
+		cctx, cancel := context.WithTimeout(ctx, checkTimeout)
+		state, err := c.check(cctx)
+		cancel()
+		st := ComponentStatus{State: state}
+		if err != nil {
+			st.Error = err.Error()
+			rep.Status = "degraded"
+		}
+		rep.Components[c.name] = st
+	}
+	return rep
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rep := h.Report(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if !rep.OK() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+// Serve exposes /health and /debug/vars on addr until ctx is done.
+func Serve(ctx context.Context, log *slog.Logger, addr string, h *Handler) error {
+	mux := http.NewServeMux()
+	mux.Handle("/health", h)
+	mux.Handle("/debug/vars", expvar.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	log.Info("health endpoint listening", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Package leader elects one replica, through a lock in the shared database, to
+// poll Telegram and run background jobs.
+package leader
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"ProxyaService/internal/metrics"
+	"ProxyaService/internal/storage"
+)
+
+// lockName is the lock held by the leader.
+const lockName = "leader"
+
+// Elector campaigns for leadership and runs the leader's work while it holds it.
+type Elector struct {
+	log      *slog.Logger
+	locker   storage.Locker
+	interval time.Duration // how often followers campaign and the leader checks its lease
+
+	leader  atomic.Bool
+	lastErr atomic.Pointer[string] // why the last campaign failed, nil if it did not
+}
+
+func New(log *slog.Logger, locker storage.Locker, interval time.Duration) *Elector {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &Elector{log: log, locker: locker, interval: interval}
+}
+
+// Leader reports whether this replica currently leads.
+func (e *Elector) Leader() bool { return e.leader.Load() }
+
+// Run campaigns until ctx is done. While this replica leads, lead runs with a
+// context that is cancelled once leadership is lost; Run waits for lead to
+// return before campaigning again. If lead returns on its own, leadership is
+// given up.
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	for {
+		lease, ok, err := e.locker.TryLease(ctx, lockName)
+		e.setErr(err)
+		switch {
+		case err != nil && ctx.Err() == nil && !errors.Is(err, storage.ErrUnavailable):
+			e.log.Warn("leader election failed", "error", err)
+		case ok:
+			e.lead(ctx, lease, lead)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.interval):
+		}
+	}
+}
+
+func (e *Elector) lead(ctx context.Context, lease storage.Lease, lead func(ctx context.Context)) {
+	defer lease.Release()
+	lctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lead(lctx)
+	}()
+	e.leader.Store(true)
+	metrics.Add("leader_elections", 1)
+	e.log.Info("became leader")
+
+	t := time.NewTicker(e.interval)
+	defer t.Stop()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-done:
+			e.log.Warn("leader work stopped, giving up leadership")
+			break loop
+		case <-t.C:
+			if err := lease.Check(ctx); err != nil && ctx.Err() == nil {
+				e.setErr(err)
+				e.log.Error("leadership lost", "error", err)
+				break loop
+			}
+		}
+	}
+	cancel()
+	<-done
+	e.leader.Store(false)
+}
+
+func (e *Elector) setErr(err error) {
+	if err == nil {
+		e.lastErr.Store(nil)
+		return
+	}
+	msg := err.Error()
+	e.lastErr.Store(&msg)
+}
+
+// Health is a health.Check: "leader" or "follower", and "electing" with an
+// error while the lock cannot be queried.
+func (e *Elector) Health(ctx context.Context) (string, error) {
+	if e.Leader() {
+		return "leader", nil
+	}
+	if msg := e.lastErr.Load(); msg != nil {
+		return "electing", errors.New(*msg)
+	}
+	return "follower", nil
+}
@@ -0,0 +1,129 @@
+// Package maintenance runs periodic cleanup jobs against the store.
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"ProxyaService/internal/metrics"
+	"ProxyaService/internal/storage"
+)
+
+// minRateEventsRetention keeps events the per-minute limiter still counts.
+const minRateEventsRetention = time.Hour
+
+// Policy configures the jobs. A zero retention disables the job.
+type Policy struct {
+	Interval           time.Duration
+	BatchSize          int
+	RateEventRetention time.Duration
+	TokenRetention     time.Duration
+	UpdateRetention    time.Duration
+}
+
+type job struct {
+	name  string
+	purge func(ctx context.Context, before time.Time, limit int) (int64, error)
+	keep  func(Policy) time.Duration
+}
+
+// Scheduler runs the jobs every Policy.Interval. Each job holds a storage lock
+// while running, so with several replicas only one of them does the work.
+type Scheduler struct {
+	log    *slog.Logger
+	store  storage.Store
+	policy func() Policy
+	jobs   []job
+}
+
+// New creates a scheduler; policy is read on every run, so reloaded settings apply.
+func New(log *slog.Logger, store storage.Store, policy func() Policy) *Scheduler {
+	return &Scheduler{
+		log:    log,
+		store:  store,
+		policy: policy,
+		jobs: []job{
+			{name: "rate_events", purge: store.PurgeRateEvents, keep: func(p Policy) time.Duration {
+				if p.RateEventRetention > 0 && p.RateEventRetention < minRateEventsRetention {
+					return minRateEventsRetention
+				}
+				return p.RateEventRetention
+			}},
+			{name: "tokens", purge: store.PurgeTokens, keep: func(p Policy) time.Duration { return p.TokenRetention }},
+			// a bucket idle this long is full again, so dropping it changes nothing
+			{name: "rate_buckets", purge: store.PurgeRateBuckets, keep: func(Policy) time.Duration { return time.Hour }},
+			{name: "processed_updates", purge: store.PurgeProcessedUpdates, keep: func(p Policy) time.Duration { return p.UpdateRetention }},
+		},
+	}
+}
+
+// Run blocks until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		interval := s.policy().Interval
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		s.RunOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// RunOnce runs every enabled job once.
+func (s *Scheduler) RunOnce(ctx context.Context) {
+	p := s.policy()
+	if p.BatchSize <= 0 {
+		p.BatchSize = 1000
+	}
+	for _, j := range s.jobs {
+		keep := j.keep(p)
+		if keep <= 0 {
+			continue
+		}
+		s.run(ctx, j, time.Now().Add(-keep), p.BatchSize)
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, j job, before time.Time, batch int) {
+	release, ok, err := s.store.TryLock(ctx, "maintenance."+j.name)
+	if errors.Is(err, storage.ErrUnavailable) {
+		s.log.Debug("maintenance skipped, storage unavailable", "job", j.name)
+		return
+	}
+	if err != nil {
+		s.log.Error("maintenance lock failed", "job", j.name, "error", err)
+		metrics.Add("maintenance_errors", 1)
+		return
+	}
+	if !ok {
+		s.log.Debug("maintenance job running elsewhere", "job", j.name)
+		return
+	}
+	defer release()
+
+	var total int64
+	for ctx.Err() == nil {
+		n, err := j.purge(ctx, before, batch)
+		total += n
+		if err != nil {
+			s.log.Error("maintenance purge failed", "job", j.name, "error", err)
+			metrics.Add("maintenance_errors", 1)
+			break
+		}
+		// short batches keep locks and transactions small; stop once the backlog is gone
+		if n < int64(batch) {
+			break
+		}
+	}
+	metrics.Add("maintenance_runs", 1)
+	metrics.Add("purged_"+j.name, total)
+	if total > 0 {
+		s.log.Info("maintenance purged rows", "job", j.name, "rows", total, "before", before)
+	}
+}
@@ -0,0 +1,38 @@
+// Package metrics keeps process counters. They are published through expvar
+// under "proxya", so any HTTP server mounting expvar.Handler exposes them.
+package metrics
+
+import (
+	"expvar"
+	"sort"
+)
+
+var counters = expvar.NewMap("proxya")
+
+// Add increments the named counter.
+func Add(name string, delta int64) { counters.Add(name, delta) }
+
+// Value returns the current value of the named counter.
+func Value(name string) int64 {
+	if v, ok := counters.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// Snapshot returns all counters sorted by name.
+func Snapshot() []Counter {
+	var res []Counter
+	counters.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			res = append(res, Counter{Name: kv.Key, Value: v.Value()})
+		}
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+type Counter struct {
+	Name  string
+	Value int64
+}
@@ -2,48 +2,110 @@ package ratelimit
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"ProxyaService/internal/roles"
 	"ProxyaService/internal/storage"
 )
 
+// Backends (RATE_LIMIT_BACKEND).
+const (
+	BackendMemory = "memory" // GCRA state in process memory
+	BackendStore  = "store"  // GCRA state in the database, shared by replicas
+	BackendWindow = "window" // count of rate_events over the last minute
+)
+
+// bucketLimit bounds the in-memory buckets; past it idle ones are dropped.
+const bucketLimit = 10000
+
+// Result is the outcome of Allow. A denied request carries how long to wait
+// before the next one is admitted (0 when unknown).
+type Result struct {
+	Allowed    bool
+	RetryAfter time.Duration
+}
+
+type bucketKey struct {
+	user int64
+	kind string
+}
+
+// Limiter admits requests by the per-minute limit of the user's role. With the
+// GCRA backends a user may make up to burst requests at once, after which
+// requests are admitted one per minute/limit; Allow never waits.
 type Limiter struct {
-	store    *storage.Store
-	free     int
-	prem     int
-	admin    int
-	throttle time.Duration
-}
-
-func New(store *storage.Store, free, prem, admin, throttleSec int) *Limiter {
-	return &Limiter{store: store, free: free, prem: prem, admin: admin, throttle: time.Duration(throttleSec) * time.Second}
-}
-
-// Allow checks per-minute limits by role and adds an event if allowed.
-func (l *Limiter) Allow(ctx context.Context, user storage.User, kind string) (bool, error) {
-	var limit int
-	switch user.Role {
-	case storage.RoleAdmin:
-		limit = l.admin
-	case storage.RolePremium:
-		limit = l.prem
-	default:
-		limit = l.free
+	store   storage.Store
+	roles   *roles.Registry
+	backend string
+	burst   atomic.Int64
+
+	mu      sync.Mutex
+	buckets map[bucketKey]time.Time // theoretical arrival time, memory backend only
+}
+
+func New(store storage.Store, roles *roles.Registry, backend string, burst int) *Limiter {
+	l := &Limiter{store: store, roles: roles, backend: backend, buckets: make(map[bucketKey]time.Time)}
+	l.SetBurst(burst)
+	return l
+}
+
+// SetBurst changes how many requests may be made at once; safe to call while
+// requests are in flight.
+func (l *Limiter) SetBurst(burst int) {
+	l.burst.Store(int64(max(burst, 1)))
+}
+
+// Allow checks the role's limit and records the request if it is admitted.
+// A role without a rate limit (0) is never limited.
+func (l *Limiter) Allow(ctx context.Context, user storage.User, kind string) (Result, error) {
+	limit := l.roles.Get(user.Role).RatePerMin
+	if l.backend == BackendWindow {
+		return l.allowWindow(ctx, user.ID, kind, limit)
 	}
-	// Throttle: simple delay to avoid bursts
-	if l.throttle > 0 {
-		time.Sleep(l.throttle)
+	if limit <= 0 {
+		return Result{Allowed: true}, nil
 	}
-	since := time.Now().Add(-1 * time.Minute)
-	cnt, err := l.store.CountEventsSince(ctx, user.ID, since)
-	if err != nil {
-		return false, err
+	interval := time.Minute / time.Duration(limit)
+	burst := int(l.burst.Load())
+	if l.backend == BackendStore {
+		ok, retry, err := l.store.TakeRateToken(ctx, user.ID, kind, interval, burst)
+		return Result{Allowed: ok, RetryAfter: retry}, err
 	}
-	if cnt >= limit {
-		return false, nil
+	return l.allowMemory(bucketKey{user.ID, kind}, interval, burst, time.Now()), nil
+}
+
+// allowMemory applies GCRA: the bucket holds the theoretical arrival time of the
+// next request, which may run ahead of now by up to burst-1 intervals.
+func (l *Limiter) allowMemory(k bucketKey, interval time.Duration, burst int, now time.Time) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tat := l.buckets[k]
+	if tat.Before(now) {
+		tat = now
 	}
-	if err := l.store.InsertRateEvent(ctx, user.ID, kind); err != nil {
-		return false, err
+	if wait := tat.Sub(now) - interval*time.Duration(burst-1); wait > 0 {
+		return Result{RetryAfter: wait}
+	}
+	if len(l.buckets) >= bucketLimit {
+		for key, t := range l.buckets {
+			if t.Before(now) {
+				delete(l.buckets, key)
+			}
+		}
+	}
+	l.buckets[k] = tat.Add(interval)
+	return Result{Allowed: true}
+}
+
+// allowWindow records a rate_events row if the user made fewer than limit
+// requests over the last minute. The check and the insert are one atomic store
+// call, so concurrent requests cannot overshoot the limit.
+func (l *Limiter) allowWindow(ctx context.Context, userID int64, kind string, limit int) (Result, error) {
+	ok, err := l.store.RecordRateEvent(ctx, userID, kind, time.Now().Add(-1*time.Minute), limit)
+	if err != nil {
+		return Result{}, err
 	}
-	return true, nil
+	return Result{Allowed: ok}, nil
 }
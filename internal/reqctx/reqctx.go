@@ -0,0 +1,41 @@
+// Package reqctx carries the identifiers of the Telegram update being handled.
+package reqctx
+
+import "context"
+
+type key int
+
+const (
+	updateKey key = iota
+	userKey
+)
+
+// With returns ctx annotated with the update and sender IDs.
+func With(ctx context.Context, updateID int, userID int64) context.Context {
+	ctx = context.WithValue(ctx, updateKey, updateID)
+	return context.WithValue(ctx, userKey, userID)
+}
+
+// UpdateID returns the Telegram update ID, if ctx belongs to an update.
+func UpdateID(ctx context.Context) (int, bool) {
+	v, ok := ctx.Value(updateKey).(int)
+	return v, ok
+}
+
+// UserID returns the sender of the update, if known.
+func UserID(ctx context.Context) (int64, bool) {
+	v, ok := ctx.Value(userKey).(int64)
+	return v, ok && v != 0
+}
+
+// LogAttrs returns slog key/value pairs for the identifiers present in ctx.
+func LogAttrs(ctx context.Context) []any {
+	var attrs []any
+	if id, ok := UpdateID(ctx); ok {
+		attrs = append(attrs, "update", id)
+	}
+	if id, ok := UserID(ctx); ok {
+		attrs = append(attrs, "sender", id)
+	}
+	return attrs
+}
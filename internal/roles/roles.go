@@ -0,0 +1,222 @@
+package roles
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+
+	"ProxyaService/internal/storage"
+)
+
+var (
+	ErrUnknownRole = errors.New("unknown role")
+	ErrBuiltinRole = errors.New("builtin role cannot be deleted")
+	ErrNoStore     = errors.New("storage is not configured")
+)
+
+// Registry keeps role definitions in memory and persists changes to the roles table.
+// Without a store it serves the builtin defaults only.
+type Registry struct {
+	mu       sync.RWMutex
+	roles    map[storage.Role]storage.RoleDef
+	fallback storage.Role
+	store    storage.Store
+}
+
+// New creates a registry from builtin defaults. Users with an unknown role are treated as fallback.
+func New(defaults []storage.RoleDef, fallback storage.Role) *Registry {
+	r := &Registry{roles: make(map[storage.Role]storage.RoleDef, len(defaults)), fallback: fallback}
+	for _, d := range defaults {
+		d.Builtin = true
+		r.roles[d.Name] = d
+	}
+	return r
+}
+
+// AttachStore seeds builtin roles into the DB, moves users with undefined roles to
+// the fallback role and loads all definitions.
+func (r *Registry) AttachStore(ctx context.Context, store storage.Store) error {
+	r.mu.RLock()
+	defaults := make([]storage.RoleDef, 0, len(r.roles))
+	for _, d := range r.roles {
+		defaults = append(defaults, d)
+	}
+	r.mu.RUnlock()
+	for _, d := range defaults {
+		if err := store.SeedRole(ctx, d); err != nil {
+			return err
+		}
+	}
+	if _, err := store.ReassignUnknownRoles(ctx, r.Fallback()); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.store = store
+	r.mu.Unlock()
+	return r.Reload(ctx)
+}
+
+// SetDefaults replaces builtin defaults and the fallback role. With a store,
+// missing roles are seeded and existing builtin ones get the new rate limits,
+// other operator edits are kept; without one, the definitions are replaced in
+// memory. On error the registry is left as it was.
+func (r *Registry) SetDefaults(ctx context.Context, defaults []storage.RoleDef, fallback storage.Role) error {
+	r.mu.RLock()
+	store := r.store
+	r.mu.RUnlock()
+	var loaded map[storage.Role]storage.RoleDef
+	if store != nil {
+		for _, d := range defaults {
+			d.Builtin = true
+			if err := store.SeedRole(ctx, d); err != nil {
+				return err
+			}
+		}
+		var err error
+		if loaded, err = load(ctx, store); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = fallback
+	if loaded != nil {
+		r.roles = loaded
+		return nil
+	}
+	for _, d := range defaults {
+		d.Builtin = true
+		r.roles[d.Name] = d
+	}
+	return nil
+}
+
+// Reload re-reads role definitions from the DB.
+func (r *Registry) Reload(ctx context.Context) error {
+	r.mu.RLock()
+	store := r.store
+	r.mu.RUnlock()
+	if store == nil {
+		return nil
+	}
+	m, err := load(ctx, store)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.roles = m
+	r.mu.Unlock()
+	return nil
+}
+
+func load(ctx context.Context, store storage.Store) (map[storage.Role]storage.RoleDef, error) {
+	list, err := store.ListRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[storage.Role]storage.RoleDef, len(list))
+	for _, d := range list {
+		m[d.Name] = d
+	}
+	return m, nil
+}
+
+// Get returns the role definition; unknown roles resolve to the fallback role.
+func (r *Registry) Get(name storage.Role) storage.RoleDef {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if d, ok := r.roles[name]; ok {
+		return d
+	}
+	return r.roles[r.fallback]
+}
+
+// Exists reports whether the role is defined.
+func (r *Registry) Exists(name storage.Role) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.roles[name]
+	return ok
+}
+
+// List returns all roles sorted by name.
+func (r *Registry) List() []storage.RoleDef {
+	r.mu.RLock()
+	res := make([]storage.RoleDef, 0, len(r.roles))
+	for _, d := range r.roles {
+		res = append(res, d)
+	}
+	r.mu.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Fallback returns the role used for users without a valid role.
+func (r *Registry) Fallback() storage.Role {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.fallback
+}
+
+// Allows reports whether the role grants the permission. "*" grants everything.
+func (r *Registry) Allows(name storage.Role, perm string) bool {
+	perms := r.Get(name).Permissions
+	return slices.Contains(perms, perm) || slices.Contains(perms, "*")
+}
+
+// Covers reports whether every permission of target is granted to issuer, i.e.
+// issuer may hand target out without escalating anyone's privileges.
+func (r *Registry) Covers(issuer, target storage.Role) bool {
+	for _, p := range r.Get(target).Permissions {
+		if !r.Allows(issuer, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsPool reports whether users of the role may use the proxy pool.
+func (r *Registry) AllowsPool(name storage.Role, pool string) bool {
+	d := r.Get(name)
+	return len(d.ProxyPools) == 0 || slices.Contains(d.ProxyPools, pool)
+}
+
+// Save creates or updates a role.
+func (r *Registry) Save(ctx context.Context, d storage.RoleDef) error {
+	r.mu.RLock()
+	store := r.store
+	if cur, ok := r.roles[d.Name]; ok {
+		d.Builtin = cur.Builtin
+	}
+	r.mu.RUnlock()
+	if store == nil {
+		return ErrNoStore
+	}
+	if err := store.UpsertRole(ctx, d); err != nil {
+		return err
+	}
+	return r.Reload(ctx)
+}
+
+// Delete removes a custom role, moving its users to the fallback role.
+func (r *Registry) Delete(ctx context.Context, name storage.Role, actor int64) error {
+	r.mu.RLock()
+	store := r.store
+	d, ok := r.roles[name]
+	r.mu.RUnlock()
+	if store == nil {
+		return ErrNoStore
+	}
+	if !ok {
+		return ErrUnknownRole
+	}
+	if d.Builtin || name == r.Fallback() {
+		return ErrBuiltinRole
+	}
+	if err := store.DeleteRole(ctx, name, r.Fallback(), actor); err != nil {
+		return err
+	}
+	return r.Reload(ctx)
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"ProxyaService/internal/metrics"
+)
+
+// userCacheLimit bounds the number of cached users; past it expired entries are
+// swept and, if that is not enough, the cache starts over.
+const userCacheLimit = 10000
+
+// UserNotifier broadcasts user changes between replicas sharing a database.
+type UserNotifier interface {
+	// NotifyUserChanged tells every listener that the user changed; id 0 means all users.
+	NotifyUserChanged(ctx context.Context, id int64) error
+	// ListenUserChanges calls fn for each notification until ctx is done or the
+	// connection fails. ready is called once listening has started.
+	ListenUserChanges(ctx context.Context, ready func(), fn func(id int64)) error
+}
+
+type cachedUser struct {
+	user    User
+	found   bool
+	expires time.Time
+}
+
+// UserCache is a Store that serves GetUser from memory for up to ttl. Every
+// write that can change a user drops the cached entry, here and, through
+// UserNotifier, on other replicas.
+type UserCache struct {
+	Store
+	ttl time.Duration
+
+	mu    sync.Mutex
+	users map[int64]cachedUser
+	gen   uint64 // bumped by every invalidation, so a slow read cannot cache stale data
+}
+
+// NewUserCache wraps st; a ttl of 0 or less disables caching.
+func NewUserCache(st Store, ttl time.Duration) *UserCache {
+	return &UserCache{Store: st, ttl: ttl, users: make(map[int64]cachedUser)}
+}
+
+func (c *UserCache) GetUser(ctx context.Context, id int64) (User, error) {
+	if c.ttl <= 0 {
+		return c.Store.GetUser(ctx, id)
+	}
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.users[id]
+	gen := c.gen
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		metrics.Add("user_cache_hits", 1)
+		if !e.found {
+			return User{}, ErrNotFound
+		}
+		return e.user, nil
+	}
+	metrics.Add("user_cache_misses", 1)
+	u, err := c.Store.GetUser(ctx, id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return u, err
+	}
+	c.mu.Lock()
+	if c.gen == gen {
+		if len(c.users) >= userCacheLimit {
+			c.sweep(now)
+		}
+		c.users[id] = cachedUser{user: u, found: err == nil, expires: now.Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	return u, err
+}
+
+func (c *UserCache) sweep(now time.Time) {
+	for id, e := range c.users {
+		if !now.Before(e.expires) {
+			delete(c.users, id)
+		}
+	}
+	if len(c.users) >= userCacheLimit {
+		c.users = make(map[int64]cachedUser)
+	}
+}
+
+// Invalidate drops the cached user locally; id 0 drops everyone.
+func (c *UserCache) Invalidate(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if id == 0 {
+		c.users = make(map[int64]cachedUser)
+	} else {
+		delete(c.users, id)
+	}
+	metrics.Add("user_cache_invalidations", 1)
+}
+
+// changed invalidates locally and notifies other replicas after a successful write.
+func (c *UserCache) changed(ctx context.Context, id int64, err error) error {
+	if err != nil {
+		return err
+	}
+	c.Invalidate(id)
+	if n, ok := c.Store.(UserNotifier); ok {
+		_ = n.NotifyUserChanged(ctx, id)
+	}
+	return nil
+}
+
+// Listen applies invalidations from other replicas until ctx is done or the
+// connection fails. The cache is flushed once listening starts, since changes
+// made while not listening were missed. Without a UserNotifier it returns
+// errors.ErrUnsupported.
+func (c *UserCache) Listen(ctx context.Context) error {
+	n, ok := c.Store.(UserNotifier)
+	if !ok || c.ttl <= 0 {
+		return errors.ErrUnsupported
+	}
+	return n.ListenUserChanges(ctx, func() { c.Invalidate(0) }, c.Invalidate)
+}
+
+func (c *UserCache) UpsertUser(ctx context.Context, user User) error {
+	return c.changed(ctx, user.ID, c.Store.UpsertUser(ctx, user))
+}
+
+func (c *UserCache) SetUserRole(ctx context.Context, id int64, role Role) error {
+	return c.changed(ctx, id, c.Store.SetUserRole(ctx, id, role))
+}
+
+func (c *UserCache) SetUserAuthed(ctx context.Context, id int64, authed bool) error {
+	return c.changed(ctx, id, c.Store.SetUserAuthed(ctx, id, authed))
+}
+
+// DeleteRole moves the role's users to the fallback, so every user is dropped.
+func (c *UserCache) DeleteRole(ctx context.Context, name, fallback Role, actor int64) error {
+	return c.changed(ctx, 0, c.Store.DeleteRole(ctx, name, fallback, actor))
+}
+
+func (c *UserCache) ReassignUnknownRoles(ctx context.Context, fallback Role) (int64, error) {
+	n, err := c.Store.ReassignUnknownRoles(ctx, fallback)
+	if n == 0 {
+		return n, err
+	}
+	return n, c.changed(ctx, 0, err)
+}
+
+func (c *UserCache) ForgetUser(ctx context.Context, id int64, policy AuditPolicy) (ForgetResult, error) {
+	res, err := c.Store.ForgetUser(ctx, id, policy)
+	return res, c.changed(ctx, id, err)
+}
+
+func (c *UserCache) ImportData(ctx context.Context, d Dataset, replace bool) error {
+	return c.changed(ctx, 0, c.Store.ImportData(ctx, d, replace))
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// notifyingMemory records the notifications a UserCache sends.
+type notifyingMemory struct {
+	*Memory
+	notified []int64
+}
+
+func (m *notifyingMemory) NotifyUserChanged(_ context.Context, id int64) error {
+	m.notified = append(m.notified, id)
+	return nil
+}
+
+func (m *notifyingMemory) ListenUserChanges(ctx context.Context, ready func(), _ func(id int64)) error {
+	ready()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// TestUserCacheBehindSecretBox checks that wrapping the backend in a SecretBox,
+// as the bot does, keeps cross-replica invalidation working.
+func TestUserCacheBehindSecretBox(t *testing.T) {
+	keys, err := ParseKeyring("1:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	must(t, err)
+	ctx := context.Background()
+
+	backend := &notifyingMemory{Memory: NewMemory()}
+	cache := NewUserCache(NewSecretBox(backend, keys), time.Minute)
+	must(t, cache.UpsertUser(ctx, User{ID: 1, Role: RoleFree}))
+	must(t, cache.SetUserRole(ctx, 1, RolePremium))
+	if !slices.Equal(backend.notified, []int64{1, 1}) {
+		t.Fatalf("notified = %v", backend.notified)
+	}
+	lctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := cache.Listen(lctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("listen = %v", err)
+	}
+
+	plain := NewUserCache(NewSecretBox(NewMemory(), keys), time.Minute)
+	if err := plain.Listen(ctx); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("listen without a notifier = %v", err)
+	}
+}
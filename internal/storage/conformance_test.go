@@ -0,0 +1,807 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// pgDSNEnv names the variable with a Postgres DSN to run the suite against. Each
+// test gets its own schema, dropped afterwards; without it Postgres is skipped.
+const pgDSNEnv = "STORAGE_TEST_PG_DSN"
+
+type backend struct {
+	name string
+	open func(t *testing.T) Store
+}
+
+var backends = []backend{
+	{"memory", func(t *testing.T) Store { return NewMemory() }},
+	{"sqlite", openSQLiteTest},
+	{"postgres", openPostgresTest},
+}
+
+func openSQLiteTest(t *testing.T) Store {
+	t.Helper()
+	ctx := context.Background()
+	st, err := NewSQLite(ctx, t.TempDir()+"/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(st.Close)
+	if err := st.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func openPostgresTest(t *testing.T) Store {
+	t.Helper()
+	dsn := os.Getenv(pgDSNEnv)
+	if dsn == "" {
+		t.Skip(pgDSNEnv + " is not set")
+	}
+	ctx := context.Background()
+	admin, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("conformance_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(ctx, `CREATE SCHEMA `+schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, _ = admin.Exec(context.Background(), `DROP SCHEMA `+schema+` CASCADE`)
+		admin.Close()
+	})
+	st, err := NewPostgres(ctx, withSearchPath(dsn, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(st.Close)
+	if err := st.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// withSearchPath adds a search_path runtime parameter to a URL or key=value DSN.
+func withSearchPath(dsn, schema string) string {
+	if !strings.Contains(dsn, "://") {
+		return dsn + " search_path=" + schema
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&search_path=" + schema
+	}
+	return dsn + "?search_path=" + schema
+}
+
+// TestConformance runs every case against a fresh store of each backend, so the
+// backends cannot drift apart.
+func TestConformance(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			for _, c := range conformance {
+				t.Run(c.name, func(t *testing.T) {
+					c.run(t, context.Background(), b.open(t))
+				})
+			}
+		})
+	}
+}
+
+var conformance = []struct {
+	name string
+	run  func(t *testing.T, ctx context.Context, st Store)
+}{
+	{"users", testUsers},
+	{"roles", testRoles},
+	{"tokens", testTokens},
+	{"profiles", testProfiles},
+	{"rate_events", testRateEvents},
+	{"rate_buckets", testRateBuckets},
+	{"access_requests", testAccessRequests},
+	{"bans", testBans},
+	{"totp", testTOTP},
+	{"audit", testAudit},
+	{"settings", testSettings},
+	{"privacy", testPrivacy},
+	{"backup", testBackup},
+	{"updates", testUpdates},
+	{"retention", testRetention},
+	{"locks", testLocks},
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func wantErr(t *testing.T, err, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Fatalf("got error %v, want %v", err, want)
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func testUsers(t *testing.T, ctx context.Context, st Store) {
+	_, err := st.GetUser(ctx, 1)
+	wantErr(t, err, ErrNotFound)
+	wantErr(t, st.SetUserRole(ctx, 1, RolePremium), ErrNotFound)
+
+	must(t, st.UpsertUser(ctx, User{ID: 1, Role: RoleFree, IsAuthed: true}))
+	must(t, st.UpsertUser(ctx, User{ID: 2, Role: RoleFree}))
+	must(t, st.UpsertUser(ctx, User{ID: 3, Role: RoleAdmin, IsAuthed: true}))
+	u, err := st.GetUser(ctx, 1)
+	must(t, err)
+	if u.Role != RoleFree || !u.IsAuthed || u.CreatedAt.IsZero() {
+		t.Fatalf("user = %+v", u)
+	}
+
+	must(t, st.SetUserRole(ctx, 2, RolePremium))
+	must(t, st.SetUserAuthed(ctx, 1, false))
+	must(t, st.SetUserAuthed(ctx, 99, true)) // a missing user is not an error
+	if u, _ := st.GetUser(ctx, 2); u.Role != RolePremium {
+		t.Fatalf("role after SetUserRole = %q", u.Role)
+	}
+
+	free, err := st.ListUsersByRole(ctx, RoleFree)
+	must(t, err)
+	if len(free) != 1 || free[0].ID != 1 {
+		t.Fatalf("free users = %+v", free)
+	}
+	authed, err := st.ListAuthedUserIDs(ctx)
+	must(t, err)
+	if !slices.Equal(authed, []int64{3}) {
+		t.Fatalf("authed = %v", authed)
+	}
+}
+
+func testRoles(t *testing.T, ctx context.Context, st Store) {
+	_, err := st.GetRole(ctx, "missing")
+	wantErr(t, err, ErrNotFound)
+
+	must(t, st.SeedRole(ctx, RoleDef{Name: RoleFree, DisplayName: "Free", RatePerMin: 10, Permissions: []string{"proxy"}, Builtin: true}))
+	must(t, st.UpsertRole(ctx, RoleDef{Name: "vip", DisplayName: "VIP", RatePerMin: 5, TrafficQuotaMB: 100, MaxConnections: 3, ProxyPools: []string{"eu", "us"}, Permissions: []string{"proxy"}}))
+
+	// seeding again refreshes the rate of a builtin role only
+	must(t, st.UpsertRole(ctx, RoleDef{Name: RoleFree, DisplayName: "Edited", RatePerMin: 10, Permissions: []string{"proxy"}}))
+	must(t, st.SeedRole(ctx, RoleDef{Name: RoleFree, DisplayName: "Free", RatePerMin: 20, Builtin: true}))
+	must(t, st.SeedRole(ctx, RoleDef{Name: "vip", RatePerMin: 50, Builtin: true}))
+	free, err := st.GetRole(ctx, RoleFree)
+	must(t, err)
+	if !free.Builtin || free.RatePerMin != 20 || free.DisplayName != "Edited" || !slices.Equal(free.Permissions, []string{"proxy"}) {
+		t.Fatalf("free = %+v", free)
+	}
+	vip, err := st.GetRole(ctx, "vip")
+	must(t, err)
+	if vip.Builtin || vip.RatePerMin != 5 || vip.TrafficQuotaMB != 100 || vip.MaxConnections != 3 || !slices.Equal(vip.ProxyPools, []string{"eu", "us"}) {
+		t.Fatalf("vip = %+v", vip)
+	}
+
+	list, err := st.ListRoles(ctx)
+	must(t, err)
+	if len(list) != 2 || list[0].Name != RoleFree || list[1].Name != "vip" {
+		t.Fatalf("roles = %+v", list)
+	}
+
+	must(t, st.UpsertUser(ctx, User{ID: 1, Role: "vip"}))
+	must(t, st.UpsertUser(ctx, User{ID: 2, Role: "ghost"}))
+	wantErr(t, st.DeleteRole(ctx, RoleFree, RoleFree, 9), ErrNotFound) // builtin
+	must(t, st.DeleteRole(ctx, "vip", RoleFree, 9))
+	if u, _ := st.GetUser(ctx, 1); u.Role != RoleFree {
+		t.Fatalf("user of deleted role has %q", u.Role)
+	}
+	events, err := st.ListAuditEvents(ctx, AuditFilter{Action: "role.delete", Limit: 10})
+	must(t, err)
+	if len(events) != 1 || events[0].Actor == nil || *events[0].Actor != 9 {
+		t.Fatalf("role.delete events = %+v", events)
+	}
+
+	n, err := st.ReassignUnknownRoles(ctx, RoleFree)
+	must(t, err)
+	if u, _ := st.GetUser(ctx, 2); n != 1 || u.Role != RoleFree {
+		t.Fatalf("reassigned %d, user role %q", n, u.Role)
+	}
+}
+
+func testTokens(t *testing.T, ctx context.Context, st Store) {
+	must(t, st.CreateToken(ctx, "t1", RolePremium, nil, 1, nil))
+	wantErr(t, st.CreateToken(ctx, "t1", RoleFree, nil, 1, nil), ErrConflict)
+	must(t, st.CreateToken(ctx, "expired", RoleFree, ptr(time.Now().Add(-time.Minute)), 1, nil))
+	must(t, st.CreateToken(ctx, "t2", RoleFree, ptr(time.Now().Add(time.Hour)), 1, nil))
+	must(t, st.CreateToken(ctx, "other", RoleFree, nil, 2, nil))
+
+	role, err := st.ConsumeToken(ctx, "t1", 10)
+	must(t, err)
+	if role != RolePremium {
+		t.Fatalf("consumed role = %q", role)
+	}
+	_, err = st.ConsumeToken(ctx, "t1", 11)
+	wantErr(t, err, ErrNotFound)
+	_, err = st.ConsumeToken(ctx, "expired", 11)
+	wantErr(t, err, ErrNotFound)
+	_, err = st.ConsumeToken(ctx, "missing", 11)
+	wantErr(t, err, ErrNotFound)
+	events, err := st.ListAuditEvents(ctx, AuditFilter{Action: "token.consume", Limit: 10})
+	must(t, err)
+	if len(events) != 1 || events[0].Target == nil || *events[0].Target != 10 {
+		t.Fatalf("token.consume events = %+v", events)
+	}
+
+	// only t2 is still usable among the tokens issued by 1
+	n, err := st.RevokeTokensIssuedBy(ctx, 1)
+	must(t, err)
+	if n != 1 {
+		t.Fatalf("revoked %d tokens, want 1", n)
+	}
+	_, err = st.ConsumeToken(ctx, "t2", 11)
+	wantErr(t, err, ErrNotFound)
+	_, err = st.ConsumeToken(ctx, "other", 11)
+	must(t, err)
+}
+
+func testProfiles(t *testing.T, ctx context.Context, st Store) {
+	_, err := st.GetProfile(ctx, 1)
+	wantErr(t, err, ErrNotFound)
+
+	changes, err := st.TouchProfile(ctx, Profile{TelegramID: 1, Username: "Alice", FirstName: "A"})
+	must(t, err)
+	if len(changes) != 0 {
+		t.Fatalf("first sighting changes = %+v", changes)
+	}
+	changes, err = st.TouchProfile(ctx, Profile{TelegramID: 1, Username: "alice2", FirstName: "A", IsPremium: true})
+	must(t, err)
+	fields := make([]string, 0, len(changes))
+	for _, c := range changes {
+		fields = append(fields, c.Field)
+	}
+	slices.Sort(fields)
+	if !slices.Equal(fields, []string{"is_premium", "username"}) {
+		t.Fatalf("changed fields = %v", fields)
+	}
+	_, err = st.TouchProfile(ctx, Profile{TelegramID: 1, Username: "alice3", FirstName: "A", IsPremium: true})
+	must(t, err)
+
+	p, err := st.GetProfile(ctx, 1)
+	must(t, err)
+	if p.Username != "alice3" || !p.IsPremium || p.LastSeenAt.IsZero() {
+		t.Fatalf("profile = %+v", p)
+	}
+
+	hist, err := st.ListProfileChanges(ctx, 1, 2)
+	must(t, err)
+	if len(hist) != 2 || hist[0].Field != "username" || hist[0].NewValue != "alice3" {
+		t.Fatalf("history = %+v", hist)
+	}
+
+	_, err = st.TouchProfile(ctx, Profile{TelegramID: 2, Username: "Bob"})
+	must(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = st.TouchProfile(ctx, Profile{TelegramID: 3, Username: "bob"})
+	must(t, err)
+	found, err := st.FindProfileByUsername(ctx, "@BOB")
+	must(t, err)
+	if found.TelegramID != 3 {
+		t.Fatalf("found %d, want the most recently seen", found.TelegramID)
+	}
+	_, err = st.FindProfileByUsername(ctx, "alice")
+	wantErr(t, err, ErrNotFound)
+	_, err = st.FindProfileByUsername(ctx, "")
+	wantErr(t, err, ErrNotFound)
+}
+
+func testRateEvents(t *testing.T, ctx context.Context, st Store) {
+	since := time.Now().Add(-time.Minute)
+	must(t, st.InsertRateEvent(ctx, 1, "proxy"))
+	for i, want := range []bool{true, false, false} {
+		ok, err := st.RecordRateEvent(ctx, 1, "proxy", since, 2)
+		must(t, err)
+		if ok != want {
+			t.Fatalf("record %d = %v, want %v", i, ok, want)
+		}
+	}
+	ok, err := st.RecordRateEvent(ctx, 1, "proxy", since, 0)
+	must(t, err)
+	if !ok {
+		t.Fatal("limit 0 must not limit")
+	}
+	ok, err = st.RecordRateEvent(ctx, 2, "proxy", since, 1)
+	must(t, err)
+	if !ok {
+		t.Fatal("another user is limited separately")
+	}
+	n, err := st.CountEventsSince(ctx, 1, since)
+	must(t, err)
+	if n != 3 {
+		t.Fatalf("count = %d, want 3", n)
+	}
+	n, err = st.CountEventsSince(ctx, 1, time.Now().Add(time.Minute))
+	must(t, err)
+	if n != 0 {
+		t.Fatalf("count after now = %d", n)
+	}
+}
+
+func testRateBuckets(t *testing.T, ctx context.Context, st Store) {
+	for i := range 2 {
+		ok, _, err := st.TakeRateToken(ctx, 1, "proxy", time.Minute, 2)
+		must(t, err)
+		if !ok {
+			t.Fatalf("request %d within burst denied", i)
+		}
+	}
+	ok, retry, err := st.TakeRateToken(ctx, 1, "proxy", time.Minute, 2)
+	must(t, err)
+	if ok || retry <= 0 || retry > time.Minute {
+		t.Fatalf("over burst: ok=%v retry=%v", ok, retry)
+	}
+	ok, _, err = st.TakeRateToken(ctx, 1, "other", time.Minute, 1)
+	must(t, err)
+	if !ok {
+		t.Fatal("another kind has its own bucket")
+	}
+	ok, _, err = st.TakeRateToken(ctx, 2, "proxy", time.Minute, 1)
+	must(t, err)
+	if !ok {
+		t.Fatal("another user has its own bucket")
+	}
+}
+
+func testAccessRequests(t *testing.T, ctx context.Context, st Store) {
+	_, err := st.LastAccessDecision(ctx, 1)
+	wantErr(t, err, ErrNotFound)
+
+	r, created, err := st.CreateAccessRequest(ctx, AccessRequest{TelegramID: 1, Username: "u", Message: "hi"})
+	must(t, err)
+	if !created || r.ID == 0 || r.Status != AccessPending || r.CreatedAt.IsZero() {
+		t.Fatalf("created=%v request=%+v", created, r)
+	}
+	again, created, err := st.CreateAccessRequest(ctx, AccessRequest{TelegramID: 1, Username: "u2"})
+	must(t, err)
+	if created || again.ID != r.ID || again.Username != "u2" || again.Message != "hi" {
+		t.Fatalf("repeat: created=%v request=%+v", created, again)
+	}
+	_, _, err = st.CreateAccessRequest(ctx, AccessRequest{TelegramID: 2})
+	must(t, err)
+
+	pending, err := st.ListPendingAccessRequests(ctx)
+	must(t, err)
+	if len(pending) != 2 || pending[0].TelegramID != 1 {
+		t.Fatalf("pending = %+v", pending)
+	}
+
+	d, err := st.DecideAccessRequest(ctx, r.ID, AccessDenied, "", 9)
+	must(t, err)
+	if d.Status != AccessDenied || d.DecidedBy == nil || *d.DecidedBy != 9 || d.DecidedAt == nil {
+		t.Fatalf("decided = %+v", d)
+	}
+	_, err = st.DecideAccessRequest(ctx, r.ID, AccessApproved, RoleFree, 9)
+	wantErr(t, err, ErrNotFound)
+	got, err := st.GetAccessRequest(ctx, r.ID)
+	must(t, err)
+	if got.Status != AccessDenied {
+		t.Fatalf("status = %q", got.Status)
+	}
+	_, err = st.GetAccessRequest(ctx, 9999)
+	wantErr(t, err, ErrNotFound)
+
+	last, err := st.LastAccessDecision(ctx, 1)
+	must(t, err)
+	if last.ID != r.ID {
+		t.Fatalf("last decision = %+v", last)
+	}
+	_, err = st.LastAccessDecision(ctx, 2)
+	wantErr(t, err, ErrNotFound)
+
+	// a decided request does not block a new one
+	next, created, err := st.CreateAccessRequest(ctx, AccessRequest{TelegramID: 1})
+	must(t, err)
+	if !created || next.ID == r.ID {
+		t.Fatalf("after decision: created=%v request=%+v", created, next)
+	}
+}
+
+func testBans(t *testing.T, ctx context.Context, st Store) {
+	wantErr(t, st.DeleteBan(ctx, 1), ErrNotFound)
+	must(t, st.UpsertBan(ctx, Ban{TelegramID: 1, Reason: "spam", BannedBy: 9}))
+	must(t, st.UpsertBan(ctx, Ban{TelegramID: 2, BannedBy: 9, ExpiresAt: ptr(time.Now().Add(-time.Minute))}))
+	must(t, st.UpsertBan(ctx, Ban{TelegramID: 3, BannedBy: 9, ExpiresAt: ptr(time.Now().Add(time.Hour))}))
+	must(t, st.UpsertBan(ctx, Ban{TelegramID: 1, Reason: "abuse", BannedBy: 8}))
+
+	bans, err := st.ListActiveBans(ctx)
+	must(t, err)
+	var ids []int64
+	for _, b := range bans {
+		ids = append(ids, b.TelegramID)
+		if b.TelegramID == 1 && (b.Reason != "abuse" || b.BannedBy != 8) {
+			t.Fatalf("ban not updated: %+v", b)
+		}
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []int64{1, 3}) {
+		t.Fatalf("active bans = %v", ids)
+	}
+	must(t, st.DeleteBan(ctx, 1))
+	bans, err = st.ListActiveBans(ctx)
+	must(t, err)
+	if len(bans) != 1 || bans[0].TelegramID != 3 {
+		t.Fatalf("after delete = %+v", bans)
+	}
+}
+
+func testTOTP(t *testing.T, ctx context.Context, st Store) {
+	_, err := st.GetTOTPSecret(ctx, 1)
+	wantErr(t, err, ErrNotFound)
+	wantErr(t, st.DeleteTOTPSecret(ctx, 1), ErrNotFound)
+	ok, err := st.UseTOTPStep(ctx, 1, 5)
+	must(t, err)
+	if ok {
+		t.Fatal("step used without a secret")
+	}
+
+	must(t, st.PutTOTPSecret(ctx, 1, "s1"))
+	sec, err := st.GetTOTPSecret(ctx, 1)
+	must(t, err)
+	if sec.Secret != "s1" || sec.Confirmed {
+		t.Fatalf("new secret = %+v", sec)
+	}
+	for i, want := range []bool{true, false, false, true} {
+		step := []int64{5, 5, 4, 6}[i]
+		ok, err := st.UseTOTPStep(ctx, 1, step)
+		must(t, err)
+		if ok != want {
+			t.Fatalf("step %d: ok=%v want %v", step, ok, want)
+		}
+	}
+	sec, _ = st.GetTOTPSecret(ctx, 1)
+	if !sec.Confirmed || sec.LastUsedStep != 6 {
+		t.Fatalf("after use = %+v", sec)
+	}
+
+	// swapping keeps the enrollment state
+	ok, err = st.SwapTOTPSecret(ctx, 1, "wrong", "s2")
+	must(t, err)
+	if ok {
+		t.Fatal("swap with a stale value succeeded")
+	}
+	ok, err = st.SwapTOTPSecret(ctx, 1, "s1", "s2")
+	must(t, err)
+	sec, _ = st.GetTOTPSecret(ctx, 1)
+	if !ok || sec.Secret != "s2" || !sec.Confirmed || sec.LastUsedStep != 6 {
+		t.Fatalf("swap ok=%v secret=%+v", ok, sec)
+	}
+
+	// re-enrolling starts over
+	must(t, st.PutTOTPSecret(ctx, 1, "s3"))
+	sec, _ = st.GetTOTPSecret(ctx, 1)
+	if sec.Secret != "s3" || sec.Confirmed || sec.LastUsedStep != 0 {
+		t.Fatalf("re-enrolled = %+v", sec)
+	}
+
+	for _, id := range []int64{4, 2, 3} {
+		must(t, st.PutTOTPSecret(ctx, id, "x"))
+	}
+	page, err := st.ListTOTPSecrets(ctx, 1, 2)
+	must(t, err)
+	if len(page) != 2 || page[0].TelegramID != 2 || page[1].TelegramID != 3 {
+		t.Fatalf("page = %+v", page)
+	}
+	page, err = st.ListTOTPSecrets(ctx, 3, 2)
+	must(t, err)
+	if len(page) != 1 || page[0].TelegramID != 4 {
+		t.Fatalf("last page = %+v", page)
+	}
+
+	must(t, st.DeleteTOTPSecret(ctx, 1))
+	_, err = st.GetTOTPSecret(ctx, 1)
+	wantErr(t, err, ErrNotFound)
+}
+
+func testAudit(t *testing.T, ctx context.Context, st Store) {
+	must(t, st.InsertAuditEvent(ctx, AuditEvent{Actor: ptr[int64](1), Target: ptr[int64](2), Action: "a.one", Metadata: map[string]any{"k": "v"}}))
+	must(t, st.InsertAuditEvent(ctx, AuditEvent{Actor: ptr[int64](2), Action: "a.two"}))
+	must(t, st.InsertAuditEvent(ctx, AuditEvent{Action: "a.one"}))
+
+	all, err := st.ListAuditEvents(ctx, AuditFilter{Limit: 10})
+	must(t, err)
+	if len(all) != 3 || all[0].Actor != nil || all[2].Action != "a.one" {
+		t.Fatalf("events, newest first = %+v", all)
+	}
+	if all[2].Metadata["k"] != "v" || all[2].ID == 0 || all[2].CreatedAt.IsZero() {
+		t.Fatalf("event = %+v", all[2])
+	}
+	if all[1].Metadata == nil {
+		t.Fatal("missing metadata must be an empty map")
+	}
+
+	byUser, err := st.ListAuditEvents(ctx, AuditFilter{UserID: ptr[int64](2), Limit: 10})
+	must(t, err)
+	if len(byUser) != 2 {
+		t.Fatalf("events of user 2 (actor or target) = %+v", byUser)
+	}
+	byAction, err := st.ListAuditEvents(ctx, AuditFilter{Action: "a.one", Limit: 10})
+	must(t, err)
+	if len(byAction) != 2 {
+		t.Fatalf("a.one events = %+v", byAction)
+	}
+	page, err := st.ListAuditEvents(ctx, AuditFilter{Limit: 1, Offset: 1})
+	must(t, err)
+	if len(page) != 1 || page[0].Action != "a.two" {
+		t.Fatalf("second page = %+v", page)
+	}
+}
+
+func testSettings(t *testing.T, ctx context.Context, st Store) {
+	_, err := st.GetSetting(ctx, "k")
+	wantErr(t, err, ErrNotFound)
+	must(t, st.PutSetting(ctx, "k", "v1"))
+	must(t, st.PutSetting(ctx, "k", "v2"))
+	v, err := st.GetSetting(ctx, "k")
+	must(t, err)
+	if v != "v2" {
+		t.Fatalf("setting = %q", v)
+	}
+}
+
+// seedUser gives user 1 a row in every table a data export or erasure covers.
+func seedUser(t *testing.T, ctx context.Context, st Store) {
+	t.Helper()
+	must(t, st.UpsertUser(ctx, User{ID: 1, Role: RoleFree, IsAuthed: true}))
+	_, err := st.TouchProfile(ctx, Profile{TelegramID: 1, Username: "one"})
+	must(t, err)
+	_, err = st.TouchProfile(ctx, Profile{TelegramID: 1, Username: "uno"})
+	must(t, err)
+	must(t, st.InsertRateEvent(ctx, 1, "proxy"))
+	_, _, err = st.TakeRateToken(ctx, 1, "proxy", time.Minute, 1)
+	must(t, err)
+	must(t, st.PutTOTPSecret(ctx, 1, "secret"))
+	_, _, err = st.CreateAccessRequest(ctx, AccessRequest{TelegramID: 1})
+	must(t, err)
+	must(t, st.UpsertBan(ctx, Ban{TelegramID: 1, BannedBy: 9}))
+	must(t, st.CreateToken(ctx, "issued", RoleFree, nil, 1, nil))
+	must(t, st.CreateToken(ctx, "received", RoleFree, nil, 9, nil))
+	_, err = st.ConsumeToken(ctx, "received", 1)
+	must(t, err)
+	must(t, st.InsertAuditEvent(ctx, AuditEvent{Actor: ptr[int64](9), Target: ptr[int64](1), Action: "user.ban"}))
+	must(t, st.UpsertUser(ctx, User{ID: 2, Role: RoleFree}))
+}
+
+func testPrivacy(t *testing.T, ctx context.Context, st Store) {
+	seedUser(t, ctx, st)
+	d, err := st.UserData(ctx, 1)
+	must(t, err)
+	if d.User == nil || d.Profile == nil || d.TOTP == nil || d.Ban == nil {
+		t.Fatalf("user data = %+v", d)
+	}
+	if len(d.ProfileChanges) != 1 || len(d.AccessRequests) != 1 || len(d.RateEvents) != 1 || len(d.Tokens) != 2 || len(d.AuditEvents) != 2 {
+		t.Fatalf("changes=%d requests=%d events=%d tokens=%d audit=%d",
+			len(d.ProfileChanges), len(d.AccessRequests), len(d.RateEvents), len(d.Tokens), len(d.AuditEvents))
+	}
+
+	res, err := st.ForgetUser(ctx, 1, AuditAnonymize)
+	must(t, err)
+	if !res.User || res.Credentials != 1 || res.AccessRequests != 1 || res.Profile != 2 || res.Tokens != 2 || res.AuditEvents != 2 {
+		t.Fatalf("forget result = %+v", res)
+	}
+	d, err = st.UserData(ctx, 1)
+	must(t, err)
+	if d.User != nil || d.Profile != nil || d.TOTP != nil || len(d.RateEvents) != 0 || len(d.Tokens) != 0 || len(d.AuditEvents) != 0 || len(d.AccessRequests) != 0 {
+		t.Fatalf("left after forget = %+v", d)
+	}
+	if d.Ban == nil {
+		t.Fatal("a ban must survive erasure")
+	}
+	// the token the user issued is revoked, the anonymized events are kept
+	_, err = st.ConsumeToken(ctx, "issued", 2)
+	wantErr(t, err, ErrNotFound)
+	events, err := st.ListAuditEvents(ctx, AuditFilter{Action: "user.ban", Limit: 10})
+	must(t, err)
+	if len(events) != 1 || events[0].Target != nil || events[0].Actor == nil || *events[0].Actor != 9 {
+		t.Fatalf("anonymized events = %+v", events)
+	}
+	// the bucket was dropped with the rate events
+	ok, _, err := st.TakeRateToken(ctx, 1, "proxy", time.Minute, 1)
+	must(t, err)
+	if !ok {
+		t.Fatal("rate bucket survived erasure")
+	}
+	if _, err := st.GetUser(ctx, 2); err != nil {
+		t.Fatalf("other user touched: %v", err)
+	}
+}
+
+// TestForgetAuditPolicies checks the policies the privacy case does not cover:
+// seedUser writes two events that reference user 1.
+func TestForgetAuditPolicies(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			for policy, left := range map[AuditPolicy]int{AuditDelete: 0, AuditKeep: 2} {
+				t.Run(string(policy), func(t *testing.T) {
+					ctx := context.Background()
+					st := b.open(t)
+					seedUser(t, ctx, st)
+					_, err := st.ForgetUser(ctx, 1, policy)
+					must(t, err)
+					events, err := st.ListAuditEvents(ctx, AuditFilter{UserID: ptr[int64](1), Limit: 10})
+					must(t, err)
+					if len(events) != left {
+						t.Fatalf("%d events of the user left, want %d", len(events), left)
+					}
+				})
+			}
+		})
+	}
+}
+
+func testBackup(t *testing.T, ctx context.Context, st Store) {
+	must(t, st.UpsertRole(ctx, RoleDef{Name: "vip", RatePerMin: 5, ProxyPools: []string{"eu"}, Permissions: []string{"proxy"}}))
+	must(t, st.UpsertUser(ctx, User{ID: 1, Role: "vip", IsAuthed: true}))
+	must(t, st.CreateToken(ctx, "tok", "vip", ptr(time.Now().Add(time.Hour).Truncate(time.Second)), 1, nil))
+	must(t, st.PutTOTPSecret(ctx, 1, "secret"))
+	must(t, st.UpsertBan(ctx, Ban{TelegramID: 2, Reason: "r", BannedBy: 1}))
+	must(t, st.PutSetting(ctx, "k", "v"))
+
+	d, err := st.ExportData(ctx)
+	must(t, err)
+	if len(d.Users) != 1 || len(d.Roles) != 1 || len(d.Tokens) != 1 || len(d.TOTPSecrets) != 1 || len(d.Bans) != 1 || d.Settings["k"] != "v" {
+		t.Fatalf("export = %+v", d)
+	}
+
+	// merge keeps rows absent from the dataset, replace drops them
+	must(t, st.UpsertUser(ctx, User{ID: 5, Role: RoleFree}))
+	must(t, st.ImportData(ctx, d, false))
+	if _, err := st.GetUser(ctx, 5); err != nil {
+		t.Fatalf("merge dropped a user: %v", err)
+	}
+	must(t, st.ImportData(ctx, d, true))
+	_, err = st.GetUser(ctx, 5)
+	wantErr(t, err, ErrNotFound)
+
+	again, err := st.ExportData(ctx)
+	must(t, err)
+	if fmt.Sprint(summarize(again)) != fmt.Sprint(summarize(d)) {
+		t.Fatalf("round trip changed the data:\n%v\n%v", summarize(d), summarize(again))
+	}
+	role, err := st.ConsumeToken(ctx, "tok", 3)
+	must(t, err)
+	if role != "vip" {
+		t.Fatalf("restored token role = %q", role)
+	}
+}
+
+// summarize drops timestamps that backends store at different precision.
+func summarize(d Dataset) []string {
+	var res []string
+	for _, u := range d.Users {
+		res = append(res, fmt.Sprintf("user %d %s %v", u.ID, u.Role, u.IsAuthed))
+	}
+	for _, r := range d.Roles {
+		res = append(res, fmt.Sprintf("role %s %d %v %v %v", r.Name, r.RatePerMin, r.ProxyPools, r.Permissions, r.Builtin))
+	}
+	for _, tk := range d.Tokens {
+		res = append(res, fmt.Sprintf("token %s %s %v %d", tk.Token, tk.Role, tk.ExpiresAt.Unix(), tk.IssuedBy))
+	}
+	for _, s := range d.TOTPSecrets {
+		res = append(res, fmt.Sprintf("totp %d %s %v", s.TelegramID, s.Secret, s.Confirmed))
+	}
+	for _, b := range d.Bans {
+		res = append(res, fmt.Sprintf("ban %d %s %d", b.TelegramID, b.Reason, b.BannedBy))
+	}
+	for k, v := range d.Settings {
+		res = append(res, "setting "+k+"="+v)
+	}
+	slices.Sort(res)
+	return res
+}
+
+func testUpdates(t *testing.T, ctx context.Context, st Store) {
+	for i, want := range []bool{true, false} {
+		ok, err := st.ClaimUpdate(ctx, 100, "/ban")
+		must(t, err)
+		if ok != want {
+			t.Fatalf("claim %d = %v, want %v", i, ok, want)
+		}
+	}
+	ok, err := st.ClaimUpdate(ctx, 101, "/ban")
+	must(t, err)
+	if !ok {
+		t.Fatal("another update is claimed separately")
+	}
+}
+
+func testRetention(t *testing.T, ctx context.Context, st Store) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	for range 3 {
+		must(t, st.InsertRateEvent(ctx, 1, "proxy"))
+	}
+	n, err := st.PurgeRateEvents(ctx, past, 10)
+	must(t, err)
+	if n != 0 {
+		t.Fatalf("purged %d fresh rate events", n)
+	}
+	n, err = st.PurgeRateEvents(ctx, future, 2)
+	must(t, err)
+	if n != 2 {
+		t.Fatalf("purged %d rate events, want the batch of 2", n)
+	}
+
+	must(t, st.CreateToken(ctx, "live", RoleFree, nil, 1, nil))
+	must(t, st.CreateToken(ctx, "used", RoleFree, nil, 1, nil))
+	must(t, st.CreateToken(ctx, "old", RoleFree, ptr(time.Now().Add(-time.Minute)), 1, nil))
+	_, err = st.ConsumeToken(ctx, "used", 2)
+	must(t, err)
+	n, err = st.PurgeTokens(ctx, future, 10)
+	must(t, err)
+	if n != 2 {
+		t.Fatalf("purged %d tokens, want the used and the expired one", n)
+	}
+	_, err = st.ConsumeToken(ctx, "live", 2)
+	must(t, err)
+
+	_, err = st.ClaimUpdate(ctx, 1, "h")
+	must(t, err)
+	n, err = st.PurgeProcessedUpdates(ctx, future, 10)
+	must(t, err)
+	if n != 1 {
+		t.Fatalf("purged %d updates", n)
+	}
+
+	_, _, err = st.TakeRateToken(ctx, 1, "proxy", time.Second, 1)
+	must(t, err)
+	n, err = st.PurgeRateBuckets(ctx, past, 10)
+	must(t, err)
+	if n != 0 {
+		t.Fatalf("purged %d busy buckets", n)
+	}
+	n, err = st.PurgeRateBuckets(ctx, future, 10)
+	must(t, err)
+	if n != 1 {
+		t.Fatalf("purged %d idle buckets", n)
+	}
+}
+
+func testLocks(t *testing.T, ctx context.Context, st Store) {
+	name := "test." + t.Name()
+	release, ok, err := st.TryLock(ctx, name)
+	must(t, err)
+	if !ok {
+		t.Fatal("free lock not taken")
+	}
+	if _, ok, err := st.TryLock(ctx, name); err != nil || ok {
+		t.Fatalf("held lock taken again: ok=%v err=%v", ok, err)
+	}
+	if _, ok, err := st.TryLease(ctx, name); err != nil || ok {
+		t.Fatalf("held lock leased: ok=%v err=%v", ok, err)
+	}
+	release()
+
+	lease, ok, err := st.TryLease(ctx, name)
+	must(t, err)
+	if !ok {
+		t.Fatal("released lock not leased")
+	}
+	must(t, lease.Check(ctx))
+	if _, ok, _ := st.TryLock(ctx, name); ok {
+		t.Fatal("leased lock taken")
+	}
+	lease.Release()
+	release, ok, err = st.TryLock(ctx, name)
+	must(t, err)
+	if !ok {
+		t.Fatal("lock not free after the lease was released")
+	}
+	release()
+}
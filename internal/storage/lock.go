@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// localLocks implements Locker for backends used by a single process.
+type localLocks struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func (l *localLocks) TryLock(ctx context.Context, name string) (func(), bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[name] {
+		return nil, false, nil
+	}
+	if l.held == nil {
+		l.held = make(map[string]bool)
+	}
+	l.held[name] = true
+	return func() {
+		l.mu.Lock()
+		delete(l.held, name)
+		l.mu.Unlock()
+	}, true, nil
+}
+
+// localLease never expires: the process holding it is the only one using the store.
+type localLease struct{ release func() }
+
+func (l localLease) Check(ctx context.Context) error { return nil }
+func (l localLease) Release()                        { l.release() }
+
+func (l *localLocks) TryLease(ctx context.Context, name string) (Lease, bool, error) {
+	release, ok, err := l.TryLock(ctx, name)
+	if !ok {
+		return nil, false, err
+	}
+	return localLease{release: release}, true, nil
+}
@@ -0,0 +1,958 @@
+package storage
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memToken struct {
+	role       Role
+	expiresAt  *time.Time
+	consumedAt *time.Time
+	issuedBy   int64
+	issuedTo   *int64
+	createdAt  time.Time
+}
+
+type memRateEvent struct {
+	telegramID int64
+	kind       string
+	createdAt  time.Time
+}
+
+// Memory is a Store kept in process memory, for single-node and development use.
+// Data is lost on restart.
+type Memory struct {
+	localLocks
+	mu         sync.Mutex
+	users      map[int64]User
+	roles      map[Role]RoleDef
+	tokens     map[string]memToken
+	rateEvents []memRateEvent
+	requests   map[int64]AccessRequest
+	bans       map[int64]Ban
+	totp       map[int64]TOTPSecret
+	audit      []AuditEvent
+	settings   map[string]string
+	profiles   map[int64]Profile
+	history    []ProfileChange
+	updates    map[int64]time.Time // processed update IDs and when they were claimed
+	buckets    map[rateBucketKey]time.Time
+	nextID     int64
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:    make(map[int64]User),
+		roles:    make(map[Role]RoleDef),
+		tokens:   make(map[string]memToken),
+		requests: make(map[int64]AccessRequest),
+		bans:     make(map[int64]Ban),
+		totp:     make(map[int64]TOTPSecret),
+		settings: make(map[string]string),
+		profiles: make(map[int64]Profile),
+		updates:  make(map[int64]time.Time),
+		buckets:  make(map[rateBucketKey]time.Time),
+	}
+}
+
+func (m *Memory) Close() {}
+
+func (m *Memory) Ping(ctx context.Context) error { return nil }
+
+// Migrate and the Migrator methods are no-ops: there is no schema to version.
+func (m *Memory) Migrate(ctx context.Context) error { return nil }
+
+func (m *Memory) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) { return nil, nil }
+
+func (m *Memory) MigrateUp(ctx context.Context, steps int) (int, error) { return 0, nil }
+
+func (m *Memory) MigrateDown(ctx context.Context, steps int) (int, error) { return 0, nil }
+
+func (m *Memory) id() int64 {
+	m.nextID++
+	return m.nextID
+}
+
+// Users
+
+func (m *Memory) UpsertUser(ctx context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	cur, ok := m.users[user.ID]
+	if !ok {
+		cur = User{ID: user.ID, CreatedAt: now}
+	}
+	cur.Role = user.Role
+	cur.IsAuthed = user.IsAuthed
+	cur.UpdatedAt = now
+	m.users[user.ID] = cur
+	return nil
+}
+
+func (m *Memory) GetUser(ctx context.Context, id int64) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+// Profiles
+
+func (m *Memory) TouchProfile(ctx context.Context, p Profile) ([]ProfileChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var changes []ProfileChange
+	p.LastSeenAt, p.UpdatedAt = now, now
+	if prev, ok := m.profiles[p.TelegramID]; ok {
+		changes = profileChanges(prev, p, now)
+		if len(changes) == 0 {
+			p.UpdatedAt = prev.UpdatedAt
+		}
+	}
+	m.profiles[p.TelegramID] = p
+	m.history = append(m.history, changes...)
+	return changes, nil
+}
+
+func (m *Memory) GetProfile(ctx context.Context, id int64) (Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.profiles[id]
+	if !ok {
+		return Profile{}, ErrNotFound
+	}
+	return p, nil
+}
+
+func (m *Memory) FindProfileByUsername(ctx context.Context, username string) (Profile, error) {
+	username = NormalizeUsername(username)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found *Profile
+	for _, p := range m.profiles {
+		if username == "" || !strings.EqualFold(p.Username, username) {
+			continue
+		}
+		if found == nil || p.LastSeenAt.After(found.LastSeenAt) {
+			found = &p
+		}
+	}
+	if found == nil {
+		return Profile{}, ErrNotFound
+	}
+	return *found, nil
+}
+
+func (m *Memory) ListProfileChanges(ctx context.Context, id int64, limit int) ([]ProfileChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []ProfileChange
+	for i := len(m.history) - 1; i >= 0 && len(res) < limit; i-- {
+		if m.history[i].TelegramID == id {
+			res = append(res, m.history[i])
+		}
+	}
+	return res, nil
+}
+
+func (m *Memory) ListUsersByRole(ctx context.Context, role Role) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []User
+	for _, u := range m.users {
+		if u.Role == role {
+			res = append(res, u)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+func (m *Memory) ListAuthedUserIDs(ctx context.Context) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []int64
+	for _, u := range m.users {
+		if u.IsAuthed {
+			res = append(res, u.ID)
+		}
+	}
+	slices.Sort(res)
+	return res, nil
+}
+
+func (m *Memory) SetUserRole(ctx context.Context, id int64, role Role) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Role = role
+	u.UpdatedAt = time.Now()
+	m.users[id] = u
+	return nil
+}
+
+func (m *Memory) SetUserAuthed(ctx context.Context, id int64, authed bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.users[id]; ok {
+		u.IsAuthed = authed
+		u.UpdatedAt = time.Now()
+		m.users[id] = u
+	}
+	return nil
+}
+
+// Roles
+
+func cloneRole(r RoleDef) RoleDef {
+	r.ProxyPools = slices.Clone(r.ProxyPools)
+	r.Permissions = slices.Clone(r.Permissions)
+	return r
+}
+
+func (m *Memory) ListRoles(ctx context.Context) ([]RoleDef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]RoleDef, 0, len(m.roles))
+	for _, r := range m.roles {
+		res = append(res, cloneRole(r))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+func (m *Memory) GetRole(ctx context.Context, name Role) (RoleDef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.roles[name]
+	if !ok {
+		return RoleDef{}, ErrNotFound
+	}
+	return cloneRole(r), nil
+}
+
+func (m *Memory) UpsertRole(ctx context.Context, r RoleDef) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	r = cloneRole(r)
+	if cur, ok := m.roles[r.Name]; ok {
+		r.Builtin = cur.Builtin
+		r.CreatedAt = cur.CreatedAt
+	} else {
+		r.CreatedAt = now
+	}
+	r.UpdatedAt = now
+	m.roles[r.Name] = r
+	return nil
+}
+
+func (m *Memory) SeedRole(ctx context.Context, r RoleDef) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if cur, ok := m.roles[r.Name]; ok {
+		if cur.Builtin && cur.RatePerMin != r.RatePerMin {
+			cur.RatePerMin, cur.UpdatedAt = r.RatePerMin, now
+			m.roles[r.Name] = cur
+		}
+		return nil
+	}
+	r = cloneRole(r)
+	r.CreatedAt, r.UpdatedAt = now, now
+	m.roles[r.Name] = r
+	return nil
+}
+
+func (m *Memory) DeleteRole(ctx context.Context, name, fallback Role, actor int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.roles[name]
+	if !ok || r.Builtin {
+		return ErrNotFound
+	}
+	delete(m.roles, name)
+	var moved int64
+	for id, u := range m.users {
+		if u.Role == name {
+			u.Role = fallback
+			u.UpdatedAt = time.Now()
+			m.users[id] = u
+			moved++
+		}
+	}
+	m.appendAudit(AuditEvent{Actor: &actor, Action: "role.delete", Metadata: map[string]any{
+		"role": string(name), "fallback": string(fallback), "users_moved": moved,
+	}})
+	return nil
+}
+
+func (m *Memory) ReassignUnknownRoles(ctx context.Context, fallback Role) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for id, u := range m.users {
+		if _, ok := m.roles[u.Role]; !ok {
+			u.Role = fallback
+			u.UpdatedAt = time.Now()
+			m.users[id] = u
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Tokens
+
+func (m *Memory) CreateToken(ctx context.Context, token string, role Role, expiresAt *time.Time, issuedBy int64, issuedTo *int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tokens[token]; ok {
+		return ErrConflict
+	}
+	m.tokens[token] = memToken{role: role, expiresAt: expiresAt, issuedBy: issuedBy, issuedTo: issuedTo, createdAt: time.Now()}
+	return nil
+}
+
+func (m *Memory) ConsumeToken(ctx context.Context, token string, consumeBy int64) (Role, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[token]
+	if !ok || t.consumedAt != nil {
+		return "", ErrNotFound
+	}
+	now := time.Now()
+	if t.expiresAt != nil && now.After(*t.expiresAt) {
+		return "", ErrNotFound
+	}
+	t.consumedAt = &now
+	t.issuedTo = &consumeBy
+	m.tokens[token] = t
+	m.appendAudit(AuditEvent{Actor: &consumeBy, Target: &consumeBy, Action: "token.consume", Metadata: map[string]any{"role": string(t.role)}})
+	return t.role, nil
+}
+
+func (m *Memory) RevokeTokensIssuedBy(ctx context.Context, issuedBy int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var n int64
+	for k, t := range m.tokens {
+		if t.issuedBy != issuedBy || t.consumedAt != nil || (t.expiresAt != nil && !t.expiresAt.After(now)) {
+			continue
+		}
+		exp := now
+		t.expiresAt = &exp
+		m.tokens[k] = t
+		n++
+	}
+	return n, nil
+}
+
+// Rate events
+
+func (m *Memory) InsertRateEvent(ctx context.Context, telegramID int64, kind string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rateEvents = append(m.rateEvents, memRateEvent{telegramID: telegramID, kind: kind, createdAt: time.Now()})
+	return nil
+}
+
+func (m *Memory) CountEventsSince(ctx context.Context, telegramID int64, since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, e := range m.rateEvents {
+		if e.telegramID == telegramID && !e.createdAt.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) RecordRateEvent(ctx context.Context, telegramID int64, kind string, since time.Time, limit int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if limit > 0 {
+		n := 0
+		for _, e := range m.rateEvents {
+			if e.telegramID == telegramID && !e.createdAt.Before(since) {
+				n++
+			}
+		}
+		if n >= limit {
+			return false, nil
+		}
+	}
+	m.rateEvents = append(m.rateEvents, memRateEvent{telegramID: telegramID, kind: kind, createdAt: time.Now()})
+	return true, nil
+}
+
+// Rate buckets
+
+type rateBucketKey struct {
+	telegramID int64
+	kind       string
+}
+
+func (m *Memory) TakeRateToken(ctx context.Context, telegramID int64, kind string, interval time.Duration, burst int) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	k := rateBucketKey{telegramID, kind}
+	tat := m.buckets[k]
+	if tat.Before(now) {
+		tat = now
+	}
+	if wait := tat.Sub(now) - interval*time.Duration(burst-1); wait > 0 {
+		return false, wait, nil
+	}
+	m.buckets[k] = tat.Add(interval)
+	return true, 0, nil
+}
+
+// Access requests
+
+func (m *Memory) CreateAccessRequest(ctx context.Context, r AccessRequest) (AccessRequest, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, cur := range m.requests {
+		if cur.TelegramID != r.TelegramID || cur.Status != AccessPending {
+			continue
+		}
+		cur.Username, cur.FirstName, cur.LastName, cur.LanguageCode = r.Username, r.FirstName, r.LastName, r.LanguageCode
+		if r.Message != "" {
+			cur.Message = r.Message
+		}
+		m.requests[id] = cur
+		return cur, false, nil
+	}
+	r.ID = m.id()
+	r.Status = AccessPending
+	r.Role = ""
+	r.DecidedBy, r.DecidedAt = nil, nil
+	r.CreatedAt = time.Now()
+	m.requests[r.ID] = r
+	return r, true, nil
+}
+
+func (m *Memory) GetAccessRequest(ctx context.Context, id int64) (AccessRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.requests[id]
+	if !ok {
+		return AccessRequest{}, ErrNotFound
+	}
+	return r, nil
+}
+
+func (m *Memory) ListPendingAccessRequests(ctx context.Context) ([]AccessRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []AccessRequest
+	for _, r := range m.requests {
+		if r.Status == AccessPending {
+			res = append(res, r)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+func (m *Memory) DecideAccessRequest(ctx context.Context, id int64, status AccessRequestStatus, role Role, decidedBy int64) (AccessRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.requests[id]
+	if !ok || r.Status != AccessPending {
+		return AccessRequest{}, ErrNotFound
+	}
+	now := time.Now()
+	r.Status, r.Role, r.DecidedBy, r.DecidedAt = status, role, &decidedBy, &now
+	m.requests[id] = r
+	return r, nil
+}
+
+func (m *Memory) LastAccessDecision(ctx context.Context, telegramID int64) (AccessRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var last AccessRequest
+	for _, r := range m.requests {
+		if r.TelegramID == telegramID && r.DecidedAt != nil && (last.DecidedAt == nil || r.DecidedAt.After(*last.DecidedAt)) {
+			last = r
+		}
+	}
+	if last.DecidedAt == nil {
+		return AccessRequest{}, ErrNotFound
+	}
+	return last, nil
+}
+
+// Bans
+
+func (m *Memory) UpsertBan(ctx context.Context, b Ban) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b.CreatedAt = time.Now()
+	m.bans[b.TelegramID] = b
+	return nil
+}
+
+func (m *Memory) DeleteBan(ctx context.Context, telegramID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.bans[telegramID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.bans, telegramID)
+	return nil
+}
+
+func (m *Memory) ListActiveBans(ctx context.Context) ([]Ban, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var res []Ban
+	for _, b := range m.bans {
+		if b.Active(now) {
+			res = append(res, b)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+	return res, nil
+}
+
+// TOTP
+
+func (m *Memory) PutTOTPSecret(ctx context.Context, telegramID int64, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.totp[telegramID] = TOTPSecret{TelegramID: telegramID, Secret: secret, CreatedAt: time.Now()}
+	return nil
+}
+
+func (m *Memory) GetTOTPSecret(ctx context.Context, telegramID int64) (TOTPSecret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totp[telegramID]
+	if !ok {
+		return TOTPSecret{}, ErrNotFound
+	}
+	return t, nil
+}
+
+func (m *Memory) UseTOTPStep(ctx context.Context, telegramID, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totp[telegramID]
+	if !ok || t.LastUsedStep >= step {
+		return false, nil
+	}
+	t.LastUsedStep = step
+	t.Confirmed = true
+	m.totp[telegramID] = t
+	return true, nil
+}
+
+func (m *Memory) DeleteTOTPSecret(ctx context.Context, telegramID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.totp[telegramID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.totp, telegramID)
+	return nil
+}
+
+func (m *Memory) ListTOTPSecrets(ctx context.Context, after int64, limit int) ([]TOTPSecret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []TOTPSecret
+	for id, t := range m.totp {
+		if id > after {
+			res = append(res, t)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].TelegramID < res[j].TelegramID })
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+func (m *Memory) SwapTOTPSecret(ctx context.Context, telegramID int64, old, secret string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totp[telegramID]
+	if !ok || t.Secret != old {
+		return false, nil
+	}
+	t.Secret = secret
+	m.totp[telegramID] = t
+	return true, nil
+}
+
+// Audit
+
+// appendAudit must be called with m.mu held.
+func (m *Memory) appendAudit(ev AuditEvent) {
+	ev.ID = m.id()
+	ev.CreatedAt = time.Now()
+	if ev.Metadata == nil {
+		ev.Metadata = map[string]any{}
+	}
+	m.audit = append(m.audit, ev)
+}
+
+func (m *Memory) InsertAuditEvent(ctx context.Context, ev AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ev.Metadata = maps.Clone(ev.Metadata)
+	m.appendAudit(ev)
+	return nil
+}
+
+func (m *Memory) ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f.Limit <= 0 {
+		f.Limit = 20
+	}
+	var res []AuditEvent
+	skipped := 0
+	for i := len(m.audit) - 1; i >= 0 && len(res) < f.Limit; i-- {
+		ev := m.audit[i]
+		if f.UserID != nil && !matchID(ev.Actor, *f.UserID) && !matchID(ev.Target, *f.UserID) {
+			continue
+		}
+		if f.Action != "" && ev.Action != f.Action {
+			continue
+		}
+		if skipped < f.Offset {
+			skipped++
+			continue
+		}
+		ev.Metadata = maps.Clone(ev.Metadata)
+		res = append(res, ev)
+	}
+	return res, nil
+}
+
+// Privacy
+
+func (m *Memory) UserData(ctx context.Context, id int64) (UserData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var d UserData
+	if u, ok := m.users[id]; ok {
+		d.User = &u
+	}
+	if p, ok := m.profiles[id]; ok {
+		d.Profile = &p
+	}
+	for _, c := range m.history {
+		if c.TelegramID == id {
+			d.ProfileChanges = append(d.ProfileChanges, c)
+		}
+	}
+	if t, ok := m.totp[id]; ok {
+		d.TOTP = &t
+	}
+	if b, ok := m.bans[id]; ok {
+		d.Ban = &b
+	}
+	for _, r := range m.requests {
+		if r.TelegramID == id {
+			d.AccessRequests = append(d.AccessRequests, r)
+		}
+	}
+	sort.Slice(d.AccessRequests, func(i, j int) bool { return d.AccessRequests[i].ID < d.AccessRequests[j].ID })
+	for _, e := range m.rateEvents {
+		if e.telegramID == id {
+			d.RateEvents = append(d.RateEvents, RateEvent{Kind: e.kind, CreatedAt: e.createdAt})
+		}
+	}
+	for k, t := range m.tokens {
+		if t.issuedBy == id || matchID(t.issuedTo, id) {
+			d.Tokens = append(d.Tokens, Token{Token: k, Role: t.role, ExpiresAt: t.expiresAt, ConsumedAt: t.consumedAt, IssuedBy: t.issuedBy, IssuedTo: t.issuedTo, CreatedAt: t.createdAt})
+		}
+	}
+	sort.Slice(d.Tokens, func(i, j int) bool { return d.Tokens[i].CreatedAt.Before(d.Tokens[j].CreatedAt) })
+	for _, ev := range m.audit {
+		if matchID(ev.Actor, id) || matchID(ev.Target, id) {
+			ev.Metadata = maps.Clone(ev.Metadata)
+			d.AuditEvents = append(d.AuditEvents, ev)
+		}
+	}
+	return d, nil
+}
+
+func (m *Memory) ForgetUser(ctx context.Context, id int64, policy AuditPolicy) (ForgetResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res ForgetResult
+	if _, ok := m.users[id]; ok {
+		delete(m.users, id)
+		res.User = true
+	}
+	if _, ok := m.profiles[id]; ok {
+		delete(m.profiles, id)
+		res.Profile++
+	}
+	history := m.history[:0]
+	for _, c := range m.history {
+		if c.TelegramID == id {
+			res.Profile++
+			continue
+		}
+		history = append(history, c)
+	}
+	m.history = history
+	kept := m.rateEvents[:0]
+	for _, e := range m.rateEvents {
+		if e.telegramID == id {
+			res.RateEvents++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	m.rateEvents = kept
+	for k := range m.buckets {
+		if k.telegramID == id {
+			delete(m.buckets, k)
+			res.RateEvents++
+		}
+	}
+	if _, ok := m.totp[id]; ok {
+		delete(m.totp, id)
+		res.Credentials++
+	}
+	for k, r := range m.requests {
+		if r.TelegramID == id {
+			delete(m.requests, k)
+			res.AccessRequests++
+		}
+	}
+	now := time.Now()
+	for k, t := range m.tokens {
+		changed := false
+		if t.issuedBy == id {
+			if t.consumedAt == nil && (t.expiresAt == nil || t.expiresAt.After(now)) {
+				t.expiresAt = &now
+			}
+			t.issuedBy = 0
+			changed = true
+			res.Tokens++
+		}
+		if matchID(t.issuedTo, id) {
+			t.issuedTo = nil
+			changed = true
+			res.Tokens++
+		}
+		if changed {
+			m.tokens[k] = t
+		}
+	}
+	switch policy {
+	case AuditDelete:
+		events := m.audit[:0]
+		for _, ev := range m.audit {
+			if matchID(ev.Actor, id) || matchID(ev.Target, id) {
+				res.AuditEvents++
+				continue
+			}
+			events = append(events, ev)
+		}
+		m.audit = events
+	case AuditAnonymize:
+		for i, ev := range m.audit {
+			if !matchID(ev.Actor, id) && !matchID(ev.Target, id) {
+				continue
+			}
+			if matchID(ev.Actor, id) {
+				m.audit[i].Actor = nil
+			}
+			if matchID(ev.Target, id) {
+				m.audit[i].Target = nil
+			}
+			res.AuditEvents++
+		}
+	}
+	return res, nil
+}
+
+// Settings
+
+func (m *Memory) GetSetting(ctx context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.settings[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return v, nil
+}
+
+func (m *Memory) PutSetting(ctx context.Context, key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settings[key] = value
+	return nil
+}
+
+// Backup
+
+func (m *Memory) ExportData(ctx context.Context) (Dataset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := Dataset{Settings: maps.Clone(m.settings)}
+	for _, u := range m.users {
+		d.Users = append(d.Users, u)
+	}
+	sort.Slice(d.Users, func(i, j int) bool { return d.Users[i].ID < d.Users[j].ID })
+	for _, r := range m.roles {
+		d.Roles = append(d.Roles, cloneRole(r))
+	}
+	sort.Slice(d.Roles, func(i, j int) bool { return d.Roles[i].Name < d.Roles[j].Name })
+	for k, t := range m.tokens {
+		d.Tokens = append(d.Tokens, Token{Token: k, Role: t.role, ExpiresAt: t.expiresAt, ConsumedAt: t.consumedAt, IssuedBy: t.issuedBy, IssuedTo: t.issuedTo, CreatedAt: t.createdAt})
+	}
+	sort.Slice(d.Tokens, func(i, j int) bool { return d.Tokens[i].CreatedAt.Before(d.Tokens[j].CreatedAt) })
+	for _, t := range m.totp {
+		d.TOTPSecrets = append(d.TOTPSecrets, t)
+	}
+	sort.Slice(d.TOTPSecrets, func(i, j int) bool { return d.TOTPSecrets[i].TelegramID < d.TOTPSecrets[j].TelegramID })
+	for _, b := range m.bans {
+		d.Bans = append(d.Bans, b)
+	}
+	sort.Slice(d.Bans, func(i, j int) bool { return d.Bans[i].TelegramID < d.Bans[j].TelegramID })
+	return d, nil
+}
+
+func (m *Memory) ImportData(ctx context.Context, d Dataset, replace bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if replace {
+		clear(m.users)
+		clear(m.roles)
+		clear(m.tokens)
+		clear(m.totp)
+		clear(m.bans)
+		clear(m.settings)
+	}
+	for _, u := range d.Users {
+		m.users[u.ID] = u
+	}
+	for _, r := range d.Roles {
+		m.roles[r.Name] = cloneRole(r)
+	}
+	for _, t := range d.Tokens {
+		m.tokens[t.Token] = memToken{role: t.Role, expiresAt: t.ExpiresAt, consumedAt: t.ConsumedAt, issuedBy: t.IssuedBy, issuedTo: t.IssuedTo, createdAt: t.CreatedAt}
+	}
+	for _, t := range d.TOTPSecrets {
+		m.totp[t.TelegramID] = t
+	}
+	for _, b := range d.Bans {
+		m.bans[b.TelegramID] = b
+	}
+	for k, v := range d.Settings {
+		m.settings[k] = v
+	}
+	return nil
+}
+
+// Updates
+
+func (m *Memory) ClaimUpdate(ctx context.Context, updateID int64, handler string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.updates[updateID]; ok {
+		return false, nil
+	}
+	m.updates[updateID] = time.Now()
+	return true, nil
+}
+
+// Retention
+
+func (m *Memory) PurgeRateEvents(ctx context.Context, before time.Time, limit int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// events are appended in time order, so old ones form a prefix
+	n := 0
+	for n < len(m.rateEvents) && n < limit && m.rateEvents[n].createdAt.Before(before) {
+		n++
+	}
+	m.rateEvents = slices.Delete(m.rateEvents, 0, n)
+	return int64(n), nil
+}
+
+func (m *Memory) PurgeTokens(ctx context.Context, before time.Time, limit int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for k, t := range m.tokens {
+		if n >= int64(limit) {
+			break
+		}
+		if tokenPurgeable(t, before) {
+			delete(m.tokens, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) PurgeProcessedUpdates(ctx context.Context, before time.Time, limit int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for id, at := range m.updates {
+		if n >= int64(limit) {
+			break
+		}
+		if at.Before(before) {
+			delete(m.updates, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) PurgeRateBuckets(ctx context.Context, before time.Time, limit int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for k, tat := range m.buckets {
+		if n >= int64(limit) {
+			break
+		}
+		if tat.Before(before) {
+			delete(m.buckets, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func tokenPurgeable(t memToken, before time.Time) bool {
+	if t.consumedAt != nil {
+		return t.consumedAt.Before(before)
+	}
+	return t.expiresAt != nil && t.expiresAt.Before(before)
+}
+
+func matchID(p *int64, id int64) bool { return p != nil && *p == id }
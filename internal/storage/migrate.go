@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration files live in migrations/<dialect>/NNNN_name.up.sql with a matching
+// NNNN_name.down.sql. Applied versions are recorded in schema_migrations.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationLockKey is the Postgres advisory lock key held while migrating.
+const migrationLockKey = 727274001
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a known migration and when it was applied (nil if pending).
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrator moves the schema between versions. steps limits how many migrations
+// are applied or rolled back, 0 means all. Both return the number of migrations run.
+type Migrator interface {
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+	MigrateUp(ctx context.Context, steps int) (int, error)
+	MigrateDown(ctx context.Context, steps int) (int, error)
+}
+
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		base, dirn, ok := strings.Cut(e.Name(), ".")
+		if !ok || (dirn != "up.sql" && dirn != "down.sql") {
+			continue
+		}
+		num, name, _ := strings.Cut(base, "_")
+		v, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: bad version", e.Name())
+		}
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[v]
+		if m == nil {
+			m = &Migration{Version: v, Name: name}
+			byVersion[v] = m
+		}
+		if dirn == "up.sql" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+	res := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s: missing up.sql", m.Version, m.Name)
+		}
+		res = append(res, *m)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Version < res[j].Version })
+	return res, nil
+}
+
+// migrationBackend is what a database needs to provide to run migrations.
+type migrationBackend interface {
+	// lockMigrations serializes migrations between processes sharing the database.
+	lockMigrations(ctx context.Context) (unlock func(), err error)
+	ensureMigrationsTable(ctx context.Context) error
+	appliedMigrations(ctx context.Context) (map[int]time.Time, error)
+	// runMigration executes the script and records (or removes) the version in one
+	// transaction. It reports false if another process already did it.
+	runMigration(ctx context.Context, m Migration, up bool) (bool, error)
+}
+
+func migrationStatus(ctx context.Context, b migrationBackend, dialect string) ([]MigrationStatus, error) {
+	list, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := b.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]MigrationStatus, 0, len(list))
+	for _, m := range list {
+		st := MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			st.AppliedAt = &at
+		}
+		res = append(res, st)
+	}
+	return res, nil
+}
+
+func migrate(ctx context.Context, b migrationBackend, dialect string, up bool, steps int) (int, error) {
+	list, err := loadMigrations(dialect)
+	if err != nil {
+		return 0, err
+	}
+	unlock, err := b.lockMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	if err := b.ensureMigrationsTable(ctx); err != nil {
+		return 0, err
+	}
+	applied, err := b.appliedMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !up {
+		slices.Reverse(list)
+	}
+	done := 0
+	for _, m := range list {
+		if steps > 0 && done >= steps {
+			break
+		}
+		if _, ok := applied[m.Version]; ok == up {
+			continue
+		}
+		if !up && m.Down == "" {
+			return done, fmt.Errorf("migration %04d_%s has no down script", m.Version, m.Name)
+		}
+		ran, err := b.runMigration(ctx, m, up)
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if ran {
+			done++
+		}
+	}
+	return done, nil
+}
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS bans;
+DROP TABLE IF EXISTS totp_secrets;
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS access_requests;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS tokens;
+DROP TABLE IF EXISTS rate_events;
+DROP TABLE IF EXISTS users;
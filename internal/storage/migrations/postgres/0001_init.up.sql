@@ -0,0 +1,87 @@
+-- Baseline schema. IF NOT EXISTS lets databases created before versioned
+-- migrations adopt it without changes.
+
+CREATE TABLE IF NOT EXISTS users (
+	telegram_id BIGINT PRIMARY KEY,
+	role TEXT NOT NULL,
+	is_authed BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS rate_events (
+	id BIGSERIAL PRIMARY KEY,
+	telegram_id BIGINT NOT NULL,
+	kind TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_events_user_time ON rate_events(telegram_id, created_at);
+
+CREATE TABLE IF NOT EXISTS tokens (
+	token TEXT PRIMARY KEY,
+	role TEXT NOT NULL,
+	expires_at TIMESTAMPTZ,
+	consumed_at TIMESTAMPTZ,
+	issued_by BIGINT,
+	issued_to BIGINT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_tokens_expires ON tokens(expires_at);
+
+CREATE TABLE IF NOT EXISTS roles (
+	name TEXT PRIMARY KEY,
+	display_name TEXT NOT NULL DEFAULT '',
+	rate_per_min INT NOT NULL DEFAULT 0,
+	traffic_quota_mb BIGINT NOT NULL DEFAULT 0,
+	max_connections INT NOT NULL DEFAULT 0,
+	proxy_pools TEXT[] NOT NULL DEFAULT '{}',
+	permissions TEXT[] NOT NULL DEFAULT '{}',
+	builtin BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS access_requests (
+	id BIGSERIAL PRIMARY KEY,
+	telegram_id BIGINT NOT NULL,
+	username TEXT NOT NULL DEFAULT '',
+	first_name TEXT NOT NULL DEFAULT '',
+	last_name TEXT NOT NULL DEFAULT '',
+	language_code TEXT NOT NULL DEFAULT '',
+	message TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'pending',
+	role TEXT NOT NULL DEFAULT '',
+	decided_by BIGINT,
+	decided_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_access_requests_pending ON access_requests(telegram_id) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS audit_events (
+	id BIGSERIAL PRIMARY KEY,
+	actor BIGINT,
+	target BIGINT,
+	action TEXT NOT NULL,
+	metadata JSONB NOT NULL DEFAULT '{}',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON audit_events(actor, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_target ON audit_events(target, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_time ON audit_events(created_at);
+
+CREATE TABLE IF NOT EXISTS totp_secrets (
+	telegram_id BIGINT PRIMARY KEY,
+	secret TEXT NOT NULL,
+	confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+	last_used_step BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS bans (
+	telegram_id BIGINT PRIMARY KEY,
+	reason TEXT NOT NULL DEFAULT '',
+	banned_by BIGINT NOT NULL,
+	expires_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_tokens_consumed;
+DROP INDEX IF EXISTS idx_rate_events_time;
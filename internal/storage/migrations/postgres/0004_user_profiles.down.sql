@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_profile_history;
+DROP TABLE IF EXISTS user_profiles;
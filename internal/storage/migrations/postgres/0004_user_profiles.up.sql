@@ -0,0 +1,22 @@
+-- Telegram profile data seen on each interaction and the history of its changes.
+CREATE TABLE IF NOT EXISTS user_profiles (
+	telegram_id BIGINT PRIMARY KEY,
+	username TEXT NOT NULL DEFAULT '',
+	first_name TEXT NOT NULL DEFAULT '',
+	last_name TEXT NOT NULL DEFAULT '',
+	language_code TEXT NOT NULL DEFAULT '',
+	is_premium BOOLEAN NOT NULL DEFAULT FALSE,
+	last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_user_profiles_username ON user_profiles(lower(username)) WHERE username <> '';
+
+CREATE TABLE IF NOT EXISTS user_profile_history (
+	id BIGSERIAL PRIMARY KEY,
+	telegram_id BIGINT NOT NULL,
+	field TEXT NOT NULL,
+	old_value TEXT NOT NULL,
+	new_value TEXT NOT NULL,
+	changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_user_profile_history_user ON user_profile_history(telegram_id, changed_at);
@@ -0,0 +1,86 @@
+-- Baseline schema. IF NOT EXISTS lets databases created before versioned
+-- migrations adopt it without changes.
+
+CREATE TABLE IF NOT EXISTS users (
+	telegram_id INTEGER PRIMARY KEY,
+	role TEXT NOT NULL,
+	is_authed INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS rate_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	telegram_id INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_rate_events_user_time ON rate_events(telegram_id, created_at);
+
+CREATE TABLE IF NOT EXISTS tokens (
+	token TEXT PRIMARY KEY,
+	role TEXT NOT NULL,
+	expires_at INTEGER,
+	consumed_at INTEGER,
+	issued_by INTEGER,
+	issued_to INTEGER,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_tokens_expires ON tokens(expires_at);
+
+CREATE TABLE IF NOT EXISTS roles (
+	name TEXT PRIMARY KEY,
+	display_name TEXT NOT NULL DEFAULT '',
+	rate_per_min INTEGER NOT NULL DEFAULT 0,
+	traffic_quota_mb INTEGER NOT NULL DEFAULT 0,
+	max_connections INTEGER NOT NULL DEFAULT 0,
+	proxy_pools TEXT NOT NULL DEFAULT '[]',
+	permissions TEXT NOT NULL DEFAULT '[]',
+	builtin INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS access_requests (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	telegram_id INTEGER NOT NULL,
+	username TEXT NOT NULL DEFAULT '',
+	first_name TEXT NOT NULL DEFAULT '',
+	last_name TEXT NOT NULL DEFAULT '',
+	language_code TEXT NOT NULL DEFAULT '',
+	message TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'pending',
+	role TEXT NOT NULL DEFAULT '',
+	decided_by INTEGER,
+	decided_at INTEGER,
+	created_at INTEGER NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_access_requests_pending ON access_requests(telegram_id) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS audit_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	actor INTEGER,
+	target INTEGER,
+	action TEXT NOT NULL,
+	metadata TEXT NOT NULL DEFAULT '{}',
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON audit_events(actor, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_target ON audit_events(target, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_time ON audit_events(created_at);
+
+CREATE TABLE IF NOT EXISTS totp_secrets (
+	telegram_id INTEGER PRIMARY KEY,
+	secret TEXT NOT NULL,
+	confirmed INTEGER NOT NULL DEFAULT 0,
+	last_used_step INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS bans (
+	telegram_id INTEGER PRIMARY KEY,
+	reason TEXT NOT NULL DEFAULT '',
+	banned_by INTEGER NOT NULL,
+	expires_at INTEGER,
+	created_at INTEGER NOT NULL
+);
@@ -0,0 +1,3 @@
+-- Indexes used by the retention jobs.
+CREATE INDEX IF NOT EXISTS idx_rate_events_time ON rate_events(created_at);
+CREATE INDEX IF NOT EXISTS idx_tokens_consumed ON tokens(consumed_at);
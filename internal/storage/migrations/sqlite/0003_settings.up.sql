@@ -0,0 +1,6 @@
+-- Key/value settings persisted by the bot and included in backups.
+CREATE TABLE IF NOT EXISTS settings (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL,
+	updated_at INTEGER NOT NULL
+);
@@ -0,0 +1,22 @@
+-- Telegram profile data seen on each interaction and the history of its changes.
+CREATE TABLE IF NOT EXISTS user_profiles (
+	telegram_id INTEGER PRIMARY KEY,
+	username TEXT NOT NULL DEFAULT '',
+	first_name TEXT NOT NULL DEFAULT '',
+	last_name TEXT NOT NULL DEFAULT '',
+	language_code TEXT NOT NULL DEFAULT '',
+	is_premium INTEGER NOT NULL DEFAULT 0,
+	last_seen_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_user_profiles_username ON user_profiles(username COLLATE NOCASE) WHERE username <> '';
+
+CREATE TABLE IF NOT EXISTS user_profile_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	telegram_id INTEGER NOT NULL,
+	field TEXT NOT NULL,
+	old_value TEXT NOT NULL,
+	new_value TEXT NOT NULL,
+	changed_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_user_profile_history_user ON user_profile_history(telegram_id, changed_at);
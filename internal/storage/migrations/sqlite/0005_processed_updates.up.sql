@@ -0,0 +1,8 @@
+-- Telegram updates already handled by side-effecting commands, so a redelivered
+-- update is not applied twice.
+CREATE TABLE IF NOT EXISTS processed_updates (
+	update_id INTEGER PRIMARY KEY,
+	handler TEXT NOT NULL,
+	processed_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_processed_updates_at ON processed_updates(processed_at);
@@ -0,0 +1,8 @@
+-- GCRA limiter state: the theoretical arrival time of the next request per user and kind.
+CREATE TABLE IF NOT EXISTS rate_buckets (
+	telegram_id INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	tat INTEGER NOT NULL,
+	PRIMARY KEY (telegram_id, kind)
+);
+CREATE INDEX IF NOT EXISTS idx_rate_buckets_tat ON rate_buckets(tat);
@@ -3,77 +3,126 @@ package storage
 import (
 	"context"
 	"errors"
+	"strconv"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var ErrNotFound = errors.New("not found")
+// Postgres is the Store backed by PostgreSQL.
+type Postgres struct {
+	pool *pgxpool.Pool
+}
 
-type Role string
+func NewPostgres(ctx context.Context, dsn string) (*Postgres, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &Postgres{pool: pool}, nil
+}
 
-const (
-	RoleFree    Role = "free"
-	RolePremium Role = "premium"
-	RoleAdmin   Role = "admin"
-)
+func (s *Postgres) Close() { s.pool.Close() }
+
+func (s *Postgres) Ping(ctx context.Context) error { return s.pool.Ping(ctx) }
 
-type User struct {
-	ID        int64
-	Role      Role
-	IsAuthed  bool
-	CreatedAt time.Time
-	UpdatedAt time.Time
+// Migrate applies all pending migrations.
+func (s *Postgres) Migrate(ctx context.Context) error {
+	_, err := s.MigrateUp(ctx, 0)
+	return err
 }
 
-type Store struct {
-	pool *pgxpool.Pool
+func (s *Postgres) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	return migrationStatus(ctx, s, "postgres")
 }
 
-func NewPostgres(ctx context.Context, dsn string) (*Store, error) {
-	pool, err := pgxpool.New(ctx, dsn)
+func (s *Postgres) MigrateUp(ctx context.Context, steps int) (int, error) {
+	return migrate(ctx, s, "postgres", true, steps)
+}
+
+func (s *Postgres) MigrateDown(ctx context.Context, steps int) (int, error) {
+	return migrate(ctx, s, "postgres", false, steps)
+}
+
+// lockMigrations holds a session advisory lock on a dedicated connection, so
+// replicas starting together wait for each other instead of racing.
+func (s *Postgres) lockMigrations(ctx context.Context) (func(), error) {
+	conn, err := s.pool.Acquire(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return &Store{pool: pool}, nil
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		conn.Release()
+		return nil, err
+	}
+	return func() {
+		_, _ = conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+		conn.Release()
+	}, nil
 }
 
-func (s *Store) Close() { s.pool.Close() }
-
-func (s *Store) Migrate(ctx context.Context) error {
+func (s *Postgres) ensureMigrationsTable(ctx context.Context) error {
 	_, err := s.pool.Exec(ctx, `
-CREATE TABLE IF NOT EXISTS users (
-	telegram_id BIGINT PRIMARY KEY,
-	role TEXT NOT NULL,
-	is_authed BOOLEAN NOT NULL DEFAULT FALSE,
-	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-
-CREATE TABLE IF NOT EXISTS rate_events (
-	id BIGSERIAL PRIMARY KEY,
-	telegram_id BIGINT NOT NULL,
-	kind TEXT NOT NULL,
-	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-
-CREATE INDEX IF NOT EXISTS idx_rate_events_user_time ON rate_events(telegram_id, created_at);
-
-CREATE TABLE IF NOT EXISTS tokens (
-    token TEXT PRIMARY KEY,
-    role TEXT NOT NULL,
-    expires_at TIMESTAMPTZ,
-    consumed_at TIMESTAMPTZ,
-    issued_by BIGINT,
-    issued_to BIGINT,
-    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-CREATE INDEX IF NOT EXISTS idx_tokens_expires ON tokens(expires_at);
-	`)
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`)
 	return err
 }
 
-func (s *Store) UpsertUser(ctx context.Context, user User) error {
+func (s *Postgres) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := s.pool.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[int]time.Time)
+	for rows.Next() {
+		var v int
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		res[v] = at
+	}
+	return res, rows.Err()
+}
+
+func (s *Postgres) runMigration(ctx context.Context, m Migration, up bool) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version=$1)`, m.Version).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists == up {
+		return false, nil
+	}
+	script := m.Up
+	if !up {
+		script = m.Down
+	}
+	if _, err := tx.Exec(ctx, script); err != nil {
+		return false, err
+	}
+	if up {
+		_, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+	} else {
+		_, err = tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version=$1`, m.Version)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+func (s *Postgres) UpsertUser(ctx context.Context, user User) error {
 	_, err := s.pool.Exec(ctx, `
 INSERT INTO users (telegram_id, role, is_authed)
 VALUES ($1, $2, $3)
@@ -85,21 +134,490 @@ ON CONFLICT (telegram_id) DO UPDATE SET
 	return err
 }
 
-func (s *Store) GetUser(ctx context.Context, id int64) (User, error) {
+func (s *Postgres) GetUser(ctx context.Context, id int64) (User, error) {
 	var u User
 	row := s.pool.QueryRow(ctx, `SELECT telegram_id, role, is_authed, created_at, updated_at FROM users WHERE telegram_id=$1`, id)
 	if err := row.Scan(&u.ID, &u.Role, &u.IsAuthed, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return User{}, ErrNotFound
+		}
 		return User{}, err
 	}
 	return u, nil
 }
 
-func (s *Store) InsertRateEvent(ctx context.Context, telegramID int64, kind string) error {
+func (s *Postgres) ListUsersByRole(ctx context.Context, role Role) ([]User, error) {
+	rows, err := s.pool.Query(ctx, `SELECT telegram_id, role, is_authed, created_at, updated_at FROM users WHERE role=$1 ORDER BY telegram_id`, string(role))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Role, &u.IsAuthed, &u.CreatedAt, &u.UpdatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, u)
+	}
+	return res, rows.Err()
+}
+
+// SetUserRole changes the role of an existing user.
+func (s *Postgres) SetUserRole(ctx context.Context, id int64, role Role) error {
+	tag, err := s.pool.Exec(ctx, `UPDATE users SET role=$2, updated_at=now() WHERE telegram_id=$1`, id, string(role))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Profiles
+
+const profileColumns = `telegram_id, username, first_name, last_name, language_code, is_premium, last_seen_at, updated_at`
+
+func scanProfile(row interface{ Scan(...any) error }) (Profile, error) {
+	var p Profile
+	err := row.Scan(&p.TelegramID, &p.Username, &p.FirstName, &p.LastName, &p.LanguageCode, &p.IsPremium, &p.LastSeenAt, &p.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Profile{}, ErrNotFound
+	}
+	return p, err
+}
+
+// TouchProfile locks the previous row, so concurrent updates of one user record
+// each change once.
+func (s *Postgres) TouchProfile(ctx context.Context, p Profile) ([]ProfileChange, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	now := time.Now()
+	var changes []ProfileChange
+	prev, err := scanProfile(tx.QueryRow(ctx, `SELECT `+profileColumns+` FROM user_profiles WHERE telegram_id=$1 FOR UPDATE`, p.TelegramID))
+	switch {
+	case err == nil:
+		changes = profileChanges(prev, p, now)
+	case !errors.Is(err, ErrNotFound):
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `
+INSERT INTO user_profiles (telegram_id, username, first_name, last_name, language_code, is_premium, last_seen_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+ON CONFLICT (telegram_id) DO UPDATE SET
+	username = EXCLUDED.username,
+	first_name = EXCLUDED.first_name,
+	last_name = EXCLUDED.last_name,
+	language_code = EXCLUDED.language_code,
+	is_premium = EXCLUDED.is_premium,
+	last_seen_at = EXCLUDED.last_seen_at,
+	updated_at = CASE WHEN $8 THEN EXCLUDED.updated_at ELSE user_profiles.updated_at END`,
+		p.TelegramID, p.Username, p.FirstName, p.LastName, p.LanguageCode, p.IsPremium, now, len(changes) > 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range changes {
+		if _, err := tx.Exec(ctx, `INSERT INTO user_profile_history (telegram_id, field, old_value, new_value, changed_at) VALUES ($1, $2, $3, $4, $5)`,
+			c.TelegramID, c.Field, c.OldValue, c.NewValue, c.ChangedAt); err != nil {
+			return nil, err
+		}
+	}
+	return changes, tx.Commit(ctx)
+}
+
+func (s *Postgres) GetProfile(ctx context.Context, id int64) (Profile, error) {
+	return scanProfile(s.pool.QueryRow(ctx, `SELECT `+profileColumns+` FROM user_profiles WHERE telegram_id=$1`, id))
+}
+
+func (s *Postgres) FindProfileByUsername(ctx context.Context, username string) (Profile, error) {
+	username = NormalizeUsername(username)
+	if username == "" {
+		return Profile{}, ErrNotFound
+	}
+	return scanProfile(s.pool.QueryRow(ctx, `SELECT `+profileColumns+` FROM user_profiles WHERE username <> '' AND lower(username)=lower($1) ORDER BY last_seen_at DESC LIMIT 1`, username))
+}
+
+func (s *Postgres) ListProfileChanges(ctx context.Context, id int64, limit int) ([]ProfileChange, error) {
+	rows, err := s.pool.Query(ctx, `SELECT telegram_id, field, old_value, new_value, changed_at FROM user_profile_history WHERE telegram_id=$1 ORDER BY changed_at DESC, id DESC LIMIT $2`, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanProfileChange)
+}
+
+func scanProfileChange(row pgx.CollectableRow) (ProfileChange, error) {
+	var c ProfileChange
+	err := row.Scan(&c.TelegramID, &c.Field, &c.OldValue, &c.NewValue, &c.ChangedAt)
+	return c, err
+}
+
+// Roles
+
+const roleColumns = `name, display_name, rate_per_min, traffic_quota_mb, max_connections, proxy_pools, permissions, builtin, created_at, updated_at`
+
+func scanRole(row interface{ Scan(...any) error }) (RoleDef, error) {
+	var r RoleDef
+	err := row.Scan(&r.Name, &r.DisplayName, &r.RatePerMin, &r.TrafficQuotaMB, &r.MaxConnections, &r.ProxyPools, &r.Permissions, &r.Builtin, &r.CreatedAt, &r.UpdatedAt)
+	return r, err
+}
+
+func (s *Postgres) ListRoles(ctx context.Context) ([]RoleDef, error) {
+	rows, err := s.pool.Query(ctx, `SELECT `+roleColumns+` FROM roles ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []RoleDef
+	for rows.Next() {
+		r, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+func (s *Postgres) GetRole(ctx context.Context, name Role) (RoleDef, error) {
+	r, err := scanRole(s.pool.QueryRow(ctx, `SELECT `+roleColumns+` FROM roles WHERE name=$1`, string(name)))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return RoleDef{}, ErrNotFound
+	}
+	return r, err
+}
+
+func (s *Postgres) UpsertRole(ctx context.Context, r RoleDef) error {
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO roles (name, display_name, rate_per_min, traffic_quota_mb, max_connections, proxy_pools, permissions, builtin)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (name) DO UPDATE SET
+	display_name = EXCLUDED.display_name,
+	rate_per_min = EXCLUDED.rate_per_min,
+	traffic_quota_mb = EXCLUDED.traffic_quota_mb,
+	max_connections = EXCLUDED.max_connections,
+	proxy_pools = EXCLUDED.proxy_pools,
+	permissions = EXCLUDED.permissions,
+	updated_at = now();
+`, string(r.Name), r.DisplayName, r.RatePerMin, r.TrafficQuotaMB, r.MaxConnections, nonNil(r.ProxyPools), nonNil(r.Permissions), r.Builtin)
+	return err
+}
+
+func (s *Postgres) SeedRole(ctx context.Context, r RoleDef) error {
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO roles (name, display_name, rate_per_min, traffic_quota_mb, max_connections, proxy_pools, permissions, builtin)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (name) DO UPDATE SET rate_per_min = EXCLUDED.rate_per_min, updated_at = now()
+WHERE roles.builtin AND roles.rate_per_min <> EXCLUDED.rate_per_min;
+`, string(r.Name), r.DisplayName, r.RatePerMin, r.TrafficQuotaMB, r.MaxConnections, nonNil(r.ProxyPools), nonNil(r.Permissions), r.Builtin)
+	return err
+}
+
+// DeleteRole removes a role and moves its users to fallback in one transaction,
+// recording the reassignment in the audit log.
+func (s *Postgres) DeleteRole(ctx context.Context, name, fallback Role, actor int64) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	tag, err := tx.Exec(ctx, `DELETE FROM roles WHERE name=$1 AND NOT builtin`, string(name))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	moved, err := tx.Exec(ctx, `UPDATE users SET role=$2, updated_at=now() WHERE role=$1`, string(name), string(fallback))
+	if err != nil {
+		return err
+	}
+	if err := insertAudit(ctx, tx, AuditEvent{Actor: &actor, Action: "role.delete", Metadata: map[string]any{
+		"role": string(name), "fallback": string(fallback), "users_moved": moved.RowsAffected(),
+	}}); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ReassignUnknownRoles moves users whose role is not defined in roles to fallback.
+func (s *Postgres) ReassignUnknownRoles(ctx context.Context, fallback Role) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `UPDATE users SET role=$1, updated_at=now() WHERE role NOT IN (SELECT name FROM roles)`, string(fallback))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func nonNil(v []string) []string {
+	if v == nil {
+		return []string{}
+	}
+	return v
+}
+
+// ListAuthedUserIDs returns users that passed authentication or were approved.
+func (s *Postgres) ListAuthedUserIDs(ctx context.Context) ([]int64, error) {
+	rows, err := s.pool.Query(ctx, `SELECT telegram_id FROM users WHERE is_authed`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, rows.Err()
+}
+
+// SetUserAuthed updates the authenticated flag of an existing user.
+func (s *Postgres) SetUserAuthed(ctx context.Context, id int64, authed bool) error {
+	_, err := s.pool.Exec(ctx, `UPDATE users SET is_authed=$2, updated_at=now() WHERE telegram_id=$1`, id, authed)
+	return err
+}
+
+func (s *Postgres) LastAccessDecision(ctx context.Context, telegramID int64) (AccessRequest, error) {
+	return scanAccessRequest(s.pool.QueryRow(ctx, `
+SELECT `+accessRequestColumns+` FROM access_requests
+WHERE telegram_id=$1 AND status<>'pending'
+ORDER BY decided_at DESC LIMIT 1`, telegramID))
+}
+
+// Bans
+
+func (s *Postgres) UpsertBan(ctx context.Context, b Ban) error {
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO bans (telegram_id, reason, banned_by, expires_at)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (telegram_id) DO UPDATE SET
+	reason = EXCLUDED.reason,
+	banned_by = EXCLUDED.banned_by,
+	expires_at = EXCLUDED.expires_at,
+	created_at = now();
+`, b.TelegramID, b.Reason, b.BannedBy, b.ExpiresAt)
+	return err
+}
+
+func (s *Postgres) DeleteBan(ctx context.Context, telegramID int64) error {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM bans WHERE telegram_id=$1`, telegramID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListActiveBans returns bans that have not expired yet.
+func (s *Postgres) ListActiveBans(ctx context.Context) ([]Ban, error) {
+	rows, err := s.pool.Query(ctx, `SELECT telegram_id, reason, banned_by, expires_at, created_at FROM bans WHERE expires_at IS NULL OR expires_at > now() ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []Ban
+	for rows.Next() {
+		var b Ban
+		if err := rows.Scan(&b.TelegramID, &b.Reason, &b.BannedBy, &b.ExpiresAt, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, b)
+	}
+	return res, rows.Err()
+}
+
+// TOTP
+
+// PutTOTPSecret starts (or restarts) an enrollment with an unconfirmed secret.
+func (s *Postgres) PutTOTPSecret(ctx context.Context, telegramID int64, secret string) error {
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO totp_secrets (telegram_id, secret) VALUES ($1, $2)
+ON CONFLICT (telegram_id) DO UPDATE SET secret = EXCLUDED.secret, confirmed = FALSE, last_used_step = 0, created_at = now();
+`, telegramID, secret)
+	return err
+}
+
+func (s *Postgres) GetTOTPSecret(ctx context.Context, telegramID int64) (TOTPSecret, error) {
+	var t TOTPSecret
+	err := s.pool.QueryRow(ctx, `SELECT telegram_id, secret, confirmed, last_used_step, created_at FROM totp_secrets WHERE telegram_id=$1`, telegramID).
+		Scan(&t.TelegramID, &t.Secret, &t.Confirmed, &t.LastUsedStep, &t.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return TOTPSecret{}, ErrNotFound
+	}
+	return t, err
+}
+
+// UseTOTPStep records a successfully verified time step and confirms the enrollment.
+// Returns false if the step (or a later one) was already used, preventing code replay.
+func (s *Postgres) UseTOTPStep(ctx context.Context, telegramID, step int64) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `UPDATE totp_secrets SET last_used_step=$2, confirmed=TRUE WHERE telegram_id=$1 AND last_used_step < $2`, telegramID, step)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (s *Postgres) DeleteTOTPSecret(ctx context.Context, telegramID int64) error {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM totp_secrets WHERE telegram_id=$1`, telegramID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *Postgres) ListTOTPSecrets(ctx context.Context, after int64, limit int) ([]TOTPSecret, error) {
+	rows, err := s.pool.Query(ctx, `SELECT telegram_id, secret, confirmed, last_used_step, created_at FROM totp_secrets WHERE telegram_id > $1 ORDER BY telegram_id LIMIT $2`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []TOTPSecret
+	for rows.Next() {
+		var t TOTPSecret
+		if err := rows.Scan(&t.TelegramID, &t.Secret, &t.Confirmed, &t.LastUsedStep, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+	return res, rows.Err()
+}
+
+func (s *Postgres) SwapTOTPSecret(ctx context.Context, telegramID int64, old, secret string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `UPDATE totp_secrets SET secret=$3 WHERE telegram_id=$1 AND secret=$2`, telegramID, old, secret)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// Audit
+
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func insertAudit(ctx context.Context, db execer, ev AuditEvent) error {
+	meta := ev.Metadata
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	_, err := db.Exec(ctx, `INSERT INTO audit_events (actor, target, action, metadata) VALUES ($1, $2, $3, $4)`, ev.Actor, ev.Target, ev.Action, meta)
+	return err
+}
+
+func (s *Postgres) InsertAuditEvent(ctx context.Context, ev AuditEvent) error {
+	return insertAudit(ctx, s.pool, ev)
+}
+
+// ListAuditEvents returns events newest first.
+func (s *Postgres) ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	if f.Limit <= 0 {
+		f.Limit = 20
+	}
+	rows, err := s.pool.Query(ctx, `
+SELECT id, actor, target, action, metadata, created_at FROM audit_events
+WHERE ($1::BIGINT IS NULL OR actor = $1 OR target = $1)
+  AND ($2 = '' OR action = $2)
+ORDER BY created_at DESC, id DESC
+LIMIT $3 OFFSET $4`, f.UserID, f.Action, f.Limit, f.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []AuditEvent
+	for rows.Next() {
+		var ev AuditEvent
+		if err := rows.Scan(&ev.ID, &ev.Actor, &ev.Target, &ev.Action, &ev.Metadata, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, ev)
+	}
+	return res, rows.Err()
+}
+
+// Access requests
+
+const accessRequestColumns = `id, telegram_id, username, first_name, last_name, language_code, message, status, role, decided_by, decided_at, created_at`
+
+func scanAccessRequest(row interface{ Scan(...any) error }) (AccessRequest, error) {
+	var r AccessRequest
+	err := row.Scan(&r.ID, &r.TelegramID, &r.Username, &r.FirstName, &r.LastName, &r.LanguageCode, &r.Message, &r.Status, &r.Role, &r.DecidedBy, &r.DecidedAt, &r.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return AccessRequest{}, ErrNotFound
+	}
+	return r, err
+}
+
+// CreateAccessRequest stores a pending request. If the user already has one pending,
+// its profile and message are refreshed and created is false.
+func (s *Postgres) CreateAccessRequest(ctx context.Context, r AccessRequest) (AccessRequest, bool, error) {
+	res, err := scanAccessRequest(s.pool.QueryRow(ctx, `
+INSERT INTO access_requests (telegram_id, username, first_name, last_name, language_code, message)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (telegram_id) WHERE status = 'pending' DO NOTHING
+RETURNING `+accessRequestColumns, r.TelegramID, r.Username, r.FirstName, r.LastName, r.LanguageCode, r.Message))
+	if err == nil {
+		return res, true, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return AccessRequest{}, false, err
+	}
+	res, err = scanAccessRequest(s.pool.QueryRow(ctx, `
+UPDATE access_requests SET
+	username = $2, first_name = $3, last_name = $4, language_code = $5,
+	message = CASE WHEN $6 = '' THEN message ELSE $6 END
+WHERE telegram_id = $1 AND status = 'pending'
+RETURNING `+accessRequestColumns, r.TelegramID, r.Username, r.FirstName, r.LastName, r.LanguageCode, r.Message))
+	return res, false, err
+}
+
+func (s *Postgres) GetAccessRequest(ctx context.Context, id int64) (AccessRequest, error) {
+	return scanAccessRequest(s.pool.QueryRow(ctx, `SELECT `+accessRequestColumns+` FROM access_requests WHERE id=$1`, id))
+}
+
+func (s *Postgres) ListPendingAccessRequests(ctx context.Context) ([]AccessRequest, error) {
+	rows, err := s.pool.Query(ctx, `SELECT `+accessRequestColumns+` FROM access_requests WHERE status='pending' ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []AccessRequest
+	for rows.Next() {
+		r, err := scanAccessRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+// DecideAccessRequest moves a pending request to approved/denied. Returns ErrNotFound
+// if the request does not exist or was already decided.
+func (s *Postgres) DecideAccessRequest(ctx context.Context, id int64, status AccessRequestStatus, role Role, decidedBy int64) (AccessRequest, error) {
+	return scanAccessRequest(s.pool.QueryRow(ctx, `
+UPDATE access_requests SET status=$2, role=$3, decided_by=$4, decided_at=now()
+WHERE id=$1 AND status='pending'
+RETURNING `+accessRequestColumns, id, string(status), string(role), decidedBy))
+}
+
+func (s *Postgres) InsertRateEvent(ctx context.Context, telegramID int64, kind string) error {
 	_, err := s.pool.Exec(ctx, `INSERT INTO rate_events (telegram_id, kind) VALUES ($1, $2)`, telegramID, kind)
 	return err
 }
 
-func (s *Store) CountEventsSince(ctx context.Context, telegramID int64, since time.Time) (int, error) {
+func (s *Postgres) CountEventsSince(ctx context.Context, telegramID int64, since time.Time) (int, error) {
 	var cnt int
 	row := s.pool.QueryRow(ctx, `SELECT COUNT(*) FROM rate_events WHERE telegram_id=$1 AND created_at >= $2`, telegramID, since)
 	if err := row.Scan(&cnt); err != nil {
@@ -108,13 +626,525 @@ func (s *Store) CountEventsSince(ctx context.Context, telegramID int64, since ti
 	return cnt, nil
 }
 
+// RecordRateEvent serializes a user's requests with a transaction-level advisory
+// lock. The count runs after the lock is taken, so under READ COMMITTED it sees
+// every event committed by the request that held the lock before.
+func (s *Postgres) RecordRateEvent(ctx context.Context, telegramID int64, kind string, since time.Time, limit int) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtextextended('rate_events:' || $1::bigint, 0))`, telegramID); err != nil {
+		return false, err
+	}
+	tag, err := tx.Exec(ctx, `
+INSERT INTO rate_events (telegram_id, kind)
+SELECT $1::bigint, $2::text
+WHERE $4::int <= 0 OR (SELECT COUNT(*) FROM rate_events WHERE telegram_id=$1 AND created_at >= $3) < $4::int`, telegramID, kind, since, limit)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	return true, tx.Commit(ctx)
+}
+
+// Rate buckets
+
+func (s *Postgres) TakeRateToken(ctx context.Context, telegramID int64, kind string, interval time.Duration, burst int) (bool, time.Duration, error) {
+	tolerance := interval * time.Duration(burst-1)
+	var tat time.Time
+	err := s.pool.QueryRow(ctx, `
+INSERT INTO rate_buckets AS b (telegram_id, kind, tat) VALUES ($1, $2, now() + $3::bigint * interval '1 microsecond')
+ON CONFLICT (telegram_id, kind) DO UPDATE SET tat = greatest(b.tat, now()) + $3::bigint * interval '1 microsecond'
+WHERE b.tat - $4::bigint * interval '1 microsecond' <= now()
+RETURNING tat`, telegramID, kind, interval.Microseconds(), tolerance.Microseconds()).Scan(&tat)
+	if err == nil {
+		return true, 0, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return false, 0, err
+	}
+	var now time.Time
+	if err := s.pool.QueryRow(ctx, `SELECT tat, now() FROM rate_buckets WHERE telegram_id=$1 AND kind=$2`, telegramID, kind).Scan(&tat, &now); err != nil {
+		return false, 0, err
+	}
+	return false, max(tat.Sub(now)-tolerance, 0), nil
+}
+
+// Privacy
+
+func (s *Postgres) UserData(ctx context.Context, id int64) (UserData, error) {
+	var d UserData
+	if u, err := s.GetUser(ctx, id); err == nil {
+		d.User = &u
+	} else if !errors.Is(err, ErrNotFound) {
+		return UserData{}, err
+	}
+	if t, err := s.GetTOTPSecret(ctx, id); err == nil {
+		d.TOTP = &t
+	} else if !errors.Is(err, ErrNotFound) {
+		return UserData{}, err
+	}
+	if p, err := s.GetProfile(ctx, id); err == nil {
+		d.Profile = &p
+	} else if !errors.Is(err, ErrNotFound) {
+		return UserData{}, err
+	}
+	var b Ban
+	err := s.pool.QueryRow(ctx, `SELECT telegram_id, reason, banned_by, expires_at, created_at FROM bans WHERE telegram_id=$1`, id).
+		Scan(&b.TelegramID, &b.Reason, &b.BannedBy, &b.ExpiresAt, &b.CreatedAt)
+	if err == nil {
+		d.Ban = &b
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return UserData{}, err
+	}
+
+	rows, err := s.pool.Query(ctx, `SELECT telegram_id, field, old_value, new_value, changed_at FROM user_profile_history WHERE telegram_id=$1 ORDER BY changed_at, id`, id)
+	if err != nil {
+		return UserData{}, err
+	}
+	d.ProfileChanges, err = pgx.CollectRows(rows, scanProfileChange)
+	if err != nil {
+		return UserData{}, err
+	}
+
+	rows, err = s.pool.Query(ctx, `SELECT `+accessRequestColumns+` FROM access_requests WHERE telegram_id=$1 ORDER BY created_at`, id)
+	if err != nil {
+		return UserData{}, err
+	}
+	d.AccessRequests, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (AccessRequest, error) { return scanAccessRequest(row) })
+	if err != nil {
+		return UserData{}, err
+	}
+
+	rows, err = s.pool.Query(ctx, `SELECT kind, created_at FROM rate_events WHERE telegram_id=$1 ORDER BY created_at`, id)
+	if err != nil {
+		return UserData{}, err
+	}
+	d.RateEvents, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (RateEvent, error) {
+		var e RateEvent
+		err := row.Scan(&e.Kind, &e.CreatedAt)
+		return e, err
+	})
+	if err != nil {
+		return UserData{}, err
+	}
+
+	rows, err = s.pool.Query(ctx, `SELECT token, role, expires_at, consumed_at, COALESCE(issued_by, 0), issued_to, created_at FROM tokens WHERE issued_by=$1 OR issued_to=$1 ORDER BY created_at`, id)
+	if err != nil {
+		return UserData{}, err
+	}
+	d.Tokens, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (Token, error) {
+		var t Token
+		err := row.Scan(&t.Token, &t.Role, &t.ExpiresAt, &t.ConsumedAt, &t.IssuedBy, &t.IssuedTo, &t.CreatedAt)
+		return t, err
+	})
+	if err != nil {
+		return UserData{}, err
+	}
+
+	rows, err = s.pool.Query(ctx, `SELECT id, actor, target, action, metadata, created_at FROM audit_events WHERE actor=$1 OR target=$1 ORDER BY created_at, id`, id)
+	if err != nil {
+		return UserData{}, err
+	}
+	d.AuditEvents, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (AuditEvent, error) {
+		var ev AuditEvent
+		err := row.Scan(&ev.ID, &ev.Actor, &ev.Target, &ev.Action, &ev.Metadata, &ev.CreatedAt)
+		return ev, err
+	})
+	if err != nil {
+		return UserData{}, err
+	}
+	return d, nil
+}
+
+// forgetStep is a statement run by ForgetUser; its row count is added to dst.
+type forgetStep struct {
+	dst *int64
+	sql string
+}
+
+// ForgetUser erases the user in one transaction: the users row, profile, rate
+// events, TOTP secret and access requests are deleted, token references are cleared (unconsumed
+// tokens the user issued are expired first) and audit events are handled per policy.
+func (s *Postgres) ForgetUser(ctx context.Context, id int64, policy AuditPolicy) (ForgetResult, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return ForgetResult{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	var res ForgetResult
+	count := func(dst *int64, sql string) error {
+		tag, err := tx.Exec(ctx, sql, id)
+		if dst != nil {
+			*dst += tag.RowsAffected()
+		}
+		return err
+	}
+	var users int64
+	steps := []forgetStep{
+		{&users, `DELETE FROM users WHERE telegram_id=$1`},
+		{&res.Profile, `DELETE FROM user_profiles WHERE telegram_id=$1`},
+		{&res.Profile, `DELETE FROM user_profile_history WHERE telegram_id=$1`},
+		{&res.RateEvents, `DELETE FROM rate_events WHERE telegram_id=$1`},
+		{&res.RateEvents, `DELETE FROM rate_buckets WHERE telegram_id=$1`},
+		{&res.Credentials, `DELETE FROM totp_secrets WHERE telegram_id=$1`},
+		{&res.AccessRequests, `DELETE FROM access_requests WHERE telegram_id=$1`},
+		{nil, `UPDATE tokens SET expires_at=now() WHERE issued_by=$1 AND consumed_at IS NULL AND (expires_at IS NULL OR expires_at > now())`},
+		{&res.Tokens, `UPDATE tokens SET issued_by=NULL WHERE issued_by=$1`},
+		{&res.Tokens, `UPDATE tokens SET issued_to=NULL WHERE issued_to=$1`},
+	}
+	switch policy {
+	case AuditDelete:
+		steps = append(steps, forgetStep{&res.AuditEvents, `DELETE FROM audit_events WHERE actor=$1 OR target=$1`})
+	case AuditAnonymize:
+		steps = append(steps, forgetStep{&res.AuditEvents, `UPDATE audit_events SET actor = NULLIF(actor, $1), target = NULLIF(target, $1) WHERE actor=$1 OR target=$1`})
+	}
+	for _, st := range steps {
+		if err := count(st.dst, st.sql); err != nil {
+			return ForgetResult{}, err
+		}
+	}
+	res.User = users > 0
+	return res, tx.Commit(ctx)
+}
+
+// Settings
+
+func (s *Postgres) GetSetting(ctx context.Context, key string) (string, error) {
+	var v string
+	err := s.pool.QueryRow(ctx, `SELECT value FROM settings WHERE key=$1`, key).Scan(&v)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return v, err
+}
+
+func (s *Postgres) PutSetting(ctx context.Context, key, value string) error {
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO settings (key, value) VALUES ($1, $2)
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = now()`, key, value)
+	return err
+}
+
+// Backup
+
+// backupTables are emptied by a replacing import, children first.
+var backupTables = []string{"totp_secrets", "bans", "tokens", "users", "roles", "settings"}
+
+func (s *Postgres) ExportData(ctx context.Context) (Dataset, error) {
+	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return Dataset{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	var d Dataset
+
+	rows, err := tx.Query(ctx, `SELECT telegram_id, role, is_authed, created_at, updated_at FROM users ORDER BY telegram_id`)
+	if err != nil {
+		return Dataset{}, err
+	}
+	d.Users, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (User, error) {
+		var u User
+		err := row.Scan(&u.ID, &u.Role, &u.IsAuthed, &u.CreatedAt, &u.UpdatedAt)
+		return u, err
+	})
+	if err != nil {
+		return Dataset{}, err
+	}
+
+	rows, err = tx.Query(ctx, `SELECT `+roleColumns+` FROM roles ORDER BY name`)
+	if err != nil {
+		return Dataset{}, err
+	}
+	d.Roles, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (RoleDef, error) { return scanRole(row) })
+	if err != nil {
+		return Dataset{}, err
+	}
+
+	rows, err = tx.Query(ctx, `SELECT token, role, expires_at, consumed_at, COALESCE(issued_by, 0), issued_to, created_at FROM tokens ORDER BY created_at`)
+	if err != nil {
+		return Dataset{}, err
+	}
+	d.Tokens, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (Token, error) {
+		var t Token
+		err := row.Scan(&t.Token, &t.Role, &t.ExpiresAt, &t.ConsumedAt, &t.IssuedBy, &t.IssuedTo, &t.CreatedAt)
+		return t, err
+	})
+	if err != nil {
+		return Dataset{}, err
+	}
+
+	rows, err = tx.Query(ctx, `SELECT telegram_id, secret, confirmed, last_used_step, created_at FROM totp_secrets ORDER BY telegram_id`)
+	if err != nil {
+		return Dataset{}, err
+	}
+	d.TOTPSecrets, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (TOTPSecret, error) {
+		var t TOTPSecret
+		err := row.Scan(&t.TelegramID, &t.Secret, &t.Confirmed, &t.LastUsedStep, &t.CreatedAt)
+		return t, err
+	})
+	if err != nil {
+		return Dataset{}, err
+	}
+
+	rows, err = tx.Query(ctx, `SELECT telegram_id, reason, banned_by, expires_at, created_at FROM bans ORDER BY telegram_id`)
+	if err != nil {
+		return Dataset{}, err
+	}
+	d.Bans, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (Ban, error) {
+		var b Ban
+		err := row.Scan(&b.TelegramID, &b.Reason, &b.BannedBy, &b.ExpiresAt, &b.CreatedAt)
+		return b, err
+	})
+	if err != nil {
+		return Dataset{}, err
+	}
+
+	rows, err = tx.Query(ctx, `SELECT key, value FROM settings`)
+	if err != nil {
+		return Dataset{}, err
+	}
+	defer rows.Close()
+	d.Settings = make(map[string]string)
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return Dataset{}, err
+		}
+		d.Settings[k] = v
+	}
+	return d, rows.Err()
+}
+
+func (s *Postgres) ImportData(ctx context.Context, d Dataset, replace bool) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	if replace {
+		for _, t := range backupTables {
+			if _, err := tx.Exec(ctx, `DELETE FROM `+t); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range d.Roles {
+		if _, err := tx.Exec(ctx, `
+INSERT INTO roles (name, display_name, rate_per_min, traffic_quota_mb, max_connections, proxy_pools, permissions, builtin, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (name) DO UPDATE SET
+	display_name = EXCLUDED.display_name, rate_per_min = EXCLUDED.rate_per_min,
+	traffic_quota_mb = EXCLUDED.traffic_quota_mb, max_connections = EXCLUDED.max_connections,
+	proxy_pools = EXCLUDED.proxy_pools, permissions = EXCLUDED.permissions,
+	builtin = EXCLUDED.builtin, created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at`,
+			string(r.Name), r.DisplayName, r.RatePerMin, r.TrafficQuotaMB, r.MaxConnections, nonNil(r.ProxyPools), nonNil(r.Permissions), r.Builtin, r.CreatedAt, r.UpdatedAt); err != nil {
+			return err
+		}
+	}
+	for _, u := range d.Users {
+		if _, err := tx.Exec(ctx, `
+INSERT INTO users (telegram_id, role, is_authed, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (telegram_id) DO UPDATE SET
+	role = EXCLUDED.role, is_authed = EXCLUDED.is_authed, created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at`,
+			u.ID, string(u.Role), u.IsAuthed, u.CreatedAt, u.UpdatedAt); err != nil {
+			return err
+		}
+	}
+	for _, t := range d.Tokens {
+		if _, err := tx.Exec(ctx, `
+INSERT INTO tokens (token, role, expires_at, consumed_at, issued_by, issued_to, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (token) DO UPDATE SET
+	role = EXCLUDED.role, expires_at = EXCLUDED.expires_at, consumed_at = EXCLUDED.consumed_at,
+	issued_by = EXCLUDED.issued_by, issued_to = EXCLUDED.issued_to, created_at = EXCLUDED.created_at`,
+			t.Token, string(t.Role), t.ExpiresAt, t.ConsumedAt, t.IssuedBy, t.IssuedTo, t.CreatedAt); err != nil {
+			return err
+		}
+	}
+	for _, t := range d.TOTPSecrets {
+		if _, err := tx.Exec(ctx, `
+INSERT INTO totp_secrets (telegram_id, secret, confirmed, last_used_step, created_at) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (telegram_id) DO UPDATE SET
+	secret = EXCLUDED.secret, confirmed = EXCLUDED.confirmed, last_used_step = EXCLUDED.last_used_step, created_at = EXCLUDED.created_at`,
+			t.TelegramID, t.Secret, t.Confirmed, t.LastUsedStep, t.CreatedAt); err != nil {
+			return err
+		}
+	}
+	for _, b := range d.Bans {
+		if _, err := tx.Exec(ctx, `
+INSERT INTO bans (telegram_id, reason, banned_by, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (telegram_id) DO UPDATE SET
+	reason = EXCLUDED.reason, banned_by = EXCLUDED.banned_by, expires_at = EXCLUDED.expires_at, created_at = EXCLUDED.created_at`,
+			b.TelegramID, b.Reason, b.BannedBy, b.ExpiresAt, b.CreatedAt); err != nil {
+			return err
+		}
+	}
+	for k, v := range d.Settings {
+		if _, err := tx.Exec(ctx, `
+INSERT INTO settings (key, value) VALUES ($1, $2)
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = now()`, k, v); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// Updates
+
+func (s *Postgres) ClaimUpdate(ctx context.Context, updateID int64, handler string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `INSERT INTO processed_updates (update_id, handler) VALUES ($1, $2) ON CONFLICT (update_id) DO NOTHING`, updateID, handler)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// Retention
+
+func (s *Postgres) PurgeRateEvents(ctx context.Context, before time.Time, limit int) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM rate_events WHERE id IN (SELECT id FROM rate_events WHERE created_at < $1 ORDER BY id LIMIT $2)`, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *Postgres) PurgeTokens(ctx context.Context, before time.Time, limit int) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `
+DELETE FROM tokens WHERE token IN (
+	SELECT token FROM tokens
+	WHERE consumed_at < $1 OR (consumed_at IS NULL AND expires_at < $1)
+	LIMIT $2
+)`, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *Postgres) PurgeProcessedUpdates(ctx context.Context, before time.Time, limit int) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM processed_updates WHERE update_id IN (SELECT update_id FROM processed_updates WHERE processed_at < $1 LIMIT $2)`, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *Postgres) PurgeRateBuckets(ctx context.Context, before time.Time, limit int) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM rate_buckets WHERE (telegram_id, kind) IN (SELECT telegram_id, kind FROM rate_buckets WHERE tat < $1 LIMIT $2)`, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// TryLock takes a session advisory lock keyed by name on a dedicated connection,
+// so only one replica holds it at a time. The lock is dropped if the connection dies.
+func (s *Postgres) TryLock(ctx context.Context, name string) (func(), bool, error) {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	var ok bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock(hashtextextended($1, 0))`, name).Scan(&ok); err != nil || !ok {
+		conn.Release()
+		return nil, false, err
+	}
+	return func() {
+		_, _ = conn.Exec(context.Background(), `SELECT pg_advisory_unlock(hashtextextended($1, 0))`, name)
+		conn.Release()
+	}, true, nil
+}
+
+// pgLease is a session advisory lock; it lives exactly as long as its connection.
+type pgLease struct {
+	conn *pgxpool.Conn
+	name string
+}
+
+// Check pings the connection holding the lock: while the session is alive nobody
+// else can take the lock.
+func (l *pgLease) Check(ctx context.Context) error { return l.conn.Ping(ctx) }
+
+func (l *pgLease) Release() {
+	_, _ = l.conn.Exec(context.Background(), `SELECT pg_advisory_unlock(hashtextextended($1, 0))`, l.name)
+	l.conn.Release()
+}
+
+func (s *Postgres) TryLease(ctx context.Context, name string) (Lease, bool, error) {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	var ok bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock(hashtextextended($1, 0))`, name).Scan(&ok); err != nil || !ok {
+		conn.Release()
+		return nil, false, err
+	}
+	return &pgLease{conn: conn, name: name}, true, nil
+}
+
+// userChangesChannel is the NOTIFY channel carrying IDs of changed users.
+const userChangesChannel = "proxya_user_changed"
+
+var _ UserNotifier = (*Postgres)(nil)
+
+func (s *Postgres) NotifyUserChanged(ctx context.Context, id int64) error {
+	_, err := s.pool.Exec(ctx, `SELECT pg_notify($1, $2)`, userChangesChannel, strconv.FormatInt(id, 10))
+	return err
+}
+
+// ListenUserChanges holds a pool connection for LISTEN until ctx is done or the
+// connection fails.
+func (s *Postgres) ListenUserChanges(ctx context.Context, ready func(), fn func(id int64)) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, `LISTEN `+userChangesChannel); err != nil {
+		return err
+	}
+	defer func() {
+		// a connection going back to the pool must not keep listening
+		_, _ = conn.Exec(context.Background(), `UNLISTEN `+userChangesChannel)
+	}()
+	ready()
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if id, err := strconv.ParseInt(n.Payload, 10, 64); err == nil {
+			fn(id)
+		}
+	}
+}
+
 // Tokens
-func (s *Store) CreateToken(ctx context.Context, token string, role Role, expiresAt *time.Time, issuedBy int64, issuedTo *int64) error {
+func (s *Postgres) CreateToken(ctx context.Context, token string, role Role, expiresAt *time.Time, issuedBy int64, issuedTo *int64) error {
 	_, err := s.pool.Exec(ctx, `INSERT INTO tokens (token, role, expires_at, issued_by, issued_to) VALUES ($1,$2,$3,$4,$5)`, token, string(role), expiresAt, issuedBy, issuedTo)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrConflict
+	}
 	return err
 }
 
-func (s *Store) ConsumeToken(ctx context.Context, token string, consumeBy int64) (Role, error) {
+// RevokeTokensIssuedBy expires unconsumed tokens minted by the user.
+func (s *Postgres) RevokeTokensIssuedBy(ctx context.Context, issuedBy int64) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `UPDATE tokens SET expires_at=now() WHERE issued_by=$1 AND consumed_at IS NULL AND (expires_at IS NULL OR expires_at > now())`, issuedBy)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *Postgres) ConsumeToken(ctx context.Context, token string, consumeBy int64) (Role, error) {
 	// Try to consume if valid and not expired/consumed
 	tx, err := s.pool.Begin(ctx)
 	if err != nil {
@@ -125,7 +1155,10 @@ func (s *Store) ConsumeToken(ctx context.Context, token string, consumeBy int64)
 	var role Role
 	var expiresAt *time.Time
 	var consumedAt *time.Time
-	err = tx.QueryRow(ctx, `SELECT role, expires_at, consumed_at FROM tokens WHERE token=$1`, token).Scan(&role, &expiresAt, &consumedAt)
+	err = tx.QueryRow(ctx, `SELECT role, expires_at, consumed_at FROM tokens WHERE token=$1 FOR UPDATE`, token).Scan(&role, &expiresAt, &consumedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotFound
+	}
 	if err != nil {
 		return "", err
 	}
@@ -139,6 +1172,9 @@ func (s *Store) ConsumeToken(ctx context.Context, token string, consumeBy int64)
 	if _, err := tx.Exec(ctx, `UPDATE tokens SET consumed_at=now(), issued_to=$2 WHERE token=$1`, token, consumeBy); err != nil {
 		return "", err
 	}
+	if err := insertAudit(ctx, tx, AuditEvent{Actor: &consumeBy, Target: &consumeBy, Action: "token.consume", Metadata: map[string]any{"role": string(role)}}); err != nil {
+		return "", err
+	}
 	if err := tx.Commit(ctx); err != nil {
 		return "", err
 	}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRecordRateEventConcurrent fires many requests of one user at once: the
+// count and the insert must be atomic, so exactly limit of them get through.
+func TestRecordRateEventConcurrent(t *testing.T) {
+	const (
+		workers = 50
+		limit   = 7
+	)
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			st := b.open(t)
+			since := time.Now().Add(-time.Minute)
+
+			var allowed atomic.Int32
+			var wg sync.WaitGroup
+			start := make(chan struct{})
+			errs := make(chan error, workers)
+			for range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					ok, err := st.RecordRateEvent(ctx, 1, "proxy", since, limit)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if ok {
+						allowed.Add(1)
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			if n := allowed.Load(); n != limit {
+				t.Fatalf("%d requests allowed, want %d", n, limit)
+			}
+			n, err := st.CountEventsSince(ctx, 1, since)
+			must(t, err)
+			if n != limit {
+				t.Fatalf("%d rows inserted, want %d", n, limit)
+			}
+		})
+	}
+}
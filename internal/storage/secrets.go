@@ -0,0 +1,357 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"ProxyaService/internal/metrics"
+)
+
+// sealedPrefix marks an encrypted value; anything without it is legacy plaintext.
+const sealedPrefix = "enc:v1:"
+
+// ErrSecretKey is returned when a stored secret was sealed with a key version
+// the keyring does not have, or fails authentication.
+var ErrSecretKey = errors.New("secret cannot be decrypted")
+
+// Keyring holds the key-encryption keys by version. New values are sealed with
+// the highest version; older versions are kept only to open existing values.
+type Keyring struct {
+	keys    map[uint32]cipher.AEAD
+	primary uint32
+}
+
+// ParseKeyring reads "version:base64key" entries separated by commas or newlines.
+// Keys are 32 bytes (AES-256); blank lines and lines starting with # are skipped.
+func ParseKeyring(spec string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[uint32]cipher.AEAD)}
+	sc := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(spec, ",", "\n")))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ver, enc, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("secret key %q: want version:base64key", line)
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(ver), 10, 32)
+		if err != nil || v == 0 {
+			return nil, fmt.Errorf("secret key version %q: must be a positive number", ver)
+		}
+		if _, dup := k.keys[uint32(v)]; dup {
+			return nil, fmt.Errorf("secret key version %d is defined twice", v)
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+		if err != nil {
+			return nil, fmt.Errorf("secret key %d: %w", v, err)
+		}
+		if len(raw) != 32 {
+			return nil, fmt.Errorf("secret key %d: want 32 bytes, got %d", v, len(raw))
+		}
+		aead, err := newGCM(raw)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[uint32(v)] = aead
+		k.primary = max(k.primary, uint32(v))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		return nil, nil
+	}
+	return k, nil
+}
+
+// LoadKeyring combines keys given inline with those from file (either may be
+// empty). It returns nil without error when no key is configured.
+func LoadKeyring(keys, file string) (*Keyring, error) {
+	spec := keys
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		spec += "\n" + string(b)
+	}
+	return ParseKeyring(spec)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Primary is the key version new values are sealed with.
+func (k *Keyring) Primary() uint32 { return k.primary }
+
+// Seal encrypts plaintext under a fresh data key, which is itself encrypted with
+// the primary key. aad binds the value to its row, so a sealed value copied to
+// another row does not open. The result is
+// "enc:v1:<version>:<base64 wrapped data key>:<base64 ciphertext>".
+func (k *Keyring) Seal(plaintext, aad string) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	ct, err := seal(aead, []byte(plaintext), []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.primary], dek, []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + strconv.FormatUint(uint64(k.primary), 10) + ":" +
+		base64.RawStdEncoding.EncodeToString(wrapped) + ":" + base64.RawStdEncoding.EncodeToString(ct), nil
+}
+
+// Open reverses Seal. Values without the sealed prefix are returned as they are,
+// so rows written before encryption was enabled keep working.
+func (k *Keyring) Open(value, aad string) (string, error) {
+	ver, wrapped, ct, sealed, err := parseSealed(value)
+	if !sealed {
+		return value, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	kek, ok := k.keys[ver]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown key version %d", ErrSecretKey, ver)
+	}
+	dek, err := open(kek, wrapped, []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	pt, err := open(aead, ct, []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	return string(pt), nil
+}
+
+// Stale reports whether value is plaintext or sealed with a non-primary key.
+func (k *Keyring) Stale(value string) bool {
+	ver, _, _, sealed, err := parseSealed(value)
+	return !sealed || err != nil || ver != k.primary
+}
+
+func parseSealed(value string) (ver uint32, wrapped, ct []byte, sealed bool, err error) {
+	rest, sealed := strings.CutPrefix(value, sealedPrefix)
+	if !sealed {
+		return 0, nil, nil, false, nil
+	}
+	parts := strings.Split(rest, ":")
+	if len(parts) != 3 {
+		return 0, nil, nil, true, fmt.Errorf("%w: malformed value", ErrSecretKey)
+	}
+	v, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, nil, nil, true, fmt.Errorf("%w: malformed key version", ErrSecretKey)
+	}
+	if wrapped, err = base64.RawStdEncoding.DecodeString(parts[1]); err != nil {
+		return 0, nil, nil, true, fmt.Errorf("%w: malformed data key", ErrSecretKey)
+	}
+	if ct, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, true, fmt.Errorf("%w: malformed ciphertext", ErrSecretKey)
+	}
+	return uint32(v), wrapped, ct, true, nil
+}
+
+// seal returns nonce||ciphertext.
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, data, aad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: value too short", ErrSecretKey)
+	}
+	pt, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSecretKey, err)
+	}
+	return pt, nil
+}
+
+// totpAAD binds a sealed TOTP secret to its owner.
+func totpAAD(telegramID int64) string {
+	return "totp_secrets:" + strconv.FormatInt(telegramID, 10)
+}
+
+// SecretBox is a Store that encrypts secrets before they reach the database and
+// decrypts them on the way back. Backups and /my_data see plaintext, so an
+// export can be restored under a different keyring.
+type SecretBox struct {
+	Store
+	keys *Keyring
+}
+
+// NewSecretBox wraps st; a nil keyring returns st unchanged.
+func NewSecretBox(st Store, keys *Keyring) Store {
+	if keys == nil {
+		return st
+	}
+	return &SecretBox{Store: st, keys: keys}
+}
+
+var _ UserNotifier = (*SecretBox)(nil)
+
+// NotifyUserChanged forwards to the wrapped store, so a UserCache in front of
+// the box still reaches other replicas.
+func (b *SecretBox) NotifyUserChanged(ctx context.Context, id int64) error {
+	n, ok := b.Store.(UserNotifier)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return n.NotifyUserChanged(ctx, id)
+}
+
+// ListenUserChanges forwards to the wrapped store; without a UserNotifier it
+// returns errors.ErrUnsupported.
+func (b *SecretBox) ListenUserChanges(ctx context.Context, ready func(), fn func(id int64)) error {
+	n, ok := b.Store.(UserNotifier)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return n.ListenUserChanges(ctx, ready, fn)
+}
+
+func (b *SecretBox) PutTOTPSecret(ctx context.Context, telegramID int64, secret string) error {
+	sealed, err := b.keys.Seal(secret, totpAAD(telegramID))
+	if err != nil {
+		return err
+	}
+	return b.Store.PutTOTPSecret(ctx, telegramID, sealed)
+}
+
+func (b *SecretBox) GetTOTPSecret(ctx context.Context, telegramID int64) (TOTPSecret, error) {
+	t, err := b.Store.GetTOTPSecret(ctx, telegramID)
+	if err != nil {
+		return t, err
+	}
+	t.Secret, err = b.keys.Open(t.Secret, totpAAD(telegramID))
+	return t, err
+}
+
+func (b *SecretBox) ListTOTPSecrets(ctx context.Context, after int64, limit int) ([]TOTPSecret, error) {
+	list, err := b.Store.ListTOTPSecrets(ctx, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if list[i].Secret, err = b.keys.Open(list[i].Secret, totpAAD(list[i].TelegramID)); err != nil {
+			return nil, fmt.Errorf("totp secret of %d: %w", list[i].TelegramID, err)
+		}
+	}
+	return list, nil
+}
+
+func (b *SecretBox) UserData(ctx context.Context, id int64) (UserData, error) {
+	d, err := b.Store.UserData(ctx, id)
+	if err != nil || d.TOTP == nil {
+		return d, err
+	}
+	t := *d.TOTP
+	t.Secret, err = b.keys.Open(t.Secret, totpAAD(id))
+	d.TOTP = &t
+	return d, err
+}
+
+func (b *SecretBox) ExportData(ctx context.Context) (Dataset, error) {
+	d, err := b.Store.ExportData(ctx)
+	if err != nil {
+		return d, err
+	}
+	for i := range d.TOTPSecrets {
+		t := &d.TOTPSecrets[i]
+		if t.Secret, err = b.keys.Open(t.Secret, totpAAD(t.TelegramID)); err != nil {
+			return Dataset{}, fmt.Errorf("totp secret of %d: %w", t.TelegramID, err)
+		}
+	}
+	return d, nil
+}
+
+func (b *SecretBox) ImportData(ctx context.Context, d Dataset, replace bool) error {
+	secrets := make([]TOTPSecret, len(d.TOTPSecrets))
+	for i, t := range d.TOTPSecrets {
+		sealed, err := b.keys.Seal(t.Secret, totpAAD(t.TelegramID))
+		if err != nil {
+			return err
+		}
+		t.Secret = sealed
+		secrets[i] = t
+	}
+	d.TOTPSecrets = secrets
+	return b.Store.ImportData(ctx, d, replace)
+}
+
+// Reencrypt seals every secret that is plaintext or under an old key with the
+// primary key, batch rows at a time. A row changed concurrently is skipped: the
+// writer already sealed it with the primary key. It returns how many rows were
+// rewritten.
+func (b *SecretBox) Reencrypt(ctx context.Context, batch int) (int64, error) {
+	if batch <= 0 {
+		batch = 1000
+	}
+	var total int64
+	var after int64
+	for {
+		list, err := b.Store.ListTOTPSecrets(ctx, after, batch)
+		if err != nil {
+			return total, err
+		}
+		for _, t := range list {
+			after = t.TelegramID
+			if !b.keys.Stale(t.Secret) {
+				continue
+			}
+			plain, err := b.keys.Open(t.Secret, totpAAD(t.TelegramID))
+			if err != nil {
+				return total, fmt.Errorf("totp secret of %d: %w", t.TelegramID, err)
+			}
+			sealed, err := b.keys.Seal(plain, totpAAD(t.TelegramID))
+			if err != nil {
+				return total, err
+			}
+			ok, err := b.Store.SwapTOTPSecret(ctx, t.TelegramID, t.Secret, sealed)
+			if err != nil {
+				return total, err
+			}
+			if ok {
+				total++
+			}
+		}
+		if len(list) < batch || ctx.Err() != nil {
+			metrics.Add("secrets_reencrypted", total)
+			return total, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T, versions ...string) *Keyring {
+	t.Helper()
+	spec := make([]string, len(versions))
+	for i, v := range versions {
+		spec[i] = v + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(v, 32)))
+	}
+	k, err := ParseKeyring(strings.Join(spec, ","))
+	must(t, err)
+	return k
+}
+
+func TestKeyringOpen(t *testing.T) {
+	keys := testKeyring(t, "1")
+	sealed, err := keys.Seal("JBSWY3DPEHPK3PXP", totpAAD(1))
+	must(t, err)
+	if !strings.HasPrefix(sealed, sealedPrefix+"1:") || strings.Contains(sealed, "JBSWY3DPEHPK3PXP") {
+		t.Fatalf("sealed = %q", sealed)
+	}
+
+	// flip a byte of the ciphertext, keeping the encoding valid
+	i := strings.LastIndex(sealed, ":") + 1
+	ct, err := base64.RawStdEncoding.DecodeString(sealed[i:])
+	must(t, err)
+	ct[len(ct)-1] ^= 1
+	tampered := sealed[:i] + base64.RawStdEncoding.EncodeToString(ct)
+
+	tests := []struct {
+		name  string
+		keys  *Keyring
+		value string
+		aad   string
+		want  string
+		err   bool
+	}{
+		{"round trip", keys, sealed, totpAAD(1), "JBSWY3DPEHPK3PXP", false},
+		{"plaintext passes through", keys, "JBSWY3DPEHPK3PXP", totpAAD(1), "JBSWY3DPEHPK3PXP", false},
+		{"tampered ciphertext", keys, tampered, totpAAD(1), "", true},
+		{"another user's row", keys, sealed, totpAAD(2), "", true},
+		{"unknown key version", testKeyring(t, "2"), sealed, totpAAD(1), "", true},
+		{"malformed value", keys, sealedPrefix + "1:x", totpAAD(1), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.keys.Open(tt.value, tt.aad)
+			if tt.err {
+				if !errors.Is(err, ErrSecretKey) {
+					t.Fatalf("err = %v, want ErrSecretKey", err)
+				}
+				return
+			}
+			must(t, err)
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSecretBoxReencrypt rotates from key 1 to key 2: every plaintext or
+// old-key secret is resealed once, after which key 1 can be dropped.
+func TestSecretBoxReencrypt(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemory()
+	must(t, NewSecretBox(backend, testKeyring(t, "1")).PutTOTPSecret(ctx, 1, "SECRETONE"))
+	must(t, backend.PutTOTPSecret(ctx, 2, "SECRETTWO")) // written before encryption was enabled
+
+	rotated := NewSecretBox(backend, testKeyring(t, "1", "2")).(*SecretBox)
+	n, err := rotated.Reencrypt(ctx, 1)
+	must(t, err)
+	if n != 2 {
+		t.Fatalf("reencrypted %d, want 2", n)
+	}
+	if n, err = rotated.Reencrypt(ctx, 1); err != nil || n != 0 {
+		t.Fatalf("second run: %d, %v", n, err)
+	}
+
+	onlyNew := NewSecretBox(backend, testKeyring(t, "2"))
+	for id, want := range map[int64]string{1: "SECRETONE", 2: "SECRETTWO"} {
+		raw, err := backend.GetTOTPSecret(ctx, id)
+		must(t, err)
+		if !strings.HasPrefix(raw.Secret, sealedPrefix+"2:") {
+			t.Fatalf("row %d stored as %q", id, raw.Secret)
+		}
+		got, err := onlyNew.GetTOTPSecret(ctx, id)
+		must(t, err)
+		if got.Secret != want {
+			t.Fatalf("row %d = %q, want %q", id, got.Secret, want)
+		}
+	}
+}
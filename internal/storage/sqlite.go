@@ -0,0 +1,1146 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLite is the Store backed by an embedded SQLite database file.
+// Timestamps are stored as Unix microseconds, lists and metadata as JSON text.
+type SQLite struct {
+	localLocks
+	db *sql.DB
+}
+
+// NewSQLite opens the database at path (":memory:" for a throwaway one).
+// All access goes through a single connection, so writes are serialized the
+// same way row locks serialize them in Postgres.
+func NewSQLite(ctx context.Context, path string) (*SQLite, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("sqlite", path+sep+"_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLite{db: db}, nil
+}
+
+func (s *SQLite) Close() { _ = s.db.Close() }
+
+func (s *SQLite) Ping(ctx context.Context) error { return s.db.PingContext(ctx) }
+
+// Migrate applies all pending migrations.
+func (s *SQLite) Migrate(ctx context.Context) error {
+	_, err := s.MigrateUp(ctx, 0)
+	return err
+}
+
+func (s *SQLite) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	return migrationStatus(ctx, s, "sqlite")
+}
+
+func (s *SQLite) MigrateUp(ctx context.Context, steps int) (int, error) {
+	return migrate(ctx, s, "sqlite", true, steps)
+}
+
+func (s *SQLite) MigrateDown(ctx context.Context, steps int) (int, error) {
+	return migrate(ctx, s, "sqlite", false, steps)
+}
+
+// lockMigrations is a no-op: SQLite has a single writer, and runMigration
+// re-checks the version inside its write transaction.
+func (s *SQLite) lockMigrations(ctx context.Context) (func(), error) {
+	return func() {}, nil
+}
+
+func (s *SQLite) ensureMigrationsTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at INTEGER NOT NULL
+)`)
+	return err
+}
+
+func (s *SQLite) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[int]time.Time)
+	for rows.Next() {
+		var v int
+		var at int64
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		res[v] = fromMicros(at)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLite) runMigration(ctx context.Context, m Migration, up bool) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version=?)`, m.Version).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists == up {
+		return false, nil
+	}
+	script := m.Up
+	if !up {
+		script = m.Down
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return false, err
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`, m.Version, m.Name, micros(time.Now()))
+	} else {
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version=?`, m.Version)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func micros(t time.Time) int64 { return t.UnixMicro() }
+
+func nullMicros(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UnixMicro()
+}
+
+func fromMicros(v int64) time.Time { return time.UnixMicro(v) }
+
+func fromNullMicros(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.UnixMicro(v.Int64)
+	return &t
+}
+
+// jsonList is a []string kept as a JSON array.
+type jsonList []string
+
+func (l *jsonList) Scan(src any) error {
+	var b []byte
+	switch v := src.(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	case nil:
+		*l = jsonList{}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+func encodeList(v []string) string {
+	b, _ := json.Marshal(nonNil(v))
+	return string(b)
+}
+
+// Users
+
+func (s *SQLite) UpsertUser(ctx context.Context, user User) error {
+	now := micros(time.Now())
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO users (telegram_id, role, is_authed, created_at, updated_at)
+VALUES (?1, ?2, ?3, ?4, ?4)
+ON CONFLICT (telegram_id) DO UPDATE SET
+	role = excluded.role,
+	is_authed = excluded.is_authed,
+	updated_at = excluded.updated_at;
+`, user.ID, string(user.Role), user.IsAuthed, now)
+	return err
+}
+
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var u User
+	var created, updated int64
+	if err := row.Scan(&u.ID, &u.Role, &u.IsAuthed, &created, &updated); err != nil {
+		return User{}, err
+	}
+	u.CreatedAt, u.UpdatedAt = fromMicros(created), fromMicros(updated)
+	return u, nil
+}
+
+func (s *SQLite) GetUser(ctx context.Context, id int64) (User, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, `SELECT telegram_id, role, is_authed, created_at, updated_at FROM users WHERE telegram_id=?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	return u, err
+}
+
+func (s *SQLite) ListUsersByRole(ctx context.Context, role Role) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT telegram_id, role, is_authed, created_at, updated_at FROM users WHERE role=? ORDER BY telegram_id`, string(role))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, u)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLite) ListAuthedUserIDs(ctx context.Context) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT telegram_id FROM users WHERE is_authed`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLite) SetUserRole(ctx context.Context, id int64, role Role) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE users SET role=?2, updated_at=?3 WHERE telegram_id=?1`, id, string(role), micros(time.Now()))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLite) SetUserAuthed(ctx context.Context, id int64, authed bool) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE users SET is_authed=?2, updated_at=?3 WHERE telegram_id=?1`, id, authed, micros(time.Now()))
+	return err
+}
+
+// Profiles
+
+func scanSQLiteProfile(row interface{ Scan(...any) error }) (Profile, error) {
+	var p Profile
+	var seen, updated int64
+	err := row.Scan(&p.TelegramID, &p.Username, &p.FirstName, &p.LastName, &p.LanguageCode, &p.IsPremium, &seen, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Profile{}, ErrNotFound
+	}
+	p.LastSeenAt, p.UpdatedAt = fromMicros(seen), fromMicros(updated)
+	return p, err
+}
+
+func scanSQLiteProfileChange(row interface{ Scan(...any) error }) (ProfileChange, error) {
+	var c ProfileChange
+	var at int64
+	err := row.Scan(&c.TelegramID, &c.Field, &c.OldValue, &c.NewValue, &at)
+	c.ChangedAt = fromMicros(at)
+	return c, err
+}
+
+func (s *SQLite) TouchProfile(ctx context.Context, p Profile) ([]ProfileChange, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	now := time.Now()
+	var changes []ProfileChange
+	prev, err := scanSQLiteProfile(tx.QueryRowContext(ctx, `SELECT `+profileColumns+` FROM user_profiles WHERE telegram_id=?`, p.TelegramID))
+	switch {
+	case err == nil:
+		changes = profileChanges(prev, p, now)
+	case !errors.Is(err, ErrNotFound):
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO user_profiles (telegram_id, username, first_name, last_name, language_code, is_premium, last_seen_at, updated_at)
+VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?7)
+ON CONFLICT (telegram_id) DO UPDATE SET
+	username = excluded.username,
+	first_name = excluded.first_name,
+	last_name = excluded.last_name,
+	language_code = excluded.language_code,
+	is_premium = excluded.is_premium,
+	last_seen_at = excluded.last_seen_at,
+	updated_at = CASE WHEN ?8 THEN excluded.updated_at ELSE user_profiles.updated_at END`,
+		p.TelegramID, p.Username, p.FirstName, p.LastName, p.LanguageCode, p.IsPremium, micros(now), len(changes) > 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range changes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO user_profile_history (telegram_id, field, old_value, new_value, changed_at) VALUES (?, ?, ?, ?, ?)`,
+			c.TelegramID, c.Field, c.OldValue, c.NewValue, micros(c.ChangedAt)); err != nil {
+			return nil, err
+		}
+	}
+	return changes, tx.Commit()
+}
+
+func (s *SQLite) GetProfile(ctx context.Context, id int64) (Profile, error) {
+	return scanSQLiteProfile(s.db.QueryRowContext(ctx, `SELECT `+profileColumns+` FROM user_profiles WHERE telegram_id=?`, id))
+}
+
+func (s *SQLite) FindProfileByUsername(ctx context.Context, username string) (Profile, error) {
+	username = NormalizeUsername(username)
+	if username == "" {
+		return Profile{}, ErrNotFound
+	}
+	return scanSQLiteProfile(s.db.QueryRowContext(ctx, `SELECT `+profileColumns+` FROM user_profiles WHERE username <> '' AND username = ? COLLATE NOCASE ORDER BY last_seen_at DESC LIMIT 1`, username))
+}
+
+func (s *SQLite) ListProfileChanges(ctx context.Context, id int64, limit int) ([]ProfileChange, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT telegram_id, field, old_value, new_value, changed_at FROM user_profile_history WHERE telegram_id=? ORDER BY changed_at DESC, id DESC LIMIT ?`, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []ProfileChange
+	for rows.Next() {
+		c, err := scanSQLiteProfileChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, rows.Err()
+}
+
+// Roles
+
+func scanSQLiteRole(row interface{ Scan(...any) error }) (RoleDef, error) {
+	var r RoleDef
+	var pools, perms jsonList
+	var created, updated int64
+	err := row.Scan(&r.Name, &r.DisplayName, &r.RatePerMin, &r.TrafficQuotaMB, &r.MaxConnections, &pools, &perms, &r.Builtin, &created, &updated)
+	r.ProxyPools, r.Permissions = pools, perms
+	r.CreatedAt, r.UpdatedAt = fromMicros(created), fromMicros(updated)
+	return r, err
+}
+
+func (s *SQLite) ListRoles(ctx context.Context) ([]RoleDef, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+roleColumns+` FROM roles ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []RoleDef
+	for rows.Next() {
+		r, err := scanSQLiteRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLite) GetRole(ctx context.Context, name Role) (RoleDef, error) {
+	r, err := scanSQLiteRole(s.db.QueryRowContext(ctx, `SELECT `+roleColumns+` FROM roles WHERE name=?`, string(name)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return RoleDef{}, ErrNotFound
+	}
+	return r, err
+}
+
+func (s *SQLite) UpsertRole(ctx context.Context, r RoleDef) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO roles (name, display_name, rate_per_min, traffic_quota_mb, max_connections, proxy_pools, permissions, builtin, created_at, updated_at)
+VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?9)
+ON CONFLICT (name) DO UPDATE SET
+	display_name = excluded.display_name,
+	rate_per_min = excluded.rate_per_min,
+	traffic_quota_mb = excluded.traffic_quota_mb,
+	max_connections = excluded.max_connections,
+	proxy_pools = excluded.proxy_pools,
+	permissions = excluded.permissions,
+	updated_at = excluded.updated_at;
+`, string(r.Name), r.DisplayName, r.RatePerMin, r.TrafficQuotaMB, r.MaxConnections, encodeList(r.ProxyPools), encodeList(r.Permissions), r.Builtin, micros(time.Now()))
+	return err
+}
+
+func (s *SQLite) SeedRole(ctx context.Context, r RoleDef) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO roles (name, display_name, rate_per_min, traffic_quota_mb, max_connections, proxy_pools, permissions, builtin, created_at, updated_at)
+VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?9)
+ON CONFLICT (name) DO UPDATE SET rate_per_min = excluded.rate_per_min, updated_at = excluded.updated_at
+WHERE roles.builtin AND roles.rate_per_min <> excluded.rate_per_min;
+`, string(r.Name), r.DisplayName, r.RatePerMin, r.TrafficQuotaMB, r.MaxConnections, encodeList(r.ProxyPools), encodeList(r.Permissions), r.Builtin, micros(time.Now()))
+	return err
+}
+
+func (s *SQLite) DeleteRole(ctx context.Context, name, fallback Role, actor int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	res, err := tx.ExecContext(ctx, `DELETE FROM roles WHERE name=? AND NOT builtin`, string(name))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	res, err = tx.ExecContext(ctx, `UPDATE users SET role=?2, updated_at=?3 WHERE role=?1`, string(name), string(fallback), micros(time.Now()))
+	if err != nil {
+		return err
+	}
+	moved, _ := res.RowsAffected()
+	if err := insertSQLiteAudit(ctx, tx, AuditEvent{Actor: &actor, Action: "role.delete", Metadata: map[string]any{
+		"role": string(name), "fallback": string(fallback), "users_moved": moved,
+	}}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) ReassignUnknownRoles(ctx context.Context, fallback Role) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE users SET role=?1, updated_at=?2 WHERE role NOT IN (SELECT name FROM roles)`, string(fallback), micros(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Tokens
+
+func (s *SQLite) CreateToken(ctx context.Context, token string, role Role, expiresAt *time.Time, issuedBy int64, issuedTo *int64) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO tokens (token, role, expires_at, issued_by, issued_to, created_at) VALUES (?,?,?,?,?,?)`,
+		token, string(role), nullMicros(expiresAt), issuedBy, issuedTo, micros(time.Now()))
+	var sqlErr *sqlite.Error
+	if errors.As(err, &sqlErr) && sqlErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *SQLite) RevokeTokensIssuedBy(ctx context.Context, issuedBy int64) (int64, error) {
+	now := micros(time.Now())
+	res, err := s.db.ExecContext(ctx, `UPDATE tokens SET expires_at=?2 WHERE issued_by=?1 AND consumed_at IS NULL AND (expires_at IS NULL OR expires_at > ?2)`, issuedBy, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ConsumeToken marks the token used with a single conditional UPDATE, so two
+// users racing for the same token cannot both get it.
+func (s *SQLite) ConsumeToken(ctx context.Context, token string, consumeBy int64) (Role, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var role Role
+	err = tx.QueryRowContext(ctx, `
+UPDATE tokens SET consumed_at=?3, issued_to=?2
+WHERE token=?1 AND consumed_at IS NULL AND (expires_at IS NULL OR expires_at >= ?3)
+RETURNING role`, token, consumeBy, micros(time.Now())).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := insertSQLiteAudit(ctx, tx, AuditEvent{Actor: &consumeBy, Target: &consumeBy, Action: "token.consume", Metadata: map[string]any{"role": string(role)}}); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// Privacy
+
+func (s *SQLite) UserData(ctx context.Context, id int64) (UserData, error) {
+	var d UserData
+	if u, err := s.GetUser(ctx, id); err == nil {
+		d.User = &u
+	} else if !errors.Is(err, ErrNotFound) {
+		return UserData{}, err
+	}
+	if t, err := s.GetTOTPSecret(ctx, id); err == nil {
+		d.TOTP = &t
+	} else if !errors.Is(err, ErrNotFound) {
+		return UserData{}, err
+	}
+	if p, err := s.GetProfile(ctx, id); err == nil {
+		d.Profile = &p
+	} else if !errors.Is(err, ErrNotFound) {
+		return UserData{}, err
+	}
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return UserData{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	each := func(query string, fn func(*sql.Rows) error) error {
+		rows, err := tx.QueryContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := fn(rows); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+	err = each(`SELECT telegram_id, reason, banned_by, expires_at, created_at FROM bans WHERE telegram_id=?`, func(rows *sql.Rows) error {
+		var b Ban
+		var expires sql.NullInt64
+		var created int64
+		err := rows.Scan(&b.TelegramID, &b.Reason, &b.BannedBy, &expires, &created)
+		b.ExpiresAt, b.CreatedAt = fromNullMicros(expires), fromMicros(created)
+		d.Ban = &b
+		return err
+	})
+	if err == nil {
+		err = each(`SELECT telegram_id, field, old_value, new_value, changed_at FROM user_profile_history WHERE telegram_id=? ORDER BY changed_at, id`, func(rows *sql.Rows) error {
+			c, err := scanSQLiteProfileChange(rows)
+			d.ProfileChanges = append(d.ProfileChanges, c)
+			return err
+		})
+	}
+	if err == nil {
+		err = each(`SELECT `+accessRequestColumns+` FROM access_requests WHERE telegram_id=? ORDER BY created_at`, func(rows *sql.Rows) error {
+			r, err := scanSQLiteAccessRequest(rows)
+			d.AccessRequests = append(d.AccessRequests, r)
+			return err
+		})
+	}
+	if err == nil {
+		err = each(`SELECT kind, created_at FROM rate_events WHERE telegram_id=? ORDER BY created_at`, func(rows *sql.Rows) error {
+			var e RateEvent
+			var created int64
+			err := rows.Scan(&e.Kind, &created)
+			e.CreatedAt = fromMicros(created)
+			d.RateEvents = append(d.RateEvents, e)
+			return err
+		})
+	}
+	if err == nil {
+		err = each(`SELECT token, role, expires_at, consumed_at, COALESCE(issued_by, 0), issued_to, created_at FROM tokens WHERE issued_by=?1 OR issued_to=?1 ORDER BY created_at`, func(rows *sql.Rows) error {
+			var t Token
+			var expires, consumed sql.NullInt64
+			var created int64
+			err := rows.Scan(&t.Token, &t.Role, &expires, &consumed, &t.IssuedBy, &t.IssuedTo, &created)
+			t.ExpiresAt, t.ConsumedAt, t.CreatedAt = fromNullMicros(expires), fromNullMicros(consumed), fromMicros(created)
+			d.Tokens = append(d.Tokens, t)
+			return err
+		})
+	}
+	if err == nil {
+		err = each(`SELECT id, actor, target, action, metadata, created_at FROM audit_events WHERE actor=?1 OR target=?1 ORDER BY created_at, id`, func(rows *sql.Rows) error {
+			var ev AuditEvent
+			var meta string
+			var created int64
+			if err := rows.Scan(&ev.ID, &ev.Actor, &ev.Target, &ev.Action, &meta, &created); err != nil {
+				return err
+			}
+			ev.CreatedAt = fromMicros(created)
+			err := json.Unmarshal([]byte(meta), &ev.Metadata)
+			d.AuditEvents = append(d.AuditEvents, ev)
+			return err
+		})
+	}
+	if err != nil {
+		return UserData{}, err
+	}
+	return d, nil
+}
+
+func (s *SQLite) ForgetUser(ctx context.Context, id int64, policy AuditPolicy) (ForgetResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ForgetResult{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var res ForgetResult
+	var users int64
+	steps := []forgetStep{
+		{&users, `DELETE FROM users WHERE telegram_id=?1`},
+		{&res.Profile, `DELETE FROM user_profiles WHERE telegram_id=?1`},
+		{&res.Profile, `DELETE FROM user_profile_history WHERE telegram_id=?1`},
+		{&res.RateEvents, `DELETE FROM rate_events WHERE telegram_id=?1`},
+		{&res.RateEvents, `DELETE FROM rate_buckets WHERE telegram_id=?1`},
+		{&res.Credentials, `DELETE FROM totp_secrets WHERE telegram_id=?1`},
+		{&res.AccessRequests, `DELETE FROM access_requests WHERE telegram_id=?1`},
+		{nil, `UPDATE tokens SET expires_at=?2 WHERE issued_by=?1 AND consumed_at IS NULL AND (expires_at IS NULL OR expires_at > ?2)`},
+		{&res.Tokens, `UPDATE tokens SET issued_by=NULL WHERE issued_by=?1`},
+		{&res.Tokens, `UPDATE tokens SET issued_to=NULL WHERE issued_to=?1`},
+	}
+	switch policy {
+	case AuditDelete:
+		steps = append(steps, forgetStep{&res.AuditEvents, `DELETE FROM audit_events WHERE actor=?1 OR target=?1`})
+	case AuditAnonymize:
+		steps = append(steps, forgetStep{&res.AuditEvents, `UPDATE audit_events SET actor = NULLIF(actor, ?1), target = NULLIF(target, ?1) WHERE actor=?1 OR target=?1`})
+	}
+	now := micros(time.Now())
+	for _, st := range steps {
+		r, err := tx.ExecContext(ctx, st.sql, id, now)
+		if err != nil {
+			return ForgetResult{}, err
+		}
+		if st.dst != nil {
+			n, _ := r.RowsAffected()
+			*st.dst += n
+		}
+	}
+	res.User = users > 0
+	return res, tx.Commit()
+}
+
+// Settings
+
+func (s *SQLite) GetSetting(ctx context.Context, key string) (string, error) {
+	var v string
+	err := s.db.QueryRowContext(ctx, `SELECT value FROM settings WHERE key=?`, key).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return v, err
+}
+
+func (s *SQLite) PutSetting(ctx context.Context, key, value string) error {
+	return putSQLiteSetting(ctx, s.db, key, value)
+}
+
+func putSQLiteSetting(ctx context.Context, db sqlExecer, key, value string) error {
+	_, err := db.ExecContext(ctx, `
+INSERT INTO settings (key, value, updated_at) VALUES (?1, ?2, ?3)
+ON CONFLICT (key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`, key, value, micros(time.Now()))
+	return err
+}
+
+// Backup
+
+func (s *SQLite) ExportData(ctx context.Context) (Dataset, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return Dataset{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	d := Dataset{Settings: make(map[string]string)}
+
+	err = sqliteEach(ctx, tx, `SELECT telegram_id, role, is_authed, created_at, updated_at FROM users ORDER BY telegram_id`, func(rows *sql.Rows) error {
+		u, err := scanUser(rows)
+		d.Users = append(d.Users, u)
+		return err
+	})
+	if err == nil {
+		err = sqliteEach(ctx, tx, `SELECT `+roleColumns+` FROM roles ORDER BY name`, func(rows *sql.Rows) error {
+			r, err := scanSQLiteRole(rows)
+			d.Roles = append(d.Roles, r)
+			return err
+		})
+	}
+	if err == nil {
+		err = sqliteEach(ctx, tx, `SELECT token, role, expires_at, consumed_at, COALESCE(issued_by, 0), issued_to, created_at FROM tokens ORDER BY created_at`, func(rows *sql.Rows) error {
+			var t Token
+			var expires, consumed sql.NullInt64
+			var created int64
+			err := rows.Scan(&t.Token, &t.Role, &expires, &consumed, &t.IssuedBy, &t.IssuedTo, &created)
+			t.ExpiresAt, t.ConsumedAt, t.CreatedAt = fromNullMicros(expires), fromNullMicros(consumed), fromMicros(created)
+			d.Tokens = append(d.Tokens, t)
+			return err
+		})
+	}
+	if err == nil {
+		err = sqliteEach(ctx, tx, `SELECT telegram_id, secret, confirmed, last_used_step, created_at FROM totp_secrets ORDER BY telegram_id`, func(rows *sql.Rows) error {
+			var t TOTPSecret
+			var created int64
+			err := rows.Scan(&t.TelegramID, &t.Secret, &t.Confirmed, &t.LastUsedStep, &created)
+			t.CreatedAt = fromMicros(created)
+			d.TOTPSecrets = append(d.TOTPSecrets, t)
+			return err
+		})
+	}
+	if err == nil {
+		err = sqliteEach(ctx, tx, `SELECT telegram_id, reason, banned_by, expires_at, created_at FROM bans ORDER BY telegram_id`, func(rows *sql.Rows) error {
+			var b Ban
+			var expires sql.NullInt64
+			var created int64
+			err := rows.Scan(&b.TelegramID, &b.Reason, &b.BannedBy, &expires, &created)
+			b.ExpiresAt, b.CreatedAt = fromNullMicros(expires), fromMicros(created)
+			d.Bans = append(d.Bans, b)
+			return err
+		})
+	}
+	if err == nil {
+		err = sqliteEach(ctx, tx, `SELECT key, value FROM settings`, func(rows *sql.Rows) error {
+			var k, v string
+			err := rows.Scan(&k, &v)
+			d.Settings[k] = v
+			return err
+		})
+	}
+	if err != nil {
+		return Dataset{}, err
+	}
+	return d, nil
+}
+
+func sqliteEach(ctx context.Context, tx *sql.Tx, query string, fn func(*sql.Rows) error) error {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLite) ImportData(ctx context.Context, d Dataset, replace bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if replace {
+		for _, t := range backupTables {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM `+t); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range d.Roles {
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO roles (name, display_name, rate_per_min, traffic_quota_mb, max_connections, proxy_pools, permissions, builtin, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (name) DO UPDATE SET
+	display_name = excluded.display_name, rate_per_min = excluded.rate_per_min,
+	traffic_quota_mb = excluded.traffic_quota_mb, max_connections = excluded.max_connections,
+	proxy_pools = excluded.proxy_pools, permissions = excluded.permissions,
+	builtin = excluded.builtin, created_at = excluded.created_at, updated_at = excluded.updated_at`,
+			string(r.Name), r.DisplayName, r.RatePerMin, r.TrafficQuotaMB, r.MaxConnections, encodeList(r.ProxyPools), encodeList(r.Permissions), r.Builtin, micros(r.CreatedAt), micros(r.UpdatedAt)); err != nil {
+			return err
+		}
+	}
+	for _, u := range d.Users {
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO users (telegram_id, role, is_authed, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (telegram_id) DO UPDATE SET
+	role = excluded.role, is_authed = excluded.is_authed, created_at = excluded.created_at, updated_at = excluded.updated_at`,
+			u.ID, string(u.Role), u.IsAuthed, micros(u.CreatedAt), micros(u.UpdatedAt)); err != nil {
+			return err
+		}
+	}
+	for _, t := range d.Tokens {
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO tokens (token, role, expires_at, consumed_at, issued_by, issued_to, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (token) DO UPDATE SET
+	role = excluded.role, expires_at = excluded.expires_at, consumed_at = excluded.consumed_at,
+	issued_by = excluded.issued_by, issued_to = excluded.issued_to, created_at = excluded.created_at`,
+			t.Token, string(t.Role), nullMicros(t.ExpiresAt), nullMicros(t.ConsumedAt), t.IssuedBy, t.IssuedTo, micros(t.CreatedAt)); err != nil {
+			return err
+		}
+	}
+	for _, t := range d.TOTPSecrets {
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO totp_secrets (telegram_id, secret, confirmed, last_used_step, created_at) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (telegram_id) DO UPDATE SET
+	secret = excluded.secret, confirmed = excluded.confirmed, last_used_step = excluded.last_used_step, created_at = excluded.created_at`,
+			t.TelegramID, t.Secret, t.Confirmed, t.LastUsedStep, micros(t.CreatedAt)); err != nil {
+			return err
+		}
+	}
+	for _, b := range d.Bans {
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO bans (telegram_id, reason, banned_by, expires_at, created_at) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (telegram_id) DO UPDATE SET
+	reason = excluded.reason, banned_by = excluded.banned_by, expires_at = excluded.expires_at, created_at = excluded.created_at`,
+			b.TelegramID, b.Reason, b.BannedBy, nullMicros(b.ExpiresAt), micros(b.CreatedAt)); err != nil {
+			return err
+		}
+	}
+	for k, v := range d.Settings {
+		if err := putSQLiteSetting(ctx, tx, k, v); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Updates
+
+func (s *SQLite) ClaimUpdate(ctx context.Context, updateID int64, handler string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT INTO processed_updates (update_id, handler, processed_at) VALUES (?, ?, ?) ON CONFLICT (update_id) DO NOTHING`, updateID, handler, micros(time.Now()))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Retention
+
+func (s *SQLite) PurgeRateEvents(ctx context.Context, before time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM rate_events WHERE id IN (SELECT id FROM rate_events WHERE created_at < ? ORDER BY id LIMIT ?)`, micros(before), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLite) PurgeTokens(ctx context.Context, before time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+DELETE FROM tokens WHERE token IN (
+	SELECT token FROM tokens
+	WHERE consumed_at < ?1 OR (consumed_at IS NULL AND expires_at < ?1)
+	LIMIT ?2
+)`, micros(before), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLite) PurgeProcessedUpdates(ctx context.Context, before time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM processed_updates WHERE update_id IN (SELECT update_id FROM processed_updates WHERE processed_at < ? LIMIT ?)`, micros(before), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLite) PurgeRateBuckets(ctx context.Context, before time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM rate_buckets WHERE rowid IN (SELECT rowid FROM rate_buckets WHERE tat < ? LIMIT ?)`, micros(before), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Rate events
+
+func (s *SQLite) InsertRateEvent(ctx context.Context, telegramID int64, kind string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO rate_events (telegram_id, kind, created_at) VALUES (?, ?, ?)`, telegramID, kind, micros(time.Now()))
+	return err
+}
+
+func (s *SQLite) CountEventsSince(ctx context.Context, telegramID int64, since time.Time) (int, error) {
+	var cnt int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM rate_events WHERE telegram_id=? AND created_at >= ?`, telegramID, micros(since)).Scan(&cnt)
+	return cnt, err
+}
+
+// RecordRateEvent checks and inserts in one statement; SQLite runs statements
+// one at a time, so it cannot interleave with another request.
+func (s *SQLite) RecordRateEvent(ctx context.Context, telegramID int64, kind string, since time.Time, limit int) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+INSERT INTO rate_events (telegram_id, kind, created_at)
+SELECT ?1, ?2, ?3
+WHERE ?5 <= 0 OR (SELECT COUNT(*) FROM rate_events WHERE telegram_id=?1 AND created_at >= ?4) < ?5`,
+		telegramID, kind, micros(time.Now()), micros(since), limit)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Rate buckets
+
+func (s *SQLite) TakeRateToken(ctx context.Context, telegramID int64, kind string, interval time.Duration, burst int) (bool, time.Duration, error) {
+	tolerance := interval * time.Duration(burst-1)
+	now := micros(time.Now())
+	var tat int64
+	err := s.db.QueryRowContext(ctx, `
+INSERT INTO rate_buckets (telegram_id, kind, tat) VALUES (?1, ?2, ?3 + ?4)
+ON CONFLICT (telegram_id, kind) DO UPDATE SET tat = max(tat, ?3) + ?4
+WHERE tat - ?5 <= ?3
+RETURNING tat`, telegramID, kind, now, interval.Microseconds(), tolerance.Microseconds()).Scan(&tat)
+	if err == nil {
+		return true, 0, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, 0, err
+	}
+	if err := s.db.QueryRowContext(ctx, `SELECT tat FROM rate_buckets WHERE telegram_id=? AND kind=?`, telegramID, kind).Scan(&tat); err != nil {
+		return false, 0, err
+	}
+	return false, max(time.Duration(tat-now)*time.Microsecond-tolerance, 0), nil
+}
+
+// Access requests
+
+func scanSQLiteAccessRequest(row interface{ Scan(...any) error }) (AccessRequest, error) {
+	var r AccessRequest
+	var decidedAt sql.NullInt64
+	var created int64
+	err := row.Scan(&r.ID, &r.TelegramID, &r.Username, &r.FirstName, &r.LastName, &r.LanguageCode, &r.Message, &r.Status, &r.Role, &r.DecidedBy, &decidedAt, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AccessRequest{}, ErrNotFound
+	}
+	r.DecidedAt, r.CreatedAt = fromNullMicros(decidedAt), fromMicros(created)
+	return r, err
+}
+
+func (s *SQLite) CreateAccessRequest(ctx context.Context, r AccessRequest) (AccessRequest, bool, error) {
+	res, err := scanSQLiteAccessRequest(s.db.QueryRowContext(ctx, `
+INSERT INTO access_requests (telegram_id, username, first_name, last_name, language_code, message, created_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (telegram_id) WHERE status = 'pending' DO NOTHING
+RETURNING `+accessRequestColumns, r.TelegramID, r.Username, r.FirstName, r.LastName, r.LanguageCode, r.Message, micros(time.Now())))
+	if err == nil {
+		return res, true, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return AccessRequest{}, false, err
+	}
+	res, err = scanSQLiteAccessRequest(s.db.QueryRowContext(ctx, `
+UPDATE access_requests SET
+	username = ?2, first_name = ?3, last_name = ?4, language_code = ?5,
+	message = CASE WHEN ?6 = '' THEN message ELSE ?6 END
+WHERE telegram_id = ?1 AND status = 'pending'
+RETURNING `+accessRequestColumns, r.TelegramID, r.Username, r.FirstName, r.LastName, r.LanguageCode, r.Message))
+	return res, false, err
+}
+
+func (s *SQLite) GetAccessRequest(ctx context.Context, id int64) (AccessRequest, error) {
+	return scanSQLiteAccessRequest(s.db.QueryRowContext(ctx, `SELECT `+accessRequestColumns+` FROM access_requests WHERE id=?`, id))
+}
+
+func (s *SQLite) ListPendingAccessRequests(ctx context.Context) ([]AccessRequest, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+accessRequestColumns+` FROM access_requests WHERE status='pending' ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []AccessRequest
+	for rows.Next() {
+		r, err := scanSQLiteAccessRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLite) DecideAccessRequest(ctx context.Context, id int64, status AccessRequestStatus, role Role, decidedBy int64) (AccessRequest, error) {
+	return scanSQLiteAccessRequest(s.db.QueryRowContext(ctx, `
+UPDATE access_requests SET status=?2, role=?3, decided_by=?4, decided_at=?5
+WHERE id=?1 AND status='pending'
+RETURNING `+accessRequestColumns, id, string(status), string(role), decidedBy, micros(time.Now())))
+}
+
+func (s *SQLite) LastAccessDecision(ctx context.Context, telegramID int64) (AccessRequest, error) {
+	return scanSQLiteAccessRequest(s.db.QueryRowContext(ctx, `
+SELECT `+accessRequestColumns+` FROM access_requests
+WHERE telegram_id=? AND status<>'pending'
+ORDER BY decided_at DESC LIMIT 1`, telegramID))
+}
+
+// Bans
+
+func (s *SQLite) UpsertBan(ctx context.Context, b Ban) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO bans (telegram_id, reason, banned_by, expires_at, created_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (telegram_id) DO UPDATE SET
+	reason = excluded.reason,
+	banned_by = excluded.banned_by,
+	expires_at = excluded.expires_at,
+	created_at = excluded.created_at;
+`, b.TelegramID, b.Reason, b.BannedBy, nullMicros(b.ExpiresAt), micros(time.Now()))
+	return err
+}
+
+func (s *SQLite) DeleteBan(ctx context.Context, telegramID int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM bans WHERE telegram_id=?`, telegramID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLite) ListActiveBans(ctx context.Context) ([]Ban, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT telegram_id, reason, banned_by, expires_at, created_at FROM bans WHERE expires_at IS NULL OR expires_at > ? ORDER BY created_at`, micros(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []Ban
+	for rows.Next() {
+		var b Ban
+		var expires sql.NullInt64
+		var created int64
+		if err := rows.Scan(&b.TelegramID, &b.Reason, &b.BannedBy, &expires, &created); err != nil {
+			return nil, err
+		}
+		b.ExpiresAt, b.CreatedAt = fromNullMicros(expires), fromMicros(created)
+		res = append(res, b)
+	}
+	return res, rows.Err()
+}
+
+// TOTP
+
+func (s *SQLite) PutTOTPSecret(ctx context.Context, telegramID int64, secret string) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO totp_secrets (telegram_id, secret, created_at) VALUES (?1, ?2, ?3)
+ON CONFLICT (telegram_id) DO UPDATE SET secret = excluded.secret, confirmed = 0, last_used_step = 0, created_at = excluded.created_at;
+`, telegramID, secret, micros(time.Now()))
+	return err
+}
+
+func (s *SQLite) GetTOTPSecret(ctx context.Context, telegramID int64) (TOTPSecret, error) {
+	var t TOTPSecret
+	var created int64
+	err := s.db.QueryRowContext(ctx, `SELECT telegram_id, secret, confirmed, last_used_step, created_at FROM totp_secrets WHERE telegram_id=?`, telegramID).
+		Scan(&t.TelegramID, &t.Secret, &t.Confirmed, &t.LastUsedStep, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TOTPSecret{}, ErrNotFound
+	}
+	t.CreatedAt = fromMicros(created)
+	return t, err
+}
+
+func (s *SQLite) UseTOTPStep(ctx context.Context, telegramID, step int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE totp_secrets SET last_used_step=?2, confirmed=1 WHERE telegram_id=?1 AND last_used_step < ?2`, telegramID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *SQLite) DeleteTOTPSecret(ctx context.Context, telegramID int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM totp_secrets WHERE telegram_id=?`, telegramID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLite) ListTOTPSecrets(ctx context.Context, after int64, limit int) ([]TOTPSecret, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT telegram_id, secret, confirmed, last_used_step, created_at FROM totp_secrets WHERE telegram_id > ? ORDER BY telegram_id LIMIT ?`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []TOTPSecret
+	for rows.Next() {
+		var t TOTPSecret
+		var created int64
+		if err := rows.Scan(&t.TelegramID, &t.Secret, &t.Confirmed, &t.LastUsedStep, &created); err != nil {
+			return nil, err
+		}
+		t.CreatedAt = fromMicros(created)
+		res = append(res, t)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLite) SwapTOTPSecret(ctx context.Context, telegramID int64, old, secret string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE totp_secrets SET secret=?3 WHERE telegram_id=?1 AND secret=?2`, telegramID, old, secret)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Audit
+
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func insertSQLiteAudit(ctx context.Context, db sqlExecer, ev AuditEvent) error {
+	meta := ev.Metadata
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO audit_events (actor, target, action, metadata, created_at) VALUES (?, ?, ?, ?, ?)`,
+		ev.Actor, ev.Target, ev.Action, string(b), micros(time.Now()))
+	return err
+}
+
+func (s *SQLite) InsertAuditEvent(ctx context.Context, ev AuditEvent) error {
+	return insertSQLiteAudit(ctx, s.db, ev)
+}
+
+func (s *SQLite) ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	if f.Limit <= 0 {
+		f.Limit = 20
+	}
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, actor, target, action, metadata, created_at FROM audit_events
+WHERE (?1 IS NULL OR actor = ?1 OR target = ?1)
+  AND (?2 = '' OR action = ?2)
+ORDER BY created_at DESC, id DESC
+LIMIT ?3 OFFSET ?4`, f.UserID, f.Action, f.Limit, f.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []AuditEvent
+	for rows.Next() {
+		var ev AuditEvent
+		var meta string
+		var created int64
+		if err := rows.Scan(&ev.ID, &ev.Actor, &ev.Target, &ev.Action, &meta, &created); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(meta), &ev.Metadata); err != nil {
+			return nil, err
+		}
+		ev.CreatedAt = fromMicros(created)
+		res = append(res, ev)
+	}
+	return res, rows.Err()
+}
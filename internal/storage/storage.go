@@ -0,0 +1,424 @@
+// Package storage defines the persistence API used by the bot and its backends.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("already exists")
+)
+
+type Role string
+
+const (
+	RoleFree    Role = "free"
+	RolePremium Role = "premium"
+	RoleAdmin   Role = "admin"
+)
+
+type User struct {
+	ID        int64
+	Role      Role
+	IsAuthed  bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Profile is the Telegram account data last seen for a user. It is kept apart
+// from User, so recording it neither creates a user row nor pins a role.
+type Profile struct {
+	TelegramID   int64
+	Username     string // without the leading @
+	FirstName    string
+	LastName     string
+	LanguageCode string
+	IsPremium    bool
+	LastSeenAt   time.Time
+	UpdatedAt    time.Time // when a field last changed
+}
+
+// ProfileChange is one profile field that changed between two sightings.
+type ProfileChange struct {
+	TelegramID int64
+	Field      string
+	OldValue   string
+	NewValue   string
+	ChangedAt  time.Time
+}
+
+// NormalizeUsername strips surrounding spaces and the leading @.
+func NormalizeUsername(v string) string {
+	return strings.TrimPrefix(strings.TrimSpace(v), "@")
+}
+
+// profileChanges lists the fields that differ between prev and p.
+func profileChanges(prev, p Profile, at time.Time) []ProfileChange {
+	var res []ProfileChange
+	add := func(field, old, new string) {
+		if old != new {
+			res = append(res, ProfileChange{TelegramID: p.TelegramID, Field: field, OldValue: old, NewValue: new, ChangedAt: at})
+		}
+	}
+	add("username", prev.Username, p.Username)
+	add("first_name", prev.FirstName, p.FirstName)
+	add("last_name", prev.LastName, p.LastName)
+	add("language_code", prev.LanguageCode, p.LanguageCode)
+	add("is_premium", strconv.FormatBool(prev.IsPremium), strconv.FormatBool(p.IsPremium))
+	return res
+}
+
+// RoleDef describes a role and the attributes granted to its users.
+// Empty ProxyPools means all pools are allowed; zero limits mean unlimited.
+// TrafficQuotaMB and MaxConnections are advisory: they are stored and shown for
+// the proxy operator, but the bot has no way to enforce them.
+type RoleDef struct {
+	Name           Role
+	DisplayName    string
+	RatePerMin     int
+	TrafficQuotaMB int64
+	MaxConnections int
+	ProxyPools     []string
+	Permissions    []string
+	Builtin        bool
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+type AccessRequestStatus string
+
+const (
+	AccessPending  AccessRequestStatus = "pending"
+	AccessApproved AccessRequestStatus = "approved"
+	AccessDenied   AccessRequestStatus = "denied"
+)
+
+// AccessRequest is a request from an unknown user to get access to the bot.
+type AccessRequest struct {
+	ID           int64
+	TelegramID   int64
+	Username     string
+	FirstName    string
+	LastName     string
+	LanguageCode string
+	Message      string
+	Status       AccessRequestStatus
+	Role         Role
+	DecidedBy    *int64
+	DecidedAt    *time.Time
+	CreatedAt    time.Time
+}
+
+// Ban cuts a user off until ExpiresAt (nil means permanent).
+type Ban struct {
+	TelegramID int64
+	Reason     string
+	BannedBy   int64
+	ExpiresAt  *time.Time
+	CreatedAt  time.Time
+}
+
+// Active reports whether the ban is still in effect at now.
+func (b Ban) Active(now time.Time) bool {
+	return b.ExpiresAt == nil || now.Before(*b.ExpiresAt)
+}
+
+// AuditEvent is a security-relevant event. Actor and Target are Telegram IDs; nil means system/none.
+type AuditEvent struct {
+	ID        int64
+	Actor     *int64
+	Target    *int64
+	Action    string
+	Metadata  map[string]any
+	CreatedAt time.Time
+}
+
+// AuditFilter selects audit events. UserID matches either actor or target.
+type AuditFilter struct {
+	UserID *int64
+	Action string
+	Limit  int
+	Offset int
+}
+
+// TOTPSecret is a second-factor enrollment. Unconfirmed secrets are not enforced yet.
+type TOTPSecret struct {
+	TelegramID   int64
+	Secret       string
+	Confirmed    bool
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+// Token is a one-time invite token row.
+type Token struct {
+	Token      string
+	Role       Role
+	ExpiresAt  *time.Time
+	ConsumedAt *time.Time
+	IssuedBy   int64
+	IssuedTo   *int64
+	CreatedAt  time.Time
+}
+
+// Dataset is everything a backup carries: users, roles, tokens, credentials, bans and settings.
+type Dataset struct {
+	Users       []User
+	Roles       []RoleDef
+	Tokens      []Token
+	TOTPSecrets []TOTPSecret
+	Bans        []Ban
+	Settings    map[string]string
+}
+
+// RateEvent is a recorded request counted by the rate limiter.
+type RateEvent struct {
+	Kind      string
+	CreatedAt time.Time
+}
+
+// UserData is everything stored about one user, for a data export.
+type UserData struct {
+	User           *User
+	Profile        *Profile
+	ProfileChanges []ProfileChange
+	AccessRequests []AccessRequest
+	RateEvents     []RateEvent
+	TOTP           *TOTPSecret
+	Ban            *Ban
+	Tokens         []Token // issued by or to the user
+	AuditEvents    []AuditEvent
+}
+
+// AuditPolicy says what ForgetUser does with audit events referencing the user.
+type AuditPolicy string
+
+const (
+	AuditAnonymize AuditPolicy = "anonymize" // keep events, clear the user's ID from actor/target
+	AuditDelete    AuditPolicy = "delete"    // delete events where the user is actor or target
+	AuditKeep      AuditPolicy = "keep"      // leave the audit log untouched
+)
+
+// ForgetResult counts what ForgetUser removed or anonymized.
+type ForgetResult struct {
+	User           bool
+	Profile        int64 // profile and history rows
+	RateEvents     int64
+	Credentials    int64
+	AccessRequests int64
+	Tokens         int64
+	AuditEvents    int64
+}
+
+// UserRepo stores bot users.
+type UserRepo interface {
+	UpsertUser(ctx context.Context, user User) error
+	GetUser(ctx context.Context, id int64) (User, error)
+	ListUsersByRole(ctx context.Context, role Role) ([]User, error)
+	ListAuthedUserIDs(ctx context.Context) ([]int64, error)
+	SetUserRole(ctx context.Context, id int64, role Role) error
+	SetUserAuthed(ctx context.Context, id int64, authed bool) error
+}
+
+// RoleRepo stores role definitions.
+type RoleRepo interface {
+	ListRoles(ctx context.Context) ([]RoleDef, error)
+	GetRole(ctx context.Context, name Role) (RoleDef, error)
+	UpsertRole(ctx context.Context, r RoleDef) error
+	// SeedRole inserts the role if it is missing. An existing builtin role only gets
+	// its rate limit refreshed, which comes from configuration; other operator edits
+	// are kept.
+	SeedRole(ctx context.Context, r RoleDef) error
+	DeleteRole(ctx context.Context, name, fallback Role, actor int64) error
+	ReassignUnknownRoles(ctx context.Context, fallback Role) (int64, error)
+}
+
+// TokenRepo stores one-time invite tokens.
+type TokenRepo interface {
+	CreateToken(ctx context.Context, token string, role Role, expiresAt *time.Time, issuedBy int64, issuedTo *int64) error
+	ConsumeToken(ctx context.Context, token string, consumeBy int64) (Role, error)
+	RevokeTokensIssuedBy(ctx context.Context, issuedBy int64) (int64, error)
+}
+
+// ProfileRepo stores Telegram profiles and their change history.
+type ProfileRepo interface {
+	// TouchProfile saves p with LastSeenAt set to now and records the fields that
+	// changed since the previous sighting, which it also returns.
+	TouchProfile(ctx context.Context, p Profile) ([]ProfileChange, error)
+	GetProfile(ctx context.Context, id int64) (Profile, error)
+	// FindProfileByUsername matches case-insensitively and ignores a leading @.
+	// If several users had the name, the one seen most recently wins.
+	FindProfileByUsername(ctx context.Context, username string) (Profile, error)
+	// ListProfileChanges returns up to limit changes, newest first.
+	ListProfileChanges(ctx context.Context, id int64, limit int) ([]ProfileChange, error)
+}
+
+// RateEventRepo stores rate limit events.
+type RateEventRepo interface {
+	InsertRateEvent(ctx context.Context, telegramID int64, kind string) error
+	CountEventsSince(ctx context.Context, telegramID int64, since time.Time) (int, error)
+	// RecordRateEvent inserts an event only if the user has fewer than limit events
+	// since the cutoff (any number if limit is 0). The check and the insert are
+	// atomic, so concurrent requests cannot both take the last slot.
+	RecordRateEvent(ctx context.Context, telegramID int64, kind string, since time.Time, limit int) (bool, error)
+}
+
+// RateBucketRepo keeps GCRA limiter state shared by replicas.
+type RateBucketRepo interface {
+	// TakeRateToken atomically admits one request of kind for the user if the
+	// bucket allows it: requests are spaced interval apart, with up to burst at
+	// once. A denied request leaves the bucket unchanged and reports how long to
+	// wait.
+	TakeRateToken(ctx context.Context, telegramID int64, kind string, interval time.Duration, burst int) (ok bool, retryAfter time.Duration, err error)
+}
+
+// AccessRequestRepo stores access requests from unknown users.
+type AccessRequestRepo interface {
+	CreateAccessRequest(ctx context.Context, r AccessRequest) (AccessRequest, bool, error)
+	GetAccessRequest(ctx context.Context, id int64) (AccessRequest, error)
+	ListPendingAccessRequests(ctx context.Context) ([]AccessRequest, error)
+	DecideAccessRequest(ctx context.Context, id int64, status AccessRequestStatus, role Role, decidedBy int64) (AccessRequest, error)
+	// LastAccessDecision returns the user's most recently decided request, or ErrNotFound.
+	LastAccessDecision(ctx context.Context, telegramID int64) (AccessRequest, error)
+}
+
+// BanRepo stores bans.
+type BanRepo interface {
+	UpsertBan(ctx context.Context, b Ban) error
+	DeleteBan(ctx context.Context, telegramID int64) error
+	ListActiveBans(ctx context.Context) ([]Ban, error)
+}
+
+// TOTPRepo stores second-factor secrets.
+type TOTPRepo interface {
+	PutTOTPSecret(ctx context.Context, telegramID int64, secret string) error
+	GetTOTPSecret(ctx context.Context, telegramID int64) (TOTPSecret, error)
+	UseTOTPStep(ctx context.Context, telegramID, step int64) (bool, error)
+	DeleteTOTPSecret(ctx context.Context, telegramID int64) error
+	// ListTOTPSecrets pages through secrets by ascending telegram_id after the given one.
+	ListTOTPSecrets(ctx context.Context, after int64, limit int) ([]TOTPSecret, error)
+	// SwapTOTPSecret replaces the secret only if it still equals old, keeping the
+	// enrollment state. It reports whether the row was changed.
+	SwapTOTPSecret(ctx context.Context, telegramID int64, old, secret string) (bool, error)
+}
+
+// AuditRepo stores audit events.
+type AuditRepo interface {
+	InsertAuditEvent(ctx context.Context, ev AuditEvent) error
+	ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error)
+}
+
+// PrivacyRepo exports and erases a single user's data. Bans are kept by ForgetUser
+// so that erasing data cannot be used to lift a ban.
+type PrivacyRepo interface {
+	UserData(ctx context.Context, id int64) (UserData, error)
+	ForgetUser(ctx context.Context, id int64, policy AuditPolicy) (ForgetResult, error)
+}
+
+// SettingsRepo stores key/value settings.
+type SettingsRepo interface {
+	GetSetting(ctx context.Context, key string) (string, error)
+	PutSetting(ctx context.Context, key, value string) error
+}
+
+// BackupRepo reads and writes a Dataset. ExportData sees a consistent snapshot;
+// ImportData runs in one transaction and with replace first empties the tables
+// the dataset covers, otherwise it upserts row by row.
+type BackupRepo interface {
+	ExportData(ctx context.Context) (Dataset, error)
+	ImportData(ctx context.Context, d Dataset, replace bool) error
+}
+
+// UpdateRepo deduplicates Telegram updates redelivered after a crash or failover.
+type UpdateRepo interface {
+	// ClaimUpdate records that handler is applying the update; false means the
+	// update was claimed before and must be skipped.
+	ClaimUpdate(ctx context.Context, updateID int64, handler string) (bool, error)
+}
+
+// RetentionRepo deletes old rows in batches of at most limit, returning how many were removed.
+type RetentionRepo interface {
+	PurgeRateEvents(ctx context.Context, before time.Time, limit int) (int64, error)
+	// PurgeTokens removes tokens consumed or expired before the cutoff.
+	PurgeTokens(ctx context.Context, before time.Time, limit int) (int64, error)
+	PurgeProcessedUpdates(ctx context.Context, before time.Time, limit int) (int64, error)
+	// PurgeRateBuckets removes buckets idle (full again) since before the cutoff.
+	PurgeRateBuckets(ctx context.Context, before time.Time, limit int) (int64, error)
+}
+
+// Locker provides named locks shared by all replicas using the same database.
+// TryLock and TryLease do not wait: ok is false if someone else holds the lock.
+type Locker interface {
+	TryLock(ctx context.Context, name string) (release func(), ok bool, err error)
+	// TryLease takes a lock meant to be held for long; its holder checks it
+	// periodically to learn when it was lost.
+	TryLease(ctx context.Context, name string) (lease Lease, ok bool, err error)
+}
+
+// Lease is a long-held lock. Check fails once the lock may have been lost, for
+// example because the database connection holding it died.
+type Lease interface {
+	Check(ctx context.Context) error
+	Release()
+}
+
+// Store is the full persistence API. Lookups of missing rows return ErrNotFound.
+type Store interface {
+	UserRepo
+	ProfileRepo
+	RoleRepo
+	TokenRepo
+	RateEventRepo
+	RateBucketRepo
+	AccessRequestRepo
+	BanRepo
+	TOTPRepo
+	AuditRepo
+	PrivacyRepo
+	SettingsRepo
+	BackupRepo
+	UpdateRepo
+	RetentionRepo
+	Locker
+	Migrator
+
+	// Migrate applies all pending migrations.
+	Migrate(ctx context.Context) error
+	// Ping checks that the database is reachable.
+	Ping(ctx context.Context) error
+	Close()
+}
+
+var (
+	_ Store = (*Postgres)(nil)
+	_ Store = (*Memory)(nil)
+	_ Store = (*SQLite)(nil)
+	_ Store = (*Switch)(nil)
+)
+
+// Open picks the backend by DSN scheme: an empty DSN or memory:// keeps data in
+// process memory, sqlite://<path> opens an embedded SQLite file (sqlite:///abs/path
+// for an absolute path), postgres:// and postgresql:// (or a key=value DSN) connect
+// to PostgreSQL.
+func Open(ctx context.Context, dsn string) (Store, error) {
+	scheme, rest, ok := strings.Cut(dsn, "://")
+	if !ok && dsn != "" {
+		scheme = "postgres"
+	}
+	switch strings.ToLower(scheme) {
+	case "", "memory":
+		return NewMemory(), nil
+	case "sqlite", "sqlite3":
+		return NewSQLite(ctx, rest)
+	case "postgres", "postgresql":
+		return NewPostgres(ctx, dsn)
+	default:
+		return nil, fmt.Errorf("unsupported storage scheme %q", scheme)
+	}
+}
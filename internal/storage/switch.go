@@ -0,0 +1,532 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnavailable is returned by a Switch that has no store yet.
+var ErrUnavailable = errors.New("storage unavailable")
+
+// Switch is a Store whose backend is set once the database becomes reachable.
+// Until then every call fails with ErrUnavailable, so callers can keep a single
+// reference and degrade instead of working without a store.
+type Switch struct {
+	cur atomic.Pointer[storeRef]
+}
+
+type storeRef struct{ Store }
+
+func NewSwitch() *Switch { return &Switch{} }
+
+// Set installs the backend. It is meant to be called once.
+func (s *Switch) Set(st Store) { s.cur.Store(&storeRef{st}) }
+
+// Available reports whether a backend is set.
+func (s *Switch) Available() bool { return s.cur.Load() != nil }
+
+func (s *Switch) current() (Store, error) {
+	ref := s.cur.Load()
+	if ref == nil {
+		return nil, ErrUnavailable
+	}
+	return ref.Store, nil
+}
+
+func (s *Switch) Migrate(ctx context.Context) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.Migrate(ctx)
+}
+
+func (s *Switch) Ping(ctx context.Context) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.Ping(ctx)
+}
+
+func (s *Switch) Close() {
+	if st, err := s.current(); err == nil {
+		st.Close()
+	}
+}
+
+// Users
+
+func (s *Switch) UpsertUser(ctx context.Context, user User) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.UpsertUser(ctx, user)
+}
+
+func (s *Switch) GetUser(ctx context.Context, id int64) (User, error) {
+	st, err := s.current()
+	if err != nil {
+		return User{}, err
+	}
+	return st.GetUser(ctx, id)
+}
+
+func (s *Switch) ListUsersByRole(ctx context.Context, role Role) ([]User, error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.ListUsersByRole(ctx, role)
+}
+
+func (s *Switch) ListAuthedUserIDs(ctx context.Context) ([]int64, error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.ListAuthedUserIDs(ctx)
+}
+
+func (s *Switch) SetUserRole(ctx context.Context, id int64, role Role) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.SetUserRole(ctx, id, role)
+}
+
+func (s *Switch) SetUserAuthed(ctx context.Context, id int64, authed bool) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.SetUserAuthed(ctx, id, authed)
+}
+
+// Profiles
+
+func (s *Switch) TouchProfile(ctx context.Context, p Profile) ([]ProfileChange, error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.TouchProfile(ctx, p)
+}
+
+func (s *Switch) GetProfile(ctx context.Context, id int64) (Profile, error) {
+	st, err := s.current()
+	if err != nil {
+		return Profile{}, err
+	}
+	return st.GetProfile(ctx, id)
+}
+
+func (s *Switch) FindProfileByUsername(ctx context.Context, username string) (Profile, error) {
+	st, err := s.current()
+	if err != nil {
+		return Profile{}, err
+	}
+	return st.FindProfileByUsername(ctx, username)
+}
+
+func (s *Switch) ListProfileChanges(ctx context.Context, id int64, limit int) ([]ProfileChange, error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.ListProfileChanges(ctx, id, limit)
+}
+
+// Roles
+
+func (s *Switch) ListRoles(ctx context.Context) ([]RoleDef, error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.ListRoles(ctx)
+}
+
+func (s *Switch) GetRole(ctx context.Context, name Role) (RoleDef, error) {
+	st, err := s.current()
+	if err != nil {
+		return RoleDef{}, err
+	}
+	return st.GetRole(ctx, name)
+}
+
+func (s *Switch) UpsertRole(ctx context.Context, r RoleDef) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.UpsertRole(ctx, r)
+}
+
+func (s *Switch) SeedRole(ctx context.Context, r RoleDef) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.SeedRole(ctx, r)
+}
+
+func (s *Switch) DeleteRole(ctx context.Context, name, fallback Role, actor int64) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.DeleteRole(ctx, name, fallback, actor)
+}
+
+func (s *Switch) ReassignUnknownRoles(ctx context.Context, fallback Role) (int64, error) {
+	st, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return st.ReassignUnknownRoles(ctx, fallback)
+}
+
+// Tokens
+
+func (s *Switch) CreateToken(ctx context.Context, token string, role Role, expiresAt *time.Time, issuedBy int64, issuedTo *int64) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.CreateToken(ctx, token, role, expiresAt, issuedBy, issuedTo)
+}
+
+func (s *Switch) ConsumeToken(ctx context.Context, token string, consumeBy int64) (Role, error) {
+	st, err := s.current()
+	if err != nil {
+		return "", err
+	}
+	return st.ConsumeToken(ctx, token, consumeBy)
+}
+
+func (s *Switch) RevokeTokensIssuedBy(ctx context.Context, issuedBy int64) (int64, error) {
+	st, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return st.RevokeTokensIssuedBy(ctx, issuedBy)
+}
+
+// Rate events
+
+func (s *Switch) InsertRateEvent(ctx context.Context, telegramID int64, kind string) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.InsertRateEvent(ctx, telegramID, kind)
+}
+
+func (s *Switch) CountEventsSince(ctx context.Context, telegramID int64, since time.Time) (int, error) {
+	st, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return st.CountEventsSince(ctx, telegramID, since)
+}
+
+func (s *Switch) RecordRateEvent(ctx context.Context, telegramID int64, kind string, since time.Time, limit int) (bool, error) {
+	st, err := s.current()
+	if err != nil {
+		return false, err
+	}
+	return st.RecordRateEvent(ctx, telegramID, kind, since, limit)
+}
+
+// Rate buckets
+
+func (s *Switch) TakeRateToken(ctx context.Context, telegramID int64, kind string, interval time.Duration, burst int) (bool, time.Duration, error) {
+	st, err := s.current()
+	if err != nil {
+		return false, 0, err
+	}
+	return st.TakeRateToken(ctx, telegramID, kind, interval, burst)
+}
+
+// Access requests
+
+func (s *Switch) CreateAccessRequest(ctx context.Context, r AccessRequest) (AccessRequest, bool, error) {
+	st, err := s.current()
+	if err != nil {
+		return AccessRequest{}, false, err
+	}
+	return st.CreateAccessRequest(ctx, r)
+}
+
+func (s *Switch) GetAccessRequest(ctx context.Context, id int64) (AccessRequest, error) {
+	st, err := s.current()
+	if err != nil {
+		return AccessRequest{}, err
+	}
+	return st.GetAccessRequest(ctx, id)
+}
+
+func (s *Switch) ListPendingAccessRequests(ctx context.Context) ([]AccessRequest, error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.ListPendingAccessRequests(ctx)
+}
+
+func (s *Switch) DecideAccessRequest(ctx context.Context, id int64, status AccessRequestStatus, role Role, decidedBy int64) (AccessRequest, error) {
+	st, err := s.current()
+	if err != nil {
+		return AccessRequest{}, err
+	}
+	return st.DecideAccessRequest(ctx, id, status, role, decidedBy)
+}
+
+func (s *Switch) LastAccessDecision(ctx context.Context, telegramID int64) (AccessRequest, error) {
+	st, err := s.current()
+	if err != nil {
+		return AccessRequest{}, err
+	}
+	return st.LastAccessDecision(ctx, telegramID)
+}
+
+// Bans
+
+func (s *Switch) UpsertBan(ctx context.Context, b Ban) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.UpsertBan(ctx, b)
+}
+
+func (s *Switch) DeleteBan(ctx context.Context, telegramID int64) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.DeleteBan(ctx, telegramID)
+}
+
+func (s *Switch) ListActiveBans(ctx context.Context) ([]Ban, error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.ListActiveBans(ctx)
+}
+
+// TOTP
+
+func (s *Switch) PutTOTPSecret(ctx context.Context, telegramID int64, secret string) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.PutTOTPSecret(ctx, telegramID, secret)
+}
+
+func (s *Switch) GetTOTPSecret(ctx context.Context, telegramID int64) (TOTPSecret, error) {
+	st, err := s.current()
+	if err != nil {
+		return TOTPSecret{}, err
+	}
+	return st.GetTOTPSecret(ctx, telegramID)
+}
+
+func (s *Switch) UseTOTPStep(ctx context.Context, telegramID, step int64) (bool, error) {
+	st, err := s.current()
+	if err != nil {
+		return false, err
+	}
+	return st.UseTOTPStep(ctx, telegramID, step)
+}
+
+func (s *Switch) DeleteTOTPSecret(ctx context.Context, telegramID int64) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.DeleteTOTPSecret(ctx, telegramID)
+}
+
+func (s *Switch) ListTOTPSecrets(ctx context.Context, after int64, limit int) ([]TOTPSecret, error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.ListTOTPSecrets(ctx, after, limit)
+}
+
+func (s *Switch) SwapTOTPSecret(ctx context.Context, telegramID int64, old, secret string) (bool, error) {
+	st, err := s.current()
+	if err != nil {
+		return false, err
+	}
+	return st.SwapTOTPSecret(ctx, telegramID, old, secret)
+}
+
+// Audit
+
+func (s *Switch) InsertAuditEvent(ctx context.Context, ev AuditEvent) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.InsertAuditEvent(ctx, ev)
+}
+
+func (s *Switch) ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.ListAuditEvents(ctx, f)
+}
+
+// Privacy
+
+func (s *Switch) UserData(ctx context.Context, id int64) (UserData, error) {
+	st, err := s.current()
+	if err != nil {
+		return UserData{}, err
+	}
+	return st.UserData(ctx, id)
+}
+
+func (s *Switch) ForgetUser(ctx context.Context, id int64, policy AuditPolicy) (ForgetResult, error) {
+	st, err := s.current()
+	if err != nil {
+		return ForgetResult{}, err
+	}
+	return st.ForgetUser(ctx, id, policy)
+}
+
+// Settings
+
+func (s *Switch) GetSetting(ctx context.Context, key string) (string, error) {
+	st, err := s.current()
+	if err != nil {
+		return "", err
+	}
+	return st.GetSetting(ctx, key)
+}
+
+func (s *Switch) PutSetting(ctx context.Context, key, value string) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.PutSetting(ctx, key, value)
+}
+
+// Backup
+
+func (s *Switch) ExportData(ctx context.Context) (Dataset, error) {
+	st, err := s.current()
+	if err != nil {
+		return Dataset{}, err
+	}
+	return st.ExportData(ctx)
+}
+
+func (s *Switch) ImportData(ctx context.Context, d Dataset, replace bool) error {
+	st, err := s.current()
+	if err != nil {
+		return err
+	}
+	return st.ImportData(ctx, d, replace)
+}
+
+// Updates
+
+func (s *Switch) ClaimUpdate(ctx context.Context, updateID int64, handler string) (bool, error) {
+	st, err := s.current()
+	if err != nil {
+		return false, err
+	}
+	return st.ClaimUpdate(ctx, updateID, handler)
+}
+
+// Retention
+
+func (s *Switch) PurgeRateEvents(ctx context.Context, before time.Time, limit int) (int64, error) {
+	st, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return st.PurgeRateEvents(ctx, before, limit)
+}
+
+func (s *Switch) PurgeTokens(ctx context.Context, before time.Time, limit int) (int64, error) {
+	st, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return st.PurgeTokens(ctx, before, limit)
+}
+
+func (s *Switch) PurgeProcessedUpdates(ctx context.Context, before time.Time, limit int) (int64, error) {
+	st, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return st.PurgeProcessedUpdates(ctx, before, limit)
+}
+
+func (s *Switch) PurgeRateBuckets(ctx context.Context, before time.Time, limit int) (int64, error) {
+	st, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return st.PurgeRateBuckets(ctx, before, limit)
+}
+
+// Locks
+
+func (s *Switch) TryLock(ctx context.Context, name string) (release func(), ok bool, err error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, false, err
+	}
+	return st.TryLock(ctx, name)
+}
+
+func (s *Switch) TryLease(ctx context.Context, name string) (Lease, bool, error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, false, err
+	}
+	return st.TryLease(ctx, name)
+}
+
+// Migrations
+
+func (s *Switch) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	st, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.MigrationStatus(ctx)
+}
+
+func (s *Switch) MigrateUp(ctx context.Context, steps int) (int, error) {
+	st, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return st.MigrateUp(ctx, steps)
+}
+
+func (s *Switch) MigrateDown(ctx context.Context, steps int) (int, error) {
+	st, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return st.MigrateDown(ctx, steps)
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/joho/godotenv"
 
@@ -10,21 +12,78 @@ import (
 	"ProxyaService/internal/bot"
 	"ProxyaService/internal/config"
 	"ProxyaService/internal/logger"
+	"ProxyaService/internal/roles"
+	"ProxyaService/internal/storage"
 )
 
 func main() {
 	_ = godotenv.Load()
+	if f := os.Getenv("CONFIG_FILE"); f != "" {
+		_ = godotenv.Load(f)
+	}
 
 	conf := config.Load()
 	log := logger.New(conf.LogLevel)
+	if conf.AuthTokensErr != nil {
+		log.Error("static tokens file cannot be read, only inline tokens are active", slog.String("error", conf.AuthTokensErr.Error()))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(conf, os.Args[2:]); err != nil {
+			log.Error("migrate failed", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		if err := runBackup(conf, os.Args[2:]); err != nil {
+			log.Error("backup failed", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "secrets" {
+		if err := runSecrets(conf, os.Args[2:]); err != nil {
+			log.Error("secrets failed", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
 
 	if conf.BotToken == "" {
 		log.Error("BOT token is not set. Define TOKEN or BOT_TOKEN in environment/.env")
 		os.Exit(1)
 	}
+	if conf.LeaderElection && conf.StorageStartup == "degraded" {
+		// the leader lock lives in the database, so no replica would poll until it is reachable
+		log.Error("STORAGE_STARTUP=degraded requires LEADER_ELECTION=false and a single replica")
+		os.Exit(1)
+	}
+
+	r := roles.New(auth.BuiltinRoles(conf.RatePerMinFree, conf.RatePerMinPremium, conf.RatePerMinAdmin), storage.Role(conf.DefaultRole))
+	a := auth.New(auth.OptionsFromConfig(conf, r))
+	b := bot.New(log, conf, a, r)
+
+	// SIGHUP reloads whitelist, tokens, proxy settings and limits without restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := b.Reload(); err != nil {
+				log.Error("reload failed", slog.String("error", err.Error()))
+			}
+		}
+	}()
 
-	a := auth.New(conf.AllowedUserIDs, conf.AuthTokens)
-	b := bot.New(log, conf, a)
+	// SIGINT/SIGTERM cancel in-flight updates and stop polling
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-stop
+		log.Info("shutting down", slog.String("signal", sig.String()))
+		b.Stop()
+	}()
 
 	if err := b.Start(); err != nil {
 		log.Error("bot stopped with error", slog.String("error", err.Error()))
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"ProxyaService/internal/config"
+	"ProxyaService/internal/storage"
+)
+
+const migrateUsage = "usage: app migrate [status | up [N|all] | down [N|all]]"
+
+// runMigrate implements the "migrate" subcommand against the configured storage.
+// "up" applies all pending migrations unless N is given, "down" rolls back one;
+// rolling back everything takes an explicit "all", never a zero count.
+func runMigrate(conf config.Config, args []string) error {
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	steps := 0
+	if cmd == "down" {
+		steps = 1
+	}
+	if len(args) > 1 && args[1] == "all" {
+		steps = 0
+	} else if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("bad step count %q\n%s", args[1], migrateUsage)
+		}
+		steps = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	st, err := storage.Open(ctx, conf.PostgresDSN)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	switch cmd {
+	case "status":
+		list, err := st.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			fmt.Println("no migrations for this storage")
+		}
+		for _, m := range list {
+			state := "pending"
+			if m.AppliedAt != nil {
+				state = "applied " + m.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d %-30s %s\n", m.Version, m.Name, state)
+		}
+	case "up":
+		n, err := st.MigrateUp(ctx, steps)
+		fmt.Printf("applied %d migration(s)\n", n)
+		return err
+	case "down":
+		n, err := st.MigrateDown(ctx, steps)
+		fmt.Printf("rolled back %d migration(s)\n", n)
+		return err
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return fmt.Errorf("unknown migrate command %q", cmd)
+	}
+	return nil
+}
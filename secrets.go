@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"ProxyaService/internal/config"
+	"ProxyaService/internal/storage"
+)
+
+const secretsUsage = "usage: app secrets genkey | app secrets reencrypt"
+
+// runSecrets implements the "secrets" subcommand. genkey prints a new random key;
+// reencrypt seals every stored secret with the newest configured key version.
+func runSecrets(conf config.Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New(secretsUsage)
+	}
+	switch args[0] {
+	case "genkey":
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return nil
+	case "reencrypt":
+	default:
+		return errors.New(secretsUsage)
+	}
+
+	keys, err := storage.LoadKeyring(conf.SecretKeys, conf.SecretKeysFile)
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return errors.New("no keys configured: set SECRET_KEYS or SECRET_KEYS_FILE")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	st, err := storage.Open(ctx, conf.PostgresDSN)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	if err := st.Migrate(ctx); err != nil {
+		return err
+	}
+	box := storage.NewSecretBox(st, keys).(*storage.SecretBox)
+	release, ok, err := box.TryLock(ctx, "secrets.reencrypt")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("re-encryption is already running elsewhere")
+	}
+	defer release()
+	n, err := box.Reencrypt(ctx, conf.MaintenanceBatch)
+	fmt.Printf("re-encrypted %d secrets with key version %d\n", n, keys.Primary())
+	return err
+}